@@ -0,0 +1,37 @@
+package jingo
+
+// allocbuffer.go manages Buffers whose backing storage comes from a caller supplied Allocator,
+// e.g a request scoped arena, rather than the GC'd heap. The buffer makes sure there's always some
+// headroom available from the allocator at each checkpoint the encoders pass, so the appends made
+// between them don't need to reach for the heap.
+
+// Allocator provides the backing storage for a Buffer, see NewBufferWithAllocator. An allocator
+// wrapping the experimental arena package would look something like
+//
+//	type arenaAllocator struct{ a *arena.Arena }
+//
+//	func (x arenaAllocator) Alloc(n int) []byte { return arena.MakeSlice[byte](x.a, 0, n) }
+type Allocator interface {
+	// Alloc returns an empty slice with a capacity of at least n
+	Alloc(n int) []byte
+}
+
+// allocHeadroom is the least amount of free capacity an allocator backed buffer keeps on hand
+// between checkpoints. A single value bigger than this can still cause append to grow the buffer
+// on the heap.
+const allocHeadroom = 1024
+
+// NewBufferWithAllocator returns a new Buffer with an initial capacity of `size` bytes which is
+// allocated from a, as is any further capacity it needs as it grows. Buffers created this way are
+// never pooled, 'ReturnToPool' simply detaches the allocator.
+func NewBufferWithAllocator(a Allocator, size int) *Buffer {
+	b := &Buffer{alloc: a}
+	b.Bytes = a.Alloc(size + allocHeadroom)
+	return b
+}
+
+// allocGrow replaces Bytes with a larger copy from the allocator, with at least n bytes free
+func (b *Buffer) allocGrow(n int) {
+	nb := b.alloc.Alloc(2*cap(b.Bytes) + n)
+	b.Bytes = append(nb, b.Bytes...)
+}
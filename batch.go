@@ -0,0 +1,23 @@
+package jingo
+
+// batch.go writes several independent values, each with its own encoder, as a single array. This
+// suits bulk endpoints which aggregate results of differing types into one response.
+
+// BatchItem is a single element of the array written by MarshalBatch. A nil Enc writes null.
+type BatchItem struct {
+	Enc   Encoder
+	Value interface{}
+}
+
+// MarshalBatch writes items as the elements of a single array, in order.
+func MarshalBatch(buf *Buffer, items ...BatchItem) {
+	buf.BeginArray()
+	for _, it := range items {
+		if it.Enc == nil {
+			buf.WriteNull()
+			continue
+		}
+		buf.WriteValue(it.Enc, it.Value)
+	}
+	buf.EndArray()
+}
@@ -7,17 +7,64 @@ package jingo
 // profile quite significantly.
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash"
 	"io"
 	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 	"unsafe"
 )
 
 // Buffer is used to pass on to the encoders Marshal methods.
 type Buffer struct {
 	Bytes []byte
+
+	err   error // the reason encoding was abandoned, if it was
+	limit int   // maximum length of the content, zero when unlimited
+	mark  int   // length of Bytes at which the encoders next need to call checkpoint
+	off   int   // length of the content which has been moved out of Bytes
+
+	segs    []*Buffer // sealed segments of content preceding Bytes, see NewSegmentedBuffer
+	segSize int       // length at which Bytes is sealed into segs, zero if never
+	iov     [][]byte  // scratch space for WriteTo
+
+	dst     io.Writer  // writer content is flushed to, see NewStreamingBuffer
+	flushAt int        // length at which Bytes is flushed to dst
+	spill   *spillFile // temporary file dst spills to, see NewSpillBuffer
+
+	lender availableBufferWriter // dst whose free space Bytes is borrowed from, see MarshalTo
+
+	alloc Allocator // provides the backing storage, see NewBufferWithAllocator
+	sized bool      // belongs to one of the size class pools rather than the general one
+
+	hash   hash.Hash // digest of the content, see SetHash
+	hashed int       // length of Bytes already written to hash
+
+	nest []bool // token writer nesting, each entry is true once its object or array holds a value
+	key  bool   // the token writer has just written a key
+
+	esc escapeMode // how WriteQuotedString escapes, that of the encoder running a custom encoder
+
+	ctx context.Context // checked for cancellation as the document is written, see MarshalContext
 }
 
-var _ io.Writer = &Buffer{} // commit to compatibility with io.Writer
+// ErrBufferLimit is reported by Buffer.Err once a document has outgrown the limit set with SetLimit.
+var ErrBufferLimit = errors.New("jingo: buffer limit exceeded")
+
+const maxInt = int(^uint(0) >> 1)
+
+// hashChunk is how many bytes are left to build up before being written to an attached hash, big
+// enough to amortise the call and small enough that they're still in cache.
+const hashChunk = 4096
+
+var _ io.Writer = &Buffer{}     // commit to compatibility with io.Writer
+var _ io.ReaderFrom = &Buffer{} // and io.ReaderFrom
+
+// minRead is the least amount of free space ReadFrom offers to a Read call
+const minRead = 512
 
 // Write a chunk of bytes to the buffer
 func (b *Buffer) Write(v []byte) (int, error) {
@@ -36,29 +83,339 @@ func (b *Buffer) WriteByte(v byte) error {
 	return nil
 }
 
+// WriteQuotedString writes a string as a quoted JSON string, escaping its content in the same
+// way as the `,escape` option. Custom encoders should prefer this over escaping strings themselves,
+// as within an encoder compiled with Config.EscapeHTML or Config.ASCII it escapes as they do.
+func (b *Buffer) WriteQuotedString(v string) {
+	b.Bytes = append(b.Bytes, '"')
+	escapers[b.esc].escape(v, b)
+	b.Bytes = append(b.Bytes, '"')
+}
+
+// WriteRune writes the UTF-8 encoding of a single rune into the output buffer
+func (b *Buffer) WriteRune(r rune) (int, error) {
+	if r < utf8.RuneSelf {
+		b.Bytes = append(b.Bytes, byte(r))
+		return 1, nil
+	}
+
+	var p [utf8.UTFMax]byte
+	n := utf8.EncodeRune(p[:], r)
+	b.Bytes = append(b.Bytes, p[:n]...)
+	return n, nil
+}
+
 // Reset allows this to be reused by emptying
 func (b *Buffer) Reset() {
 	b.Bytes = b.Bytes[:0]
+	b.err = nil
+	b.mark = 0
+	b.off = 0
+	b.releaseSegments()
+	if b.spill != nil {
+		b.spill.remove()
+	}
+	if b.hash != nil {
+		b.hash.Reset()
+		b.hashed = 0
+	}
+	b.nest = b.nest[:0]
+	b.esc = 0
+	b.key = false
+}
+
+// Grow makes sure another n bytes can be written to the buffer without it being reallocated. The
+// growth of streaming, segmented and limited buffers is capped to what they'd hold at a checkpoint,
+// and buffers borrowing a writer's memory don't grow ahead of need, see MarshalTo.
+func (b *Buffer) Grow(n int) {
+	if cap(b.Bytes)-len(b.Bytes) < n {
+		b.grow(n)
+	}
+}
+
+// grow is the slow path of Grow, kept separate so Grow can be inlined
+func (b *Buffer) grow(n int) {
+	if b.lender != nil { // there's only the writer's memory to use, checkpoints keep room in it
+		return
+	}
+	if b.dst != nil && n > b.flushAt {
+		n = b.flushAt
+	}
+	if b.segSize > 0 && n > b.segSize {
+		n = b.segSize
+	}
+	if b.limit > 0 && n > b.limit-b.Len() {
+		n = b.limit - b.Len()
+	}
+	if cap(b.Bytes)-len(b.Bytes) < n {
+		b.realloc(n)
+	}
+}
+
+// realloc moves Bytes to a larger backing array with at least n bytes free
+func (b *Buffer) realloc(n int) {
+	if b.alloc != nil {
+		b.allocGrow(n)
+		return
+	}
+
+	nb := make([]byte, len(b.Bytes), 2*cap(b.Bytes)+n)
+	copy(nb, b.Bytes)
+	b.Bytes = nb
+}
+
+// Reserve returns a window of n bytes beyond the end of the buffer's content for the caller to
+// write into directly, e.g with strconv.AppendInt(w[:0], ...). The content of the window is
+// undefined. Call Commit with the number of bytes written to add them to the buffer.
+func (b *Buffer) Reserve(n int) []byte {
+	if cap(b.Bytes)-len(b.Bytes) < n {
+		b.realloc(n)
+	}
+
+	l := len(b.Bytes)
+	return b.Bytes[l : l+n]
+}
+
+// Commit adds the first `written` bytes of the window returned by Reserve to the buffer.
+func (b *Buffer) Commit(written int) {
+	b.Bytes = b.Bytes[:len(b.Bytes)+written]
+}
+
+// SetLimit sets the maximum number of bytes the buffer can hold before the encoders abandon the
+// document. The limit is checked between values, so the buffer can overshoot it by a single value
+// before encoding stops. A limit of zero or less removes it.
+func (b *Buffer) SetLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	b.limit = n
+	b.mark = 0
+}
+
+// Err returns the reason the encoders abandoned the document written to this buffer, if they did.
+// The contents of the buffer are incomplete when this is not nil.
+func (b *Buffer) Err() error {
+	return b.err
+}
+
+// fail abandons the document being written to this buffer, with err reported by Err.
+func (b *Buffer) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+	b.mark = 0
+}
+
+// ok is called by the encoders between values and reports whether they should carry on writing.
+// It's kept small enough to be inlined, the real work happens in checkpoint.
+func (b *Buffer) ok() bool {
+	return len(b.Bytes) < b.mark || b.checkpoint()
+}
+
+// checkpoint applies any limits to the buffer and works out where the next one is due.
+func (b *Buffer) checkpoint() bool {
+	if b.err != nil {
+		return false
+	}
+
+	if b.ctx != nil {
+		if err := b.ctx.Err(); err != nil {
+			b.fail(err)
+			return false
+		}
+	}
+
+	if b.limit > 0 && b.off+len(b.Bytes) > b.limit {
+		b.err = ErrBufferLimit
+		b.mark = 0
+		return false
+	}
+
+	if b.hash != nil && len(b.Bytes)-b.hashed >= hashChunk {
+		b.hashPending()
+	}
+
+	if b.dst != nil && len(b.Bytes) >= b.flushAt {
+		if b.flush(); b.err != nil {
+			return false
+		}
+	}
+
+	if b.segSize > 0 && len(b.Bytes) >= b.segSize {
+		b.seal()
+	}
+
+	if b.alloc != nil && cap(b.Bytes)-len(b.Bytes) < allocHeadroom {
+		b.allocGrow(allocHeadroom)
+	}
+
+	b.mark = maxInt
+	if b.limit > 0 {
+		b.mark = b.limit + 1 - b.off
+	}
+	if b.hash != nil && b.hashed+hashChunk < b.mark {
+		b.mark = b.hashed + hashChunk
+	}
+	if b.segSize > 0 && b.segSize < b.mark {
+		b.mark = b.segSize
+	}
+	if b.dst != nil && b.flushAt < b.mark {
+		b.mark = b.flushAt
+	}
+	if b.alloc != nil && cap(b.Bytes)-allocHeadroom < b.mark {
+		b.mark = cap(b.Bytes) - allocHeadroom
+	}
+	if b.ctx != nil && len(b.Bytes)+ctxChunk < b.mark {
+		b.mark = len(b.Bytes) + ctxChunk
+	}
+	return true
+}
+
+// Len returns the length of the buffer's content, which is longer than Bytes when some of
+// it has been moved elsewhere.
+func (b *Buffer) Len() int {
+	return b.off + len(b.Bytes)
 }
 
+// SetHash attaches a hash to the buffer, which the content is written to incrementally as the
+// encoders work through a document so the digest is ready as soon as they are done. Content must
+// not be modified once written when a hash is attached. Passing nil detaches the hash.
+func (b *Buffer) SetHash(h hash.Hash) {
+	if h != nil {
+		h.Reset()
+	}
+	b.hash = h
+	b.hashed = 0
+	b.mark = 0
+}
+
+// Sum appends the digest of the buffer's content to in and returns the result. It returns in
+// unchanged if no hash has been attached with SetHash.
+func (b *Buffer) Sum(in []byte) []byte {
+	if b.hash == nil {
+		return in
+	}
+
+	b.hashPending()
+	return b.hash.Sum(in)
+}
+
+// hashPending writes the content not yet seen by the attached hash to it
+func (b *Buffer) hashPending() {
+	if b.hashed < len(b.Bytes) {
+		b.hash.Write(b.Bytes[b.hashed:])
+		b.hashed = len(b.Bytes)
+	}
+}
+
+// ETag returns the digest of the buffer's content as a quoted, hex encoded string fit for use as
+// a strong HTTP ETag. It requires a hash to have been attached with SetHash.
+func (b *Buffer) ETag() string {
+	var d [64]byte
+	sum := b.Sum(d[:0])
+
+	t := make([]byte, hex.EncodedLen(len(sum))+2)
+	t[0], t[len(t)-1] = '"', '"'
+	hex.Encode(t[1:], sum)
+	return string(t)
+}
+
+// String returns a copy of the buffer's content as a string, which remains valid after the buffer
+// is reset or returned to the pool.
 func (b *Buffer) String() string {
+	return string(b.Bytes)
+}
+
+// UnsafeString returns the buffer's content as a string without copying it. The string shares
+// memory with the buffer, so it's silently corrupted by any further use of the buffer, including
+// returning it to the pool - only use it where the string is discarded before that happens.
+func (b *Buffer) UnsafeString() string {
 	return *(*string)(unsafe.Pointer(&b.Bytes))
 }
 
+// ReadFrom appends data from r until EOF, allowing pre-encoded JSON to be spliced into a document
+// straight from its source. It respects any limit set on the buffer.
+func (b *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	for {
+		if !b.ok() {
+			return n, b.err
+		}
+
+		l := len(b.Bytes)
+		if cap(b.Bytes)-l < minRead {
+			b.Bytes = append(b.Bytes, make([]byte, minRead)...)[:l]
+		}
+
+		m, err := r.Read(b.Bytes[l:cap(b.Bytes)])
+		b.Bytes = b.Bytes[:l+m]
+		n += int64(m)
+
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
 // WriteTo writes the contents of our buffer to an io.Writer
 func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	if len(b.segs) > 0 {
+		return b.writeSegmentsTo(w)
+	}
+	if b.spill != nil {
+		return b.writeSpillTo(w)
+	}
+
 	n, err := w.Write(b.Bytes)
 	return int64(n), err
 }
 
 var bufpool = sync.Pool{
-	New: func() interface{} { return &Buffer{} },
+	New: func() interface{} {
+		if poolStatsEnabled() {
+			atomic.AddUint64(&poolStats.Misses, 1)
+		}
+		return &Buffer{}
+	},
+}
+
+// poolingOff is set when pooling has been disabled with EnablePooling
+var poolingOff uint32
+
+// EnablePooling switches buffer pooling on or off, it's on by default. With pooling off each
+// buffer is freshly allocated and 'ReturnToPool' simply drops it, trading speed for memory which
+// is attributed to its real owner in heap profiles.
+func EnablePooling(on bool) {
+	var v uint32
+	if !on {
+		v = 1
+	}
+	atomic.StoreUint32(&poolingOff, v)
+}
+
+func poolingEnabled() bool {
+	return atomic.LoadUint32(&poolingOff) == 0
+}
+
+// getBuffer retrieves a buffer from the pool as-is
+func getBuffer() *Buffer {
+	if !poolingEnabled() {
+		return &Buffer{}
+	}
+
+	if poolStatsEnabled() {
+		atomic.AddUint64(&poolStats.Gets, 1)
+	}
+	return bufpool.Get().(*Buffer)
 }
 
 // NewBufferFromPool returns a pointer to a zerod Buffer. This may be retrieved from a
 // pool. When you're done with it, call 'ReturnToPool'.
 func NewBufferFromPool() *Buffer {
-	b := bufpool.Get().(*Buffer)
+	b := getBuffer()
 	b.Reset()
 	return b
 }
@@ -66,12 +423,11 @@ func NewBufferFromPool() *Buffer {
 // NewBufferFromPoolWithCap returns a pointer to a zero'd Buffer with its underlying
 // capacity set. This may be retrieved from a pool. When you're done with it, call 'ReturnToPool'.
 func NewBufferFromPoolWithCap(size int) *Buffer {
-	b := bufpool.Get().(*Buffer)
+	b := getClassBuffer(size)
+	b.Reset()
 
-	if c := cap(b.Bytes); c < size {
+	if cap(b.Bytes) < size {
 		b.Bytes = make([]byte, 0, size)
-	} else if c > 0 {
-		b.Reset()
 	}
 
 	return b
@@ -80,5 +436,38 @@ func NewBufferFromPoolWithCap(size int) *Buffer {
 // ReturnToPool puts this instance back in the underlying pool. Reading from or using this instance
 // in any way after calling this is invalid.
 func (b *Buffer) ReturnToPool() {
-	bufpool.Put(b)
+	if b.alloc != nil {
+		b.alloc, b.Bytes = nil, nil
+		return
+	}
+
+	b.err, b.limit, b.mark = nil, 0, 0
+	b.hash, b.hashed = nil, 0
+	b.off, b.segSize = 0, 0
+	b.dst, b.flushAt = nil, 0
+	b.ctx = nil
+	if b.spill != nil {
+		b.spill.remove()
+		b.spill = nil
+	}
+	b.releaseSegments()
+
+	putBuffer(b)
+}
+
+// Clone returns a copy of the buffer retrieved from the pool. The copy shares no memory with
+// the original, so each can be used and returned to the pool independently of the other. Content
+// already flushed out of a streaming or spilling buffer isn't included.
+func (b *Buffer) Clone() *Buffer {
+	n := len(b.Bytes) // not Len, which counts what's been flushed or spilled too
+	for _, s := range b.segs {
+		n += len(s.Bytes)
+	}
+
+	c := NewBufferFromPoolWithCap(n)
+	for _, s := range b.segs {
+		c.Bytes = append(c.Bytes, s.Bytes...)
+	}
+	c.Bytes = append(c.Bytes, b.Bytes...)
+	return c
 }
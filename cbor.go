@@ -0,0 +1,203 @@
+package jingo
+
+// cbor.go provides CBOR (RFC 8949) output for services switching wire format. It's a transcoder
+// rather than a second backend: there are no CBOR writers behind the compiled instructions, the JSON
+// document they write is converted in a single pass instead. Every tag option and registered type
+// encoder applies in the same way as it does to JSON, with no new tags or encoders needed, but the
+// CBOR can hold no more than the JSON does. Values the JSON writes as strings stay text strings,
+// so ,string numbers and bools, times and raw bytes don't become CBOR numbers, tagged dates or byte
+// strings.
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// CBOR major types, shifted into the high bits of the initial byte
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+)
+
+const (
+	cborFalse      = 0xf4
+	cborTrue       = 0xf5
+	cborNull       = 0xf6
+	cborFloat64    = 0xfb
+	cborIndefinite = 0x1f // length of an array or map terminated by cborBreak
+	cborBreak      = 0xff
+)
+
+// MarshalCBOR writes v, encoded by enc, into buf transcoded from JSON to CBOR, as ToCBOR does.
+// Objects and arrays are written with indefinite lengths, integers as CBOR integers, other numbers
+// as 64 bit floats, and strings, whatever they hold, as text strings.
+func MarshalCBOR(enc Encoder, v interface{}, buf *Buffer) error {
+	scratch := getScratch()
+	defer putScratch(scratch)
+
+	enc.Marshal(v, scratch)
+	if err := scratch.Err(); err != nil {
+		return err
+	}
+	return ToCBOR(buf, scratch.Bytes)
+}
+
+// ToCBOR transcodes the JSON document in src to CBOR, appending it to dst, as MarshalCBOR writes. A
+// *DecodeError is returned should src be invalid, leaving dst with a partial document, as is the
+// error of dst should it fail, i.e on reaching its limit.
+func ToCBOR(dst *Buffer, src []byte) error {
+	s := getScanner(src)
+	defer putScanner(s)
+
+	if err := cborValue(s, dst, 0); err != nil {
+		return err
+	}
+	if err := s.end(); err != nil {
+		return err
+	}
+	dst.ok()
+	return dst.Err()
+}
+
+// cborValue transcodes the next value
+func cborValue(s *scanner, dst *Buffer, depth int) error {
+	if depth > maxDepth {
+		return s.errorf("exceeded max depth")
+	}
+	if !dst.ok() { // a limit, flush or cancellation, as between the values of any document
+		return dst.Err()
+	}
+
+	switch s.next() {
+	case '{':
+		s.pos++
+		dst.WriteByte(cborMap | cborIndefinite)
+		if s.next() == '}' {
+			s.pos++
+			return dst.WriteByte(cborBreak)
+		}
+		for {
+			k, err := s.string()
+			if err != nil {
+				return err
+			}
+			cborHead(dst, cborText, uint64(len(k)))
+			dst.Write(k)
+
+			if err := s.consume(':'); err != nil {
+				return err
+			}
+			if err := cborValue(s, dst, depth+1); err != nil {
+				return err
+			}
+
+			done, err := s.more('}')
+			if err != nil {
+				return err
+			}
+			if done {
+				return dst.WriteByte(cborBreak)
+			}
+		}
+
+	case '[':
+		s.pos++
+		dst.WriteByte(cborArray | cborIndefinite)
+		if s.next() == ']' {
+			s.pos++
+			return dst.WriteByte(cborBreak)
+		}
+		for {
+			if err := cborValue(s, dst, depth+1); err != nil {
+				return err
+			}
+
+			done, err := s.more(']')
+			if err != nil {
+				return err
+			}
+			if done {
+				return dst.WriteByte(cborBreak)
+			}
+		}
+
+	case '"':
+		b, err := s.string()
+		if err != nil {
+			return err
+		}
+		cborHead(dst, cborText, uint64(len(b)))
+		dst.Write(b)
+		return nil
+
+	case 't', 'f':
+		v, err := s.bool()
+		if err != nil {
+			return err
+		}
+		if v {
+			return dst.WriteByte(cborTrue)
+		}
+		return dst.WriteByte(cborFalse)
+
+	case 'n':
+		if !s.null() {
+			return s.unexpected("a value")
+		}
+		return dst.WriteByte(cborNull)
+	}
+
+	start := s.pos
+	b, err := s.number()
+	if err != nil {
+		return err
+	}
+
+	if n, err := strconv.ParseUint(string(b), 10, 64); err == nil {
+		cborHead(dst, cborUint, n)
+		return nil
+	}
+	if n, err := strconv.ParseInt(string(b), 10, 64); err == nil && n < 0 {
+		cborHead(dst, cborNegInt, uint64(-1-n))
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return &DecodeError{Offset: start, Msg: err.Error()}
+	}
+	var h [9]byte
+	h[0] = cborFloat64
+	binary.BigEndian.PutUint64(h[1:], math.Float64bits(f))
+	dst.Write(h[:])
+	return nil
+}
+
+// cborHead writes the initial bytes of an item of the given major type with argument n, i.e the
+// value of an integer or the length of a string
+func cborHead(dst *Buffer, major byte, n uint64) {
+	var h [9]byte
+	switch {
+	case n < 24:
+		dst.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		h[0], h[1] = major|24, byte(n)
+		dst.Write(h[:2])
+	case n <= math.MaxUint16:
+		h[0] = major | 25
+		binary.BigEndian.PutUint16(h[1:], uint16(n))
+		dst.Write(h[:3])
+	case n <= math.MaxUint32:
+		h[0] = major | 26
+		binary.BigEndian.PutUint32(h[1:], uint32(n))
+		dst.Write(h[:5])
+	default:
+		h[0] = major | 27
+		binary.BigEndian.PutUint64(h[1:], n)
+		dst.Write(h[:])
+	}
+}
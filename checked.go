@@ -0,0 +1,56 @@
+package jingo
+
+// checked.go provides Marshal variants which verify the value they're given is of the type the
+// encoder was compiled for. Marshal itself trusts the caller, so a mismatch there silently produces
+// garbage or crashes. The check is a comparison of type pointers, so costs next to nothing.
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// ErrTypeMismatch is returned by MarshalChecked when the value isn't of the encoder's type.
+var ErrTypeMismatch = errors.New("jingo: value doesn't match the type the encoder was compiled for")
+
+// typeOf returns the type pointer held by an interface holding v
+func typeOf(v interface{}) unsafe.Pointer {
+	return (*iface)(unsafe.Pointer(&v)).Type
+}
+
+// MarshalChecked is Marshal, but first checks s is the struct or a pointer to the struct the encoder
+// was compiled for, returning an error wrapping ErrTypeMismatch if not. A struct is copied before
+// encoding, so passing a pointer is cheaper.
+func (e *StructEncoder) MarshalChecked(s interface{}, w *Buffer) error {
+	c := e
+	if c.base != nil {
+		c = c.base
+	}
+
+	switch typeOf(s) {
+	case c.ptrTyp:
+	case c.typ:
+		// the interface's data word only points at the struct for some types, a struct holding a
+		// single pointer is stored in it directly, so work from a copy the encoder can address
+		p := reflect.New(reflect.TypeOf(s))
+		p.Elem().Set(reflect.ValueOf(s))
+		s = p.Interface()
+	default:
+		return fmt.Errorf("%w: want %s, got %T", ErrTypeMismatch, reflect.TypeOf(c.t), s)
+	}
+
+	e.Marshal(s, w)
+	return nil
+}
+
+// MarshalChecked is Marshal, but first checks s is a pointer to the slice type the encoder was
+// compiled for, returning an error wrapping ErrTypeMismatch if not.
+func (e *SliceEncoder) MarshalChecked(s interface{}, w *Buffer) error {
+	if typeOf(s) != e.ptrTyp {
+		return fmt.Errorf("%w: want *%s, got %T", ErrTypeMismatch, e.tt, s)
+	}
+
+	e.Marshal(s, w)
+	return nil
+}
@@ -0,0 +1,88 @@
+package jingo
+
+// codec.go provides Codec, which marshals and unmarshals values of any type the package level
+// Marshal supports through a pair of methods shaped like those of gRPC's encoding.Codec and the
+// like, so jingo can be plugged into frameworks which take a codec without either depending on
+// the other. Decoders are compiled the first time a type is seen and cached against it, as the
+// encoders are.
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Codec marshals values with the encoders Marshal uses and unmarshals them with decoders cached in
+// the same way. It has no state, so the zero value is ready to use and safe for concurrent use.
+// Values must be structs or slices, passed by pointer to Unmarshal.
+type Codec struct{}
+
+// unmarshaler is implemented by StructDecoder and SliceDecoder
+type unmarshaler interface {
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// decoders caches the decoder for each type passed to Codec.Unmarshal, keyed by its reflect.Type
+var decoders sync.Map
+
+// Marshal returns the encoding of v, as written by Marshal, as a new byte slice.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	Marshal(v, b)
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(b.Bytes))
+	copy(out, b.Bytes)
+
+	return out, nil
+}
+
+// Unmarshal decodes data into v, a pointer to a struct or slice. An error wrapping
+// ErrUnsupportedType is returned should v be anything else.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return fmt.Errorf("%w: %T, want a pointer", ErrUnsupportedType, v)
+	}
+
+	d, err := cachedDecoder(t)
+	if err != nil {
+		return err
+	}
+	return d.Unmarshal(data, v)
+}
+
+// Name returns the name of the content subtype the codec handles, as gRPC's encoding.Codec requires.
+func (Codec) Name() string {
+	return "json"
+}
+
+// cachedDecoder returns the cached decoder for t, a pointer type, compiling one if needed
+func cachedDecoder(t reflect.Type) (d unmarshaler, err error) {
+	if d, ok := decoders.Load(t); ok {
+		return d.(unmarshaler), nil
+	}
+
+	// the compilers panic on unsupported field types, report those as encoderFor does
+	defer func() {
+		if r := recover(); r != nil {
+			d, err = nil, fmt.Errorf("%w: %s, %v", ErrUnsupportedType, t.Elem(), r)
+		}
+	}()
+
+	switch t.Elem().Kind() {
+	case reflect.Struct:
+		d = NewStructDecoder(reflect.New(t.Elem()).Elem().Interface())
+	case reflect.Slice:
+		d = NewSliceDecoder(reflect.New(t.Elem()).Elem().Interface())
+	default:
+		return nil, fmt.Errorf("%w: %s, want a struct or slice", ErrUnsupportedType, t.Elem())
+	}
+
+	actual, _ := decoders.LoadOrStore(t, d)
+	return actual.(unmarshaler), nil
+}
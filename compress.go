@@ -0,0 +1,62 @@
+package jingo
+
+// compress.go provides helpers for encoding straight into a compressed stream. The document is
+// passed to the compressor in chunks as it's encoded using a streaming Buffer, so the raw and
+// compressed forms of a large document never need to be held in memory at the same time. The
+// compressors themselves are pooled as they're expensive to allocate.
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// compressChunk is the amount of encoded data handed to a compressor at a time
+const compressChunk = 32 << 10
+
+var gzipPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+var flatePool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// MarshalGzip encodes v using enc and writes it to w gzip compressed
+func MarshalGzip(w io.Writer, enc Encoder, v interface{}) error {
+	zw := gzipPool.Get().(*gzip.Writer)
+	defer gzipPool.Put(zw)
+	zw.Reset(w)
+
+	err := marshalStream(zw, enc, v)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// MarshalDeflate encodes v using enc and writes it to w deflate compressed
+func MarshalDeflate(w io.Writer, enc Encoder, v interface{}) error {
+	zw := flatePool.Get().(*flate.Writer)
+	defer flatePool.Put(zw)
+	zw.Reset(w)
+
+	err := marshalStream(zw, enc, v)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// marshalStream encodes v into w in chunks using a streaming buffer
+func marshalStream(w io.Writer, enc Encoder, v interface{}) error {
+	b := NewStreamingBuffer(w, compressChunk)
+	enc.Marshal(v, b)
+	err := b.Flush()
+	b.ReturnToPool()
+	return err
+}
@@ -0,0 +1,216 @@
+package jingo
+
+// config.go manages Config, the options which adjust the documents an encoder produces. Options are
+// applied once when the encoder is compiled wherever possible, so they cost nothing at runtime. The
+// exception is indentation, which is applied in a second pass over the document. Escaping options
+// select the table strings are escaped with, so need an encoder compiled for them.
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Config adjusts the documents produced by an encoder, see NewStructEncoderWithConfig and
+// NewSliceEncoderWithConfig. The zero value gives the default behaviour.
+type Config struct {
+	// Newline appends a '\n' after each document, as expected by NDJSON sinks and log shippers
+	Newline bool
+
+	// Suffix is appended after each document, ahead of any Newline, i.e "," when concatenating
+	// documents into a stream
+	Suffix string
+
+	// Prefix and Indent pretty print each document when either is set. Each element begins on a
+	// new line starting with Prefix, followed by one copy of Indent per level of nesting.
+	Prefix, Indent string
+
+	// EscapeHTML escapes <, > and & in escaped strings as \u003c, \u003e and \u0026, along with
+	// U+2028 and U+2029, as encoding/json does by default. Escaped strings are those written by
+	// fields tagged `,escape` or `,text` and by EscapeString slices, plain strings are written as
+	// they are.
+	EscapeHTML bool
+
+	// ASCII escapes every character beyond ASCII in escaped strings as \uXXXX, with surrogate pairs
+	// where needed, for consumers which can't handle UTF-8. Invalid UTF-8 is written as \ufffd.
+	ASCII bool
+}
+
+// escapeMode returns the escapeMode the encoder must be compiled for, as the escaping of strings
+// is chosen when their instructions are compiled
+func (c Config) escapeMode() (m escapeMode) {
+	if c.EscapeHTML {
+		m |= escapeHTML
+	}
+	if c.ASCII {
+		m |= escapeASCII
+	}
+	return m
+}
+
+// layout returns c without the options applied at compile time, leaving those which adjust the
+// document as it's written
+func (c Config) layout() Config {
+	c.EscapeHTML, c.ASCII = false, false
+	return c
+}
+
+// suffix returns the bytes written after each document
+func (c Config) suffix() []byte {
+	b := []byte(c.Suffix)
+	if c.Newline {
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// indented reports whether documents need a second pass to pretty print them
+func (c Config) indented() bool {
+	return c.Prefix != "" || c.Indent != ""
+}
+
+// marshalConfig uses marshal to write the value p points to into w, adjusted by c. Indented
+// documents are written to a scratch buffer first, which is held to what's left of any limit on w,
+// and should they fail the error is passed on to w in place of the document.
+func marshalConfig(p unsafe.Pointer, w *Buffer, c *Config, marshal func(unsafe.Pointer, *Buffer)) {
+	if c.indented() {
+		scratch := scratchFor(w)
+		marshal(p, scratch)
+		if err := scratch.Err(); err != nil {
+			w.fail(err)
+		} else {
+			Indent(w, scratch.Bytes, c.Prefix, c.Indent)
+		}
+		putScratch(scratch)
+	} else {
+		marshal(p, w)
+	}
+
+	w.WriteString(c.Suffix)
+	if c.Newline {
+		w.WriteByte('\n')
+	}
+}
+
+// NewStructEncoderWithConfig compiles a StructEncoder with its output adjusted by c.
+func NewStructEncoderWithConfig(t interface{}, c Config) *StructEncoder {
+	return NewStructEncoder(t).WithConfig(c)
+}
+
+// WithConfig returns a variant of the encoder with its output adjusted by c, in place of any Config
+// the encoder was compiled with. The variant shares the instructions already compiled, so is cheap
+// to create, unless c changes the escaping of strings, when the encoder is compiled again for it.
+// It keeps the encoder's hooks, Metrics and Tracer.
+func (e *StructEncoder) WithConfig(c Config) *StructEncoder {
+	return e.withConfig(c, c.escapeMode())
+}
+
+// withConfig is WithConfig with strings escaped as esc selects
+func (e *StructEncoder) withConfig(c Config, esc escapeMode) *StructEncoder {
+	base := e
+	if base.base != nil {
+		base = base.base
+	}
+	if esc != base.esc {
+		base = sharedStruct(base.t, base.version, esc)
+	}
+	plain := c.layout() == (Config{})
+	if plain && (e == base || e.hooks == nil && e.metrics == nil && e.tracer == nil) {
+		return base
+	}
+
+	// nested references to the encoder, as made by recursive structs, keep using base so the
+	// config only applies to the top level document. The type is kept for observe.
+	v := &StructEncoder{base: base, t: base.t, size: base.size, version: base.version, esc: base.esc, cfg: c,
+		hooks: e.hooks, metrics: e.metrics, tracer: e.tracer}
+	if plain {
+		v.instructions = base.instructions
+		return v
+	}
+	e = v
+
+	if c.indented() {
+		e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+			marshalConfig(v, w, &c, base.marshal)
+		})
+		return e
+	}
+
+	// the closing brace is always the last static chunk written, so fold the suffix into it
+	e.instructions = make([]instruction, len(base.instructions))
+	copy(e.instructions, base.instructions)
+
+	last := &e.instructions[len(e.instructions)-1]
+	last.static = append(append([]byte{}, last.static...), c.suffix()...)
+
+	return e
+}
+
+// NewSliceEncoderWithConfig compiles a SliceEncoder with its output adjusted by c.
+func NewSliceEncoderWithConfig(t interface{}, c Config) *SliceEncoder {
+	return NewSliceEncoder(t).WithConfig(c)
+}
+
+// WithConfig returns a variant of the encoder with its output adjusted by c, in place of any Config
+// the encoder was compiled with. The variant shares the instructions already compiled, so is cheap
+// to create, unless c changes the escaping of strings, when the encoder is compiled again for it.
+// It keeps the encoder's hooks, Metrics and Tracer.
+func (e *SliceEncoder) WithConfig(c Config) *SliceEncoder {
+	return e.withConfig(c, c.escapeMode())
+}
+
+// withConfig is WithConfig with strings escaped as esc selects
+func (e *SliceEncoder) withConfig(c Config, esc escapeMode) *SliceEncoder {
+	base := e
+	if base.base != nil {
+		base = base.base
+	}
+	if esc != base.esc {
+		base = sharedSlice(reflect.Zero(base.tt).Interface(), base.version, esc)
+	}
+	plain := c.layout() == (Config{})
+	if plain && (e == base || e.hooks == nil && e.metrics == nil && e.tracer == nil) {
+		return base
+	}
+
+	v := *base
+	v.base, v.cfg = base, c
+	v.hooks, v.metrics, v.tracer = e.hooks, e.metrics, e.tracer
+	if plain {
+		return &v
+	}
+	v.instruction = func(p unsafe.Pointer, w *Buffer) {
+		marshalConfig(p, w, &c, base.instruction)
+	}
+
+	return &v
+}
+
+// MarshalWithConfig is Marshal with c used in place of the Config the encoder was compiled with,
+// allowing one encoder to produce documents in several styles. Options which change the escaping
+// of strings compile the encoder again for them on first use. The encoder's hooks, Metrics and
+// Tracer apply as they do to Marshal.
+func (e *StructEncoder) MarshalWithConfig(s interface{}, w *Buffer, c Config) {
+	base := e
+	if base.base != nil {
+		base = base.base
+	}
+	if esc := c.escapeMode(); esc != base.esc {
+		base = sharedStruct(base.t, base.version, esc)
+	}
+	e.run(s, w, func(p unsafe.Pointer, w *Buffer) { marshalConfig(p, w, &c, base.marshal) })
+}
+
+// MarshalWithConfig is Marshal with c used in place of the Config the encoder was compiled with,
+// allowing one encoder to produce documents in several styles. Options which change the escaping
+// of strings compile the encoder again for them on first use. The encoder's hooks, Metrics and
+// Tracer apply as they do to Marshal.
+func (e *SliceEncoder) MarshalWithConfig(s interface{}, w *Buffer, c Config) {
+	base := e
+	if base.base != nil {
+		base = base.base
+	}
+	if esc := c.escapeMode(); esc != base.esc {
+		base = sharedSlice(reflect.Zero(base.tt).Interface(), base.version, esc)
+	}
+	e.run(s, w, func(p unsafe.Pointer, w *Buffer) { marshalConfig(p, w, &c, base.marshal) })
+}
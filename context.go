@@ -0,0 +1,50 @@
+package jingo
+
+// context.go supports abandoning an encode part way through when its context is cancelled, so a
+// request which times out stops burning CPU on a large document nobody is waiting for. The context
+// is checked from Buffer.checkpoint every ctxChunk bytes, keeping the cost in proportion to the
+// amount written rather than the number of values.
+
+import (
+	"context"
+)
+
+// ctxChunk is the number of bytes written between checks of the context
+const ctxChunk = 16 << 10
+
+// MarshalContext is Marshal, but gives up once ctx is done, returning ctx.Err(). The buffer is then
+// left holding a partial document and reports the same error from Err until it's Reset.
+func MarshalContext(ctx context.Context, v interface{}, buf *Buffer) error {
+	return marshalContext(ctx, buf, false, func() { Marshal(v, buf) })
+}
+
+// MarshalContext is Marshal, but gives up once ctx is done, returning ctx.Err(). The buffer is then
+// left holding a partial document and reports the same error from Err until it's Reset.
+func (e *StructEncoder) MarshalContext(ctx context.Context, s interface{}, w *Buffer) error {
+	return marshalContext(ctx, w, e.tracer != nil, func() { e.Marshal(s, w) })
+}
+
+// MarshalContext is Marshal, but gives up once ctx is done, returning ctx.Err(). The buffer is then
+// left holding a partial document and reports the same error from Err until it's Reset.
+func (e *SliceEncoder) MarshalContext(ctx context.Context, s interface{}, w *Buffer) error {
+	return marshalContext(ctx, w, e.tracer != nil, func() { e.Marshal(s, w) })
+}
+
+// marshalContext calls marshal with ctx attached to w. traced is set for encoders with a Tracer of
+// their own.
+func marshalContext(ctx context.Context, w *Buffer, traced bool, marshal func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// contexts which can never be cancelled needn't be checked, but may carry the span a Tracer
+	// should start its own within
+	if ctx.Done() != nil || traced || tracing() {
+		prev := w.ctx
+		w.ctx, w.mark = ctx, 0
+		defer func() { w.ctx, w.mark = prev, 0 }()
+	}
+
+	marshal()
+	return w.Err()
+}
@@ -0,0 +1,82 @@
+package jingo
+
+// direct.go encodes straight into the buffer of a buffered writer. Marshalling into a Buffer and
+// then writing it to a *bufio.Writer copies every document twice, once to build it and again into
+// the writer's own buffer. Writers which lend out their free space, as *bufio.Writer does with
+// AvailableBuffer, can instead have it used as the streaming buffer's Bytes, so content is encoded
+// in place and handing it back to the writer is a copy onto itself.
+
+import (
+	"io"
+)
+
+// directHeadroom is the free space kept on hand in a borrowed buffer between checkpoints, so the
+// encoders rarely outgrow it. A writer with less than twice this free is flushed first if it can be.
+const directHeadroom = 512
+
+// availableBufferWriter is a writer which lends out its free buffer space, as *bufio.Writer does.
+// The slice returned by AvailableBuffer is empty, and valid only until the next write.
+type availableBufferWriter interface {
+	io.Writer
+	AvailableBuffer() []byte
+}
+
+// flushWriter is a buffered writer whose content can be flushed through to the underlying writer
+type flushWriter interface {
+	Flush() error
+}
+
+// MarshalTo encodes v using enc and writes it to w. When w lends out its free buffer space, as a
+// *bufio.Writer does, the document is encoded directly into it, otherwise it's written to w in
+// chunks as it's encoded. Either way w isn't flushed once the document is written, that's left to
+// the caller. Any error encoding or writing the document is returned, in which case some of it may
+// already have been written.
+func MarshalTo(w io.Writer, enc Encoder, v interface{}) error {
+	lw, ok := w.(availableBufferWriter)
+	if !ok {
+		return marshalStream(w, enc, v)
+	}
+
+	b := NewBufferFromPool()
+	own := b.Bytes
+	defer func() {
+		// Bytes may still be the writer's memory, it mustn't go back to the pool with us
+		b.Bytes, b.lender = own, nil
+		b.ReturnToPool()
+	}()
+
+	b.dst, b.lender = lw, lw
+	if b.borrow(); b.err != nil {
+		return b.err
+	}
+
+	enc.Marshal(v, b)
+
+	// nothing more is to be written, so there's no need to borrow again after the last flush
+	b.lender = nil
+	return b.Flush()
+}
+
+// borrow points Bytes at the free space of the writer the buffer is lending from, flushing the
+// writer first if it has too little to be worth using. The buffer's content is flushed at the
+// checkpoint after it runs into the headroom, though a single value bigger than that, or a writer
+// with too little space to begin with, still has the encoders grow into memory of their own,
+// which is written to the writer like any other content.
+func (b *Buffer) borrow() {
+	p := b.lender.AvailableBuffer()
+	if cap(p) < 2*directHeadroom {
+		if f, ok := b.lender.(flushWriter); ok {
+			if err := f.Flush(); err != nil {
+				b.fail(err)
+				return
+			}
+			p = b.lender.AvailableBuffer()
+		}
+	}
+
+	b.Bytes = p
+	b.flushAt = cap(p) - directHeadroom
+	if b.flushAt < directHeadroom {
+		b.flushAt = directHeadroom
+	}
+}
@@ -0,0 +1,34 @@
+package jingo
+
+// envelope.go writes the response envelopes which wrap documents in APIs, i.e {"data":...}, without
+// needing a wrapper struct and encoder for each payload type.
+
+// EnvelopeField is a single key of an envelope written by MarshalEnvelope. A nil Enc writes null.
+type EnvelopeField struct {
+	Key   string
+	Enc   Encoder
+	Value interface{}
+}
+
+// MarshalEnveloped writes v, encoded by enc, as the only key of an object, i.e {"data":...}.
+func MarshalEnveloped(key string, enc Encoder, v interface{}, buf *Buffer) {
+	buf.BeginObject()
+	buf.WriteKey(key)
+	buf.WriteValue(enc, v)
+	buf.EndObject()
+}
+
+// MarshalEnvelope writes an object with a key for each of fields, in order, i.e
+// {"data":...,"error":null}.
+func MarshalEnvelope(buf *Buffer, fields ...EnvelopeField) {
+	buf.BeginObject()
+	for _, f := range fields {
+		buf.WriteKey(f.Key)
+		if f.Enc == nil {
+			buf.WriteNull()
+			continue
+		}
+		buf.WriteValue(f.Enc, f.Value)
+	}
+	buf.EndObject()
+}
@@ -0,0 +1,53 @@
+package jingo
+
+// estimate.go works out how large the documents produced by the encoders are likely to be. The
+// encoders use this to grow the buffer once up-front, rather than letting append grow and copy it
+// repeatedly as a document is written. These are deliberately rough figures, as the cost of an
+// overestimate is only some spare capacity.
+
+import (
+	"reflect"
+)
+
+// EstimatedSize returns roughly how many bytes a document written by the encoder will take, being
+// the static bytes compiled into the instructions plus a typical width for each field. This can be
+// used to pre-size buffers, i.e with NewBufferFromPoolWithCap.
+func (e *StructEncoder) EstimatedSize() int {
+	return e.size
+}
+
+// EstimatedSize returns roughly how many bytes a document written by the encoder will take for a
+// slice of n elements.
+func (e *SliceEncoder) EstimatedSize(n int) int {
+	return 2 + e.elemSize*n
+}
+
+// typicalWidth returns the number of bytes a value of type t typically encodes to. Structs and
+// slices are left to the encoders to account for.
+func typicalWidth(t reflect.Type) int {
+	if t == timeType {
+		return len(`"2006-01-02T15:04:05.999Z"`)
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typicalWidth(t.Elem())
+	case reflect.Bool:
+		return len("false")
+	case reflect.Int8, reflect.Uint8:
+		return 3
+	case reflect.Int16, reflect.Uint16:
+		return 5
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 8
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Float64:
+		return 12
+	case reflect.String:
+		return 18
+	case reflect.Array:
+		return 2 + t.Len()*(typicalWidth(t.Elem())+2)
+	case reflect.Slice:
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package jingo
+
+// exactsize.go encodes documents in two passes, the first measuring the document and the second
+// writing it into storage of exactly that size. It's for callers which must know the length of a
+// document before any of it is sent, i.e to set Content-Length through a proxy, and would rather not
+// hold a growing buffer while doing so.
+
+import (
+	"io/ioutil"
+)
+
+// sizeChunk is how much of a document is held at once while measuring it
+const sizeChunk = 4096
+
+// ExactSize returns the length of the document enc writes for v. The document is discarded as it's
+// written, so it's never held in memory as a whole.
+func ExactSize(enc Encoder, v interface{}) (int, error) {
+	b := NewStreamingBuffer(ioutil.Discard, sizeChunk)
+	defer b.ReturnToPool()
+
+	enc.Marshal(v, b)
+	if err := b.Err(); err != nil {
+		return 0, err
+	}
+	return b.Len(), nil
+}
+
+// MarshalExact returns the document enc writes for v in a new byte slice with no spare capacity,
+// having measured it with ExactSize first. Should v change between the two passes so that the
+// document grows, ErrBufferLimit is returned.
+func MarshalExact(enc Encoder, v interface{}) ([]byte, error) {
+	n, err := ExactSize(enc, v)
+	if err != nil {
+		return nil, err
+	}
+
+	// the limit keeps the encoders from growing the buffer beyond n when they pre-size it
+	b := &Buffer{Bytes: make([]byte, 0, n), limit: n}
+	enc.Marshal(v, b)
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+	return b.Bytes, nil
+}
@@ -0,0 +1,90 @@
+package jingo
+
+// explain.go describes the instruction plans compiled by the encoders in a human readable form, to
+// help debug why a field is missing from a document or slower to encode than expected without
+// having to dig through the compiler.
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// explainer is implemented by the encoders which can describe their plan
+type explainer interface {
+	explain(w *strings.Builder, depth int, seen map[explainer]bool)
+}
+
+// fieldPlan describes how a single struct field is encoded
+type fieldPlan struct {
+	name, key, how string
+	nested         explainer
+	end            int // instructions compiled up to and including this field, see MarshalSafe
+
+	// where the field is held and how to write it alone, see MarshalPatch
+	offset, size uintptr
+	inline       bool // a struct held within ours rather than behind a pointer
+	value        *fieldValue
+}
+
+// Explain returns a description of how the encoder writes each field of its struct, including any
+// encoders nested fields are delegated to.
+func (e *StructEncoder) Explain() string {
+	var w strings.Builder
+	e.explain(&w, 0, map[explainer]bool{})
+	return w.String()
+}
+
+// Explain returns a description of how the encoder writes each element of its slice, including any
+// encoder elements are delegated to.
+func (e *SliceEncoder) Explain() string {
+	var w strings.Builder
+	e.explain(&w, 0, map[explainer]bool{})
+	return w.String()
+}
+
+func (e *StructEncoder) explain(w *strings.Builder, depth int, seen map[explainer]bool) {
+	if e.base != nil {
+		explainLine(w, depth, "configured StructEncoder, %d instructions wrapping", len(e.instructions))
+		e.base.explain(w, depth+1, seen)
+		return
+	}
+
+	if seen[e] {
+		explainLine(w, depth, "StructEncoder %s, see above", reflect.TypeOf(e.t))
+		return
+	}
+	seen[e] = true
+
+	explainLine(w, depth, "StructEncoder %s, %d instructions, ~%d bytes", reflect.TypeOf(e.t), len(e.instructions), e.size)
+	for _, f := range e.plan {
+		if f.key == "" {
+			explainLine(w, depth+1, "%s: %s", f.name, f.how)
+			continue
+		}
+
+		explainLine(w, depth+1, "%s -> %q: %s", f.name, f.key, f.how)
+		if f.nested != nil {
+			f.nested.explain(w, depth+2, seen)
+		}
+	}
+}
+
+func (e *SliceEncoder) explain(w *strings.Builder, depth int, seen map[explainer]bool) {
+	if e.base != nil {
+		explainLine(w, depth, "configured SliceEncoder wrapping")
+		e.base.explain(w, depth+1, seen)
+		return
+	}
+
+	explainLine(w, depth, "SliceEncoder %s, %s elements, ~%d bytes each", e.tt, e.how, e.elemSize)
+	if e.nested != nil {
+		e.nested.explain(w, depth+1, seen)
+	}
+}
+
+func explainLine(w *strings.Builder, depth int, format string, args ...interface{}) {
+	w.WriteString(strings.Repeat("  ", depth))
+	fmt.Fprintf(w, format, args...)
+	w.WriteByte('\n')
+}
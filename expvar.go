@@ -0,0 +1,32 @@
+package jingo
+
+// expvar.go publishes live values as expvar variables, which are written with fmt or encoding/json
+// otherwise. expvar isn't imported, as importing it registers its handler on http.DefaultServeMux,
+// so the variables satisfy expvar.Var structurally as PoolStatsVar does.
+
+// JSONVar reports the current value it was created for, encoded as JSON, each time its String
+// method is called. It satisfies expvar.Var.
+type JSONVar struct {
+	enc Encoder
+	ptr interface{}
+}
+
+// Var returns a variable reporting the value ptr points to, encoded with enc, which can be published
+// with e.g expvar.Publish("state", jingo.Var(enc, &state)). The value is read each time the variable
+// is, so it mustn't be written to concurrently.
+func Var(enc Encoder, ptr interface{}) *JSONVar {
+	return &JSONVar{enc: enc, ptr: ptr}
+}
+
+// String encodes the value into a pooled buffer and returns a copy, the only allocation made. null
+// is returned should encoding fail, so the output of expvar stays valid JSON.
+func (v *JSONVar) String() string {
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	v.enc.Marshal(v.ptr, b)
+	if b.Err() != nil {
+		return "null"
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package jingo
+
+// format.go reformats documents which have already been encoded. The input is assumed to be valid
+// JSON, as produced by the encoders.
+
+// Compact writes src to dst with all whitespace outside of strings removed. src is assumed to be
+// valid JSON, check it with Valid first if that isn't certain.
+func Compact(dst *Buffer, src []byte) {
+	dst.Grow(len(src))
+
+	start := 0 // start of the run of bytes yet to be written
+	str, esc := false, false
+
+	for i, c := range src {
+		if str {
+			if esc {
+				esc = false
+			} else if c == '\\' {
+				esc = true
+			} else if c == '"' {
+				str = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			str = true
+		case ' ', '\t', '\n', '\r':
+			dst.Write(src[start:i])
+			start = i + 1
+		}
+	}
+	dst.Write(src[start:])
+}
+
+// Indent writes src to dst with each element on a new line starting with prefix, followed by one
+// copy of indent per level of nesting, in the same style as json.Indent. Any whitespace already in
+// src outside of strings is dropped. src is assumed to be valid JSON, check it with Valid first if
+// that isn't certain.
+func Indent(dst *Buffer, src []byte, prefix, indent string) {
+	reformat(dst, src, prefix, indent, nil)
+}
+
+// IndentColor is Indent with ANSI colour escapes added, so keys, strings, numbers, booleans and
+// nulls can be told apart at a glance in a terminal, i.e for the output of admin and debugging
+// tools. It's not intended for documents which are going to be parsed.
+func IndentColor(dst *Buffer, src []byte, prefix, indent string) {
+	reformat(dst, src, prefix, indent, &ansiColors)
+}
+
+// palette holds the escape sequences IndentColor starts each kind of token with
+type palette struct {
+	key, str, num, bool, null, reset string
+}
+
+var ansiColors = palette{
+	key:   "\x1b[34m", // blue
+	str:   "\x1b[32m", // green
+	num:   "\x1b[36m", // cyan
+	bool:  "\x1b[33m", // yellow
+	null:  "\x1b[90m", // grey
+	reset: "\x1b[0m",
+}
+
+// reformat implements Indent, colouring the tokens from pal when it isn't nil
+func reformat(dst *Buffer, src []byte, prefix, indent string, pal *palette) {
+	depth := 0
+	open := false // the last token opened an object or array
+	str, esc := false, false
+	lit := false    // within a number, boolean or null, only tracked for pal
+	var objs []bool // whether each level of nesting is an object, only tracked for pal
+	key := false    // the next string is a key, only tracked for pal
+
+	newline := func() {
+		dst.WriteByte('\n')
+		dst.WriteString(prefix)
+		for i := 0; i < depth; i++ {
+			dst.WriteString(indent)
+		}
+	}
+
+	for _, c := range src {
+		if str {
+			dst.WriteByte(c)
+			if esc {
+				esc = false
+			} else if c == '\\' {
+				esc = true
+			} else if c == '"' {
+				str = false
+				if pal != nil {
+					dst.WriteString(pal.reset)
+				}
+			}
+			continue
+		}
+
+		if lit {
+			switch c {
+			case ' ', '\t', '\n', '\r', ',', ':', '}', ']':
+				lit = false
+				dst.WriteString(pal.reset)
+			}
+		}
+
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+
+		if open && c != '}' && c != ']' {
+			open = false
+			depth++
+			newline()
+		}
+
+		switch c {
+		case '"':
+			str = true
+			if pal != nil {
+				if key {
+					dst.WriteString(pal.key)
+				} else {
+					dst.WriteString(pal.str)
+				}
+				key = false
+			}
+			dst.WriteByte(c)
+		case '{', '[':
+			open = true
+			if pal != nil {
+				objs = append(objs, c == '{')
+				key = c == '{'
+			}
+			dst.WriteByte(c)
+		case ',':
+			dst.WriteByte(c)
+			newline()
+			if pal != nil {
+				key = objs[len(objs)-1]
+			}
+		case ':':
+			dst.WriteByte(c)
+			dst.WriteByte(' ')
+		case '}', ']':
+			if open { // empty objects and arrays stay on one line
+				open = false
+			} else {
+				depth--
+				newline()
+			}
+			if pal != nil {
+				objs = objs[:len(objs)-1]
+			}
+			dst.WriteByte(c)
+		default:
+			if pal != nil && !lit {
+				lit = true
+				switch c {
+				case 't', 'f':
+					dst.WriteString(pal.bool)
+				case 'n':
+					dst.WriteString(pal.null)
+				default:
+					dst.WriteString(pal.num)
+				}
+			}
+			dst.WriteByte(c)
+		}
+	}
+
+	if lit {
+		dst.WriteString(pal.reset)
+	}
+}
@@ -0,0 +1,119 @@
+package jingo
+
+// get.go extracts single values from encoded documents by path, i.e for middlewares which route or
+// sample on one field of a response. Only the parts of the document preceding the value are
+// scanned, and nothing is decoded.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrPathNotFound is returned by Get when the document has no value at the path.
+var ErrPathNotFound = errors.New("jingo: path not found")
+
+// Get returns the encoded value found at path within the document b, i.e "a.b[2].c" for the value
+// of key c within the third element of the array at key b of the object at key a. The result
+// refers to b rather than being a copy. An error wrapping ErrPathNotFound is returned when there's
+// no such value, or a *DecodeError if the document is invalid on the way to it.
+func Get(b []byte, path string) ([]byte, error) {
+	s := getScanner(b)
+	defer putScanner(s)
+
+	for p := path; p != ""; {
+		var found bool
+		var err error
+
+		if p[0] == '[' {
+			j := strings.IndexByte(p, ']')
+			if j < 0 {
+				return nil, fmt.Errorf("jingo: invalid path %q", path)
+			}
+			i, aerr := strconv.Atoi(p[1:j])
+			if aerr != nil || i < 0 {
+				return nil, fmt.Errorf("jingo: invalid path %q", path)
+			}
+			found, err = s.index(i)
+			p = p[j+1:]
+		} else {
+			j := strings.IndexAny(p, ".[")
+			if j < 0 {
+				j = len(p)
+			}
+			found, err = s.key(p[:j])
+			p = p[j:]
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrPathNotFound, path)
+		}
+		p = strings.TrimPrefix(p, ".")
+	}
+
+	s.next()
+	start := s.pos
+	if err := s.skip(); err != nil {
+		return nil, err
+	}
+	return b[start:s.pos], nil
+}
+
+// key moves to the value of key k in the object which is next, reporting whether there is one
+func (s *scanner) key(k string) (bool, error) {
+	if s.next() != '{' {
+		return false, nil
+	}
+	s.pos++
+	if s.next() == '}' {
+		return false, nil
+	}
+
+	for {
+		sk, err := s.string()
+		if err != nil {
+			return false, err
+		}
+		if err := s.consume(':'); err != nil {
+			return false, err
+		}
+		if string(sk) == k {
+			return true, nil
+		}
+
+		if err := s.skip(); err != nil {
+			return false, err
+		}
+		if done, err := s.more('}'); done || err != nil {
+			return false, err
+		}
+	}
+}
+
+// index moves to element i of the array which is next, reporting whether there is one
+func (s *scanner) index(i int) (bool, error) {
+	if s.next() != '[' {
+		return false, nil
+	}
+	s.pos++
+	if s.next() == ']' {
+		return false, nil
+	}
+
+	for n := 0; ; n++ {
+		if n == i {
+			return true, nil
+		}
+
+		if err := s.skip(); err != nil {
+			return false, err
+		}
+		if done, err := s.more(']'); done || err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package jingo
+
+// hash.go computes digests of values for cache keys and change detection. The document is streamed
+// into the hash in small chunks as it's encoded, so it's never held in memory as a whole.
+
+import (
+	"hash"
+)
+
+// Hash writes the document enc produces for v to h, without materialising the whole document. It's
+// the encoder's own output which is hashed rather than a canonical form with sorted keys: the
+// encoders write documents deterministically, with keys in the order of the struct's fields and
+// values formatted the same way each time, so equal values give equal digests, but reordering the
+// fields of a struct, or changing its Config, changes them. h is written to but not reset, so
+// several values can be hashed together. Should the document fail, i.e on a cancelled context or an
+// error from a ,text field, the error is returned and h holds some part of it.
+func Hash(enc Encoder, v interface{}, h hash.Hash) error {
+	buf := NewStreamingBuffer(h, hashChunk)
+	defer buf.ReturnToPool()
+
+	enc.Marshal(v, buf)
+	if err := buf.Err(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
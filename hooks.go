@@ -0,0 +1,59 @@
+package jingo
+
+// hooks.go supports callbacks run around each Marshal call on an encoder, for cross-cutting concerns
+// such as wrapping documents in an envelope, timing or auditing output. They're held behind a single
+// pointer so encoders without hooks pay only a nil check.
+
+import (
+	"unsafe"
+)
+
+// hooks holds the callbacks set by SetHooks
+type hooks struct {
+	before, after func(unsafe.Pointer, *Buffer)
+}
+
+// run calls marshal for p, surrounded by the hooks
+func (h *hooks) run(p unsafe.Pointer, w *Buffer, marshal func(unsafe.Pointer, *Buffer)) {
+	if h.before != nil {
+		h.before(p, w)
+	}
+	marshal(p, w)
+	if h.after != nil {
+		h.after(p, w)
+	}
+}
+
+// SetHooks returns a copy of the encoder which calls the given functions with the value and buffer
+// at the start and end of each Marshal, either may be nil. Anything they write to the buffer
+// surrounds the document. Hooks aren't run for documents nested within the encoder's own. The copy
+// shares the compiled instructions and the encoder itself is left as it is, so it's safe to call
+// while the encoder is in use.
+func (e *StructEncoder) SetHooks(before, after func(p unsafe.Pointer, w *Buffer)) *StructEncoder {
+	v := *e
+	v.hooks = &hooks{before: before, after: after}
+	return &v
+}
+
+// SetHooks returns a copy of the encoder which calls the given functions with the slice and buffer
+// at the start and end of each Marshal, either may be nil. Anything they write to the buffer
+// surrounds the document. The encoder itself is left as it is.
+func (e *SliceEncoder) SetHooks(before, after func(p unsafe.Pointer, w *Buffer)) *SliceEncoder {
+	v := *e
+	v.hooks = &hooks{before: before, after: after}
+	return &v
+}
+
+// selfRef refers a recursive struct back to its own encoder, bypassing the hooks which only apply
+// to the top level document.
+type selfRef struct {
+	*StructEncoder
+}
+
+func (r selfRef) Marshal(s interface{}, w *Buffer) {
+	r.marshal((*(*iface)(unsafe.Pointer(&s))).Data, w)
+}
+
+func (r selfRef) marshalPtr(p unsafe.Pointer, w *Buffer) {
+	r.marshal(p, w)
+}
@@ -0,0 +1,121 @@
+package jingo
+
+// http.go helps handlers write jingo encoded documents as HTTP responses. WriteResponse covers the
+// simple case, ResponseEncoder adds compression and streaming for services which want them.
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WriteResponse encodes v with enc into a pooled buffer and writes it as the response body with the
+// given status, setting the Content-Type and Content-Length headers. Should the value fail to encode,
+// i.e for a buffer limit, the error is returned before any header is set, leaving the response for
+// the caller to write. Otherwise any error writing the body is returned.
+func WriteResponse(w http.ResponseWriter, status int, enc Encoder, v interface{}) error {
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	enc.Marshal(v, b)
+	if err := b.Err(); err != nil {
+		return err
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(b.Bytes)))
+	w.WriteHeader(status)
+
+	_, err := w.Write(b.Bytes)
+	return err
+}
+
+// minGzip is the smallest buffered body ResponseEncoder compresses, below which gzip's framing
+// costs more than it saves
+const minGzip = 1024
+
+// ResponseEncoder writes values as HTTP responses using a compiled encoder. Bodies are gzip
+// compressed when the request accepts it, and buffers are taken from and returned to the pools.
+type ResponseEncoder struct {
+	enc    Encoder
+	stream bool
+}
+
+// NewResponseEncoder returns a ResponseEncoder which encodes values with enc. Each body is encoded
+// into a buffer first so Content-Length can be set, unless stream is true, in which case it's
+// written as it's encoded with chunked transfer encoding. Streaming suits documents too large to
+// hold in memory, but an error part way through can only cut the response short.
+func NewResponseEncoder(enc Encoder, stream bool) *ResponseEncoder {
+	return &ResponseEncoder{enc: enc, stream: stream}
+}
+
+// Write encodes v as the response to r with the given status. Should the value fail to encode
+// before anything is written, i.e for a buffer limit, the error is returned and the response is
+// left for the caller to write.
+func (re *ResponseEncoder) Write(w http.ResponseWriter, r *http.Request, status int, v interface{}) error {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Add("Vary", "Accept-Encoding")
+	gz := acceptsGzip(r)
+
+	if re.stream {
+		if gz {
+			h.Set("Content-Encoding", "gzip")
+		}
+		w.WriteHeader(status)
+		if gz {
+			return MarshalGzip(w, re.enc, v)
+		}
+		return marshalStream(w, re.enc, v)
+	}
+
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	re.enc.Marshal(v, b)
+	if err := b.Err(); err != nil {
+		return err
+	}
+
+	body := b.Bytes
+	if gz && len(body) >= minGzip {
+		z := getScratch()
+		defer putScratch(z)
+
+		zw := gzipPool.Get().(*gzip.Writer)
+		zw.Reset(z)
+		zw.Write(body) // writes to a Buffer don't fail
+		zw.Close()
+		gzipPool.Put(zw)
+
+		body = z.Bytes
+		h.Set("Content-Encoding", "gzip")
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+
+	_, err := w.Write(body)
+	return err
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows a gzip response
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params := strings.TrimSpace(enc), ""
+			if i := strings.IndexByte(name, ';'); i >= 0 {
+				name, params = name[:i], name[i+1:]
+			}
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
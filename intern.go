@@ -0,0 +1,57 @@
+package jingo
+
+// intern.go provides the string interning used by the decoders for fields tagged `json:",intern"`.
+// Ingesting many similar documents otherwise allocates a new copy of every status code and enum
+// string in each of them. Interned strings are shared by every decoder, so the table is bounded to
+// keep a stream of distinct values from growing it without limit.
+
+import (
+	"sync"
+	"unsafe"
+)
+
+const (
+	maxInterned   = 1 << 16 // strings held by the table before it stops taking more
+	maxInternSize = 64      // longer strings are unlikely to repeat, so aren't interned
+)
+
+var interned = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// intern returns b as a string, sharing the memory of a previous string with the same content where
+// there is one
+func intern(b []byte) string {
+	if len(b) > maxInternSize {
+		return string(b)
+	}
+
+	interned.RLock()
+	s, ok := interned.m[string(b)] // doesn't allocate
+	interned.RUnlock()
+	if ok {
+		return s
+	}
+
+	s = string(b)
+	interned.Lock()
+	if len(interned.m) < maxInterned {
+		interned.m[s] = s
+	}
+	interned.Unlock()
+
+	return s
+}
+
+func decodeInternedString(s *scanner, p unsafe.Pointer) error {
+	if s.null() {
+		return nil
+	}
+	b, err := s.string()
+	if err != nil {
+		return err
+	}
+	*(*string)(p) = intern(b)
+	return nil
+}
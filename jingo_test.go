@@ -1,14 +1,34 @@
 package jingo
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 type all struct {
@@ -66,6 +86,171 @@ func (j *jsonMarshaler) EncodeJSON(w io.Writer) {
 	w.Write(j.val)
 }
 
+type level int
+
+func (l level) String() string {
+	if l > 0 {
+		return "high"
+	}
+	return "low"
+}
+
+// marshalText only implements encoding.TextMarshaler
+type marshalText string
+
+func (m marshalText) MarshalText() ([]byte, error) {
+	if m == "bad" {
+		return nil, errors.New("bad text")
+	}
+	return []byte("text:" + m), nil
+}
+
+func Test_TextOption(t *testing.T) {
+
+	type doc struct {
+		Addr    addr4        `json:"addr,text"`
+		PtrAddr *addr4       `json:"ptraddr,text"`
+		Text    marshalText  `json:"text,text"`
+		PtrText *marshalText `json:"ptrtext,text"`
+		Plain   int          `json:"plain,text"` // no text methods, so encoded as normal
+	}
+
+	enc := NewStructEncoder(doc{})
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	addr := addr4{192, 168, 0, 1}
+	enc.Marshal(&doc{Addr: addr, Text: `a"b`, Plain: 1}, buf)
+	want := `{"addr":"192.168.0.1","ptraddr":null,"text":"text:a\"b","ptrtext":null,"plain":1}`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// AppendText writes straight into the buffer, leaving only the slice returned by MarshalText
+	d := doc{Addr: addr, PtrAddr: &addr}
+	if n := testing.AllocsPerRun(10, func() { buf.Reset(); enc.Marshal(&d, buf) }); n != 1 {
+		t.Errorf("want 1 allocation got %v", n)
+	}
+
+	// errors abandon the document
+	buf.Reset()
+	bad := marshalText("bad")
+	enc.Marshal(&doc{PtrText: &bad}, buf)
+	if err := buf.Err(); err == nil || err.Error() != "bad text" {
+		t.Errorf("want bad text error got %v", err)
+	}
+}
+
+// addr4 is an IPv4 address which implements encoding.TextAppender as well as TextMarshaler
+type addr4 [4]byte
+
+func (a addr4) AppendText(b []byte) ([]byte, error) {
+	for i, c := range a {
+		if i > 0 {
+			b = append(b, '.')
+		}
+		b = strconv.AppendUint(b, uint64(c), 10)
+	}
+	return b, nil
+}
+
+func (a addr4) MarshalText() ([]byte, error) {
+	return a.AppendText(nil)
+}
+
+// appendText only implements encoding.TextAppender
+type appendText string
+
+func (a appendText) AppendText(b []byte) ([]byte, error) {
+	return append(b, a...), nil
+}
+
+func Test_Scratch(t *testing.T) {
+
+	// text needing escaping is escaped from scratch space, leaving nothing else behind
+	type doc struct {
+		Text appendText `json:"text,text"`
+	}
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(doc{}).Marshal(&doc{"a\"\n"}, buf)
+	if want := `{"text":"a\"\n"}`; buf.String() != want {
+		t.Errorf("want %s got %s", want, buf.Bytes)
+	}
+
+	// scratch buffers come back empty, and huge ones aren't kept
+	s := getScratch()
+	s.WriteString("abc")
+	putScratch(s)
+	if s.Len() != 0 {
+		t.Errorf("want an empty scratch buffer got %q", s.Bytes)
+	}
+
+	big := getScratch()
+	big.Grow(maxScratch + 1)
+	big.WriteString("abc")
+	putScratch(big)
+	if big.Len() != 3 {
+		t.Error("scratch buffers over maxScratch should be left alone")
+	}
+}
+
+func Test_StringOption(t *testing.T) {
+
+	type doc struct {
+		T    bool     `json:"t,string"`
+		F    bool     `json:"f,string"`
+		PB   *bool    `json:"pb,string"`
+		I    int      `json:"i,string"`
+		PI   *int     `json:"pi,string"`
+		U8   uint8    `json:"u8,string"`
+		F64  float64  `json:"f64,string"`
+		PF32 *float32 `json:"pf32,string"`
+	}
+
+	enc := NewStructEncoder(doc{})
+	yes, n, f := true, -5, float32(1.5)
+	for _, v := range []doc{{}, {T: true, PB: &yes, I: 12, PI: &n, U8: 255, F64: 0.25, PF32: &f}} {
+		buf := NewBufferFromPool()
+		enc.Marshal(&v, buf)
+
+		want, _ := json.Marshal(&v)
+		if !bytes.Equal(want, buf.Bytes) {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+		buf.ReturnToPool()
+	}
+}
+
+func Test_BoundMethodsDontAllocate(t *testing.T) {
+
+	type doc struct {
+		Level  level          `json:"level,stringer"`
+		PLevel *level         `json:"plevel,stringer"`
+		Enc    encode0        `json:"enc,encoder"`
+		PEnc   *encode0       `json:"penc,encoder"`
+		Writer jsonMarshaler  `json:"writer,encoder"`
+		PWrite *jsonMarshaler `json:"pwriter,encoder"`
+	}
+
+	high := level(1)
+	d := doc{Level: 0, PLevel: &high, Enc: encode0{'1'}, PEnc: &encode0{'2'}, Writer: jsonMarshaler{[]byte("3")}}
+	enc := NewStructEncoder(doc{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc.Marshal(&d, buf)
+	want := `{"level":"low","plevel":"high","enc":1,"penc":2,"writer":3,"pwriter":null}`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	if n := testing.AllocsPerRun(10, func() { buf.Reset(); enc.Marshal(&d, buf) }); n != 0 {
+		t.Errorf("want no allocations got %v", n)
+	}
+}
+
 func Example() {
 
 	enc := NewStructEncoder(all{})
@@ -194,6 +379,64 @@ func Test_StructWithEscapes(t *testing.T) {
 	}
 }
 
+func Test_EscapeWords(t *testing.T) {
+
+	// every byte in every position of a word, against a clean background, for each table
+	for m, es := range escapers {
+		for c := 0; c < 256; c++ {
+			dirty := es.table[c] != 0 || c >= utf8.RuneSelf && escapeMode(m)&^escapeAll != 0
+			for pos := 0; pos < 8; pos++ {
+				w := []byte("abcdefgh")
+				w[pos] = byte(c)
+				if cleanWord(binary.LittleEndian.Uint64(w), es.html, es.high) == dirty {
+					t.Fatalf("mode %d byte %#x at %d: want clean %v", m, c, pos, !dirty)
+				}
+			}
+		}
+	}
+
+	// long strings are escaped the same as byte by byte, wherever the escapes fall. encoding/json
+	// always escapes U+2028 and U+2029, and escapes <, > and & unless told not to.
+	long := strings.Repeat("plain text é ", 20)
+	html := long[:45] + "<a href='x&y'>" + long[45:] + "\u2028 \u2029\u2027"
+	for _, tc := range []struct {
+		in   string
+		mode escapeMode
+	}{
+		{long, 0}, {long + "\"", 0}, {"\n" + long, 0}, {long[:37] + "\\" + long[37:] + "\x01", 0}, {long[:80] + "\t\r" + long[80:], 0},
+		{long, escapeHTML}, {html, escapeHTML}, {"<>&" + long, escapeHTML},
+	} {
+		buf := NewBufferFromPool()
+		escapers[tc.mode].escape(tc.in, buf)
+
+		var want bytes.Buffer
+		enc := json.NewEncoder(&want)
+		enc.SetEscapeHTML(tc.mode&escapeHTML != 0)
+		enc.Encode(tc.in)
+		if got := `"` + buf.String() + `"`; got != strings.TrimSuffix(want.String(), "\n") {
+			t.Errorf("mode %d\nwant:\n%s\ngot:\n%s", tc.mode, want.String(), got)
+		}
+		buf.ReturnToPool()
+	}
+
+	// ASCII output decodes to the original, with invalid UTF-8 replaced
+	for _, in := range []string{long, html, "😀 \u00e9\u2028", "a\xffb"} {
+		buf := NewBufferFromPool()
+		escapers[escapeASCII].escape(in, buf)
+
+		var got string
+		if err := json.Unmarshal([]byte(`"`+buf.String()+`"`), &got); err != nil || got != strings.ToValidUTF8(in, "\ufffd") {
+			t.Errorf("%q: got %q %v from %s", in, got, err, buf.Bytes)
+		}
+		for _, c := range buf.Bytes {
+			if c >= utf8.RuneSelf {
+				t.Fatalf("%q: non-ASCII output %s", in, buf.Bytes)
+			}
+		}
+		buf.ReturnToPool()
+	}
+}
+
 func Test_StructWithRecursion(t *testing.T) {
 
 	type structWithRecursion struct {
@@ -394,6 +637,103 @@ func Test_Time(t *testing.T) {
 	}
 }
 
+func Test_AppendInts(t *testing.T) {
+
+	values := []int64{0, 1, -1, 9, 10, 99, 100, 101, 999, 1000, 12345, -98765,
+		math.MaxInt8, math.MinInt8, math.MaxInt16, math.MinInt16, math.MaxInt32, math.MinInt32,
+		math.MaxUint32, math.MaxUint32 + 1, 1e9, 1e10 - 1, 1e10, 1e18, math.MaxInt64, math.MinInt64}
+	for i := int64(1); i > 0 && i < math.MaxInt64/7; i *= 7 {
+		values = append(values, i, -i, i-1, i+1)
+	}
+	for i := int64(1); i <= 1e18; i *= 10 {
+		values = append(values, i, -i, i-1, i+1, 2*i-1)
+	}
+
+	for _, v := range values {
+		if want, got := strconv.FormatInt(v, 10), string(appendInt64(nil, v)); want != got {
+			t.Errorf("appendInt64: want %s got %s", want, got)
+		}
+		if want, got := strconv.FormatUint(uint64(v), 10), string(appendUint64(nil, uint64(v))); want != got {
+			t.Errorf("appendUint64: want %s got %s", want, got)
+		}
+		if want, got := strconv.FormatInt(int64(int32(v)), 10), string(appendInt32(nil, int32(v))); want != got {
+			t.Errorf("appendInt32: want %s got %s", want, got)
+		}
+		if want, got := strconv.FormatUint(uint64(uint32(v)), 10), string(appendUint32(nil, uint32(v))); want != got {
+			t.Errorf("appendUint32: want %s got %s", want, got)
+		}
+	}
+}
+
+func BenchmarkInts(b *testing.B) {
+	b.ReportAllocs()
+
+	type odds struct {
+		A int    `json:"a"`
+		B int64  `json:"b"`
+		C int32  `json:"c"`
+		D uint16 `json:"d"`
+		E uint64 `json:"e"`
+		F int    `json:"f"`
+	}
+	o := odds{123456, -9876543210, 2500, 65535, 1 << 40, 7}
+
+	var enc = NewStructEncoder(odds{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&o, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func BenchmarkFloats(b *testing.B) {
+	b.ReportAllocs()
+
+	type prices struct {
+		Back  float64 `json:"back"`
+		Lay   float64 `json:"lay"`
+		Odds  float32 `json:"odds"`
+		Total float64 `json:"total"`
+	}
+	p := prices{1.9523809523809523, 2.04, 5.5, 123456.789}
+
+	var enc = NewStructEncoder(prices{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&p, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func Test_AppendTime(t *testing.T) {
+
+	east := time.FixedZone("east", 5*60*60+30*60)
+	west := time.FixedZone("west", -8*60*60)
+	odd := time.FixedZone("odd", 61) // offsets with seconds are left to AppendFormat
+
+	for _, v := range []time.Time{
+		{},
+		time.Date(2000, 9, 17, 20, 4, 26, 0, time.UTC),
+		time.Date(2000, 9, 17, 20, 4, 26, 1, time.UTC),
+		time.Date(2000, 9, 17, 20, 4, 26, 120000000, time.UTC),
+		time.Date(2000, 9, 17, 20, 4, 26, 999999999, east),
+		time.Date(1999, 12, 31, 23, 59, 59, 5000, west),
+		time.Date(2000, 1, 1, 0, 0, 0, 0, odd),
+		time.Date(12345, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(-1, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Now(),
+	} {
+		want := v.Format(time.RFC3339Nano)
+		if got := string(appendTime(nil, v)); got != want {
+			t.Errorf("want %s got %s", want, got)
+		}
+	}
+}
+
 func BenchmarkTime(b *testing.B) {
 	b.ReportAllocs()
 
@@ -419,6 +759,26 @@ func BenchmarkTime(b *testing.B) {
 	}
 }
 
+func BenchmarkStringer(b *testing.B) {
+	b.ReportAllocs()
+
+	type doc struct {
+		Level  level  `json:"level,stringer"`
+		PLevel *level `json:"plevel,stringer"`
+	}
+
+	high := level(1)
+	d := doc{PLevel: &high}
+	var enc = NewStructEncoder(doc{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&d, buf)
+		buf.ReturnToPool()
+	}
+}
+
 func BenchmarkTimeStdLib(b *testing.B) {
 	b.ReportAllocs()
 
@@ -444,13 +804,9 @@ func TestSliceEncoder(t *testing.T) {
 
 	enc := NewSliceEncoder([]string{})
 
-	type marshaler interface {
-		Marshal(s interface{}, w *Buffer)
-	}
-
 	tests := []struct {
 		name string
-		enc  marshaler
+		enc  Encoder
 		v    interface{}
 		want []byte
 	}{
@@ -472,6 +828,12 @@ func TestSliceEncoder(t *testing.T) {
 			&[]string{"0", "1", "2"},
 			[]byte(`["0","1","2"]`),
 		},
+		{
+			"SliceEncoder String - Empty Elements",
+			enc,
+			&[]string{"", "1", ""},
+			[]byte(`["","1",""]`),
+		},
 	}
 
 	for _, tt := range tests {
@@ -490,135 +852,3072 @@ func TestSliceEncoder(t *testing.T) {
 	}
 }
 
-func BenchmarkSlice(b *testing.B) {
+func Test_BufferClone(t *testing.T) {
 
-	ss := []string{
-		"a name",
-		"another name",
-		"another",
-		"and one more",
-		"last one, promise",
-	}
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	buf.WriteString(`{"a":1}`)
 
-	var enc = NewSliceEncoder([]string{})
+	c := buf.Clone()
+	defer c.ReturnToPool()
 
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		buf := NewBufferFromPool()
-		enc.Marshal(&ss, buf)
-		buf.ReturnToPool()
+	buf.Reset()
+	buf.WriteString(`{"b":2}`)
+
+	if want := `{"a":1}`; c.String() != want {
+		t.Errorf("want: %s got: %s", want, c.String())
+	}
+
+	// content already flushed isn't copied, so isn't made room for either
+	sb := NewStreamingBuffer(ioutil.Discard, 64)
+	defer sb.ReturnToPool()
+	enc := NewStructEncoder(LargePayload{})
+	for i := 0; i < 10; i++ {
+		enc.Marshal(largePayload, sb)
+	}
+	sc := sb.Clone()
+	defer sc.ReturnToPool()
+	if !bytes.Equal(sc.Bytes, sb.Bytes) || cap(sc.Bytes) >= sb.Len() {
+		t.Errorf("want %d bytes in less than %d got %d of %d", len(sb.Bytes), sb.Len(), len(sc.Bytes), cap(sc.Bytes))
 	}
 }
 
-func BenchmarkSliceEscape(b *testing.B) {
+func Test_BufferLimit(t *testing.T) {
 
-	ss := []string{
-		"a name",
-		"another name",
-		"another",
-		"and one more",
-		"last one, promise",
+	enc := NewSliceEncoder([]string{})
+	v := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	buf.SetLimit(10)
+	enc.Marshal(&v, buf)
+
+	if buf.Err() != ErrBufferLimit {
+		t.Fatalf("want: %v got: %v", ErrBufferLimit, buf.Err())
 	}
 
-	var enc = NewSliceEncoder([]EscapeString{})
+	if len(buf.Bytes) > 10+len(`","h`) {
+		t.Errorf("buffer overshot its limit: %s", buf.Bytes)
+	}
 
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		buf := NewBufferFromPool()
-		enc.Marshal(&ss, buf)
-		buf.ReturnToPool()
+	buf.Reset()
+	buf.SetLimit(0)
+	enc.Marshal(&v, buf)
+
+	if buf.Err() != nil {
+		t.Errorf("unexpected error after reset: %v", buf.Err())
 	}
 }
 
-func BenchmarkSliceStdLib(b *testing.B) {
-	ss := []string{
-		"a name",
-		"another name",
-		"another",
-		"and one more",
-		"last one, promise",
+func Test_BufferReadFrom(t *testing.T) {
+
+	cached := strings.Repeat(`{"k":"v"},`, 100) + `{"k":"v"}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	buf.WriteByte('[')
+	n, err := buf.ReadFrom(strings.NewReader(cached))
+	buf.WriteByte(']')
+
+	if err != nil || n != int64(len(cached)) {
+		t.Fatalf("want: %d <nil> got: %d %v", len(cached), n, err)
 	}
 
-	b.StartTimer()
-	for i := 0; i < b.N; i++ {
-		json.Marshal(&ss)
+	if want := "[" + cached + "]"; buf.String() != want {
+		t.Errorf("want: %s got: %s", want, buf.String())
 	}
 }
 
-// var fakeType = SmallPayload{}
-// var fake = NewSmallPayload()
+func Test_BufferWriteRune(t *testing.T) {
 
-// var fakeType = LargePayload{}
-// var fake = NewLargePayload()
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
 
-var s = "test pointer string b"
-var fakeType = all{}
-var fake = &all{
-	PropBool:    false,
-	PropInt:     1234567878910111212,
-	PropInt8:    123,
-	PropInt16:   12349,
-	PropInt32:   1234567891,
-	PropInt64:   1234567878910111213,
-	PropUint:    12345678789101112138,
-	PropUint8:   255,
-	PropUint16:  12345,
-	PropUint32:  1234567891,
-	PropUint64:  12345678789101112139,
-	PropFloat32: 21.232426,
-	PropFloat64: 2799999999888.28293031999999,
-	PropString:  "thirty two thirty four",
-	PropStruct: struct {
-		PropNames        []string  `json:"propName"`
-		PropPs           []*string `json:"ps"`
-		PropNamesEscaped []string  `json:"propNameEscaped,escape"`
-	}{
-		PropNames:        []string{"a name", "another name", "another"},
-		PropPs:           []*string{&s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s},
-		PropNamesEscaped: []string{"one\\two\\,three\"", "\"four\\five\\,six\""},
-	},
+	want := "aé你👋"
+	for _, r := range want {
+		buf.WriteRune(r)
+	}
+	buf.WriteRune(utf8.MaxRune + 1)
+
+	if want += string(utf8.RuneError); buf.String() != want {
+		t.Errorf("want: %s got: %s", want, buf.String())
+	}
 }
 
-func BenchmarkJson(b *testing.B) {
+func Test_BufferWriteQuotedString(t *testing.T) {
 
-	e := NewStructEncoder(fakeType)
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		buf := NewBufferFromPool()
-		e.Marshal(fake, buf)
-		buf.ReturnToPool()
+	v := "a \"quoted\"\\path\n\twith\x01control\x1f chars, 你好"
+	buf.WriteQuotedString(v)
+
+	want, _ := json.Marshal(v)
+	if !bytes.Equal(want, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
 	}
-}
 
-func BenchmarkStdJson(b *testing.B) {
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		by, _ := json.Marshal(fake)
-		_ = by
+	// custom encoders escape as the encoder they're part of does
+	type doc struct {
+		Q quoter `json:"q,encoder"`
+	}
+	enc := NewStructEncoder(doc{})
+	for _, tt := range []struct {
+		c    Config
+		want string
+	}{
+		{Config{}, `{"q":"<a&b> é"}`},
+		{Config{EscapeHTML: true}, `{"q":"\u003ca\u0026b\u003e é"}`},
+		{Config{ASCII: true}, `{"q":"<a&b> \u00e9"}`},
+	} {
+		buf.Reset()
+		enc.WithConfig(tt.c).Marshal(&doc{"<a&b> é"}, buf)
+		buf.WriteQuotedString("<")
+		if want := tt.want + `"<"`; buf.String() != want {
+			t.Errorf("%+v\nwant:\n%s\ngot:\n%s", tt.c, want, buf.Bytes)
+		}
 	}
 }
 
-//
-//
-//
+// quoter writes itself with WriteQuotedString
+type quoter string
 
-type SmallPayload struct {
-	St   int    `json:"st"`
-	Sid  int    `json:"sid"`
-	Tt   string `json:"tt"`
-	Gr   int    `json:"gr"`
-	UUID string `json:"uuid"`
-	IP   string `json:"ip"`
-	Ua   string `json:"ua"`
-	Tz   int    `json:"tz"`
-	V    int    `json:"v"`
+func (q *quoter) JSONEncode(w *Buffer) {
+	w.WriteQuotedString(string(*q))
 }
 
-func NewSmallPayload() *SmallPayload {
-	s := &SmallPayload{
-		St:   1,
-		Sid:  2,
+func Test_BufferTokenWriter(t *testing.T) {
+
+	enc := NewSliceEncoder([]string{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	buf.BeginObject()
+	buf.WriteKey("id")
+	buf.WriteInt(-12)
+	buf.WriteKey("price")
+	buf.WriteFloat(1.5)
+	buf.WriteKey("tags")
+	buf.WriteValue(enc, &[]string{"a", "b"})
+	buf.WriteKey("items")
+	buf.BeginArray()
+	buf.WriteBool(true)
+	buf.WriteNull()
+	buf.BeginObject()
+	buf.EndObject()
+	buf.WriteStringValue("say \"hi\"")
+	buf.WriteRawValue([]byte(`{"raw":1}`))
+	buf.EndArray()
+	buf.WriteKey("count")
+	buf.WriteUint(3)
+	buf.EndObject()
+
+	want := `{"id":-12,"price":1.5,"tags":["a","b"],"items":[true,null,{},"say \"hi\"",{"raw":1}],"count":3}`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func Test_BufferHash(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	buf.SetHash(sha256.New())
+
+	for i := 0; i < 2; i++ { // second pass makes sure Reset starts the digest over
+		buf.Reset()
+		enc.Marshal(largePayload, buf)
+
+		want := sha256.Sum256(buf.Bytes)
+		if got := buf.Sum(nil); !bytes.Equal(want[:], got) {
+			t.Fatalf("want: %x got: %x", want, got)
+		}
+
+		if etag := fmt.Sprintf(`"%x"`, want); buf.ETag() != etag {
+			t.Errorf("want: %s got: %s", etag, buf.ETag())
+		}
+	}
+}
+
+func Test_Hash(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(largePayload, buf)
+
+	h := sha256.New()
+	if err := Hash(enc, largePayload, h); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(buf.Bytes); !bytes.Equal(want[:], h.Sum(nil)) {
+		t.Errorf("want: %x got: %x", want, h.Sum(nil))
+	}
+
+	if err := Hash(failingEncoder{}, nil, sha256.New()); err != errBroken {
+		t.Errorf("want %v got %v", errBroken, err)
+	}
+}
+
+// mustMarshalBytes is MarshalBytes for values which are known to encode
+func mustMarshalBytes(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := MarshalBytes(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func Test_MarshalExact(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+	want := mustMarshalBytes(t, largePayload)
+
+	if n, err := ExactSize(enc, largePayload); err != nil || n != len(want) {
+		t.Errorf("want %d got %d %v", len(want), n, err)
+	}
+
+	got, err := MarshalExact(enc, largePayload)
+	if err != nil || !bytes.Equal(want, got) || cap(got) != len(want) {
+		t.Errorf("want %d bytes with no spare capacity got %d of %d %v", len(want), len(got), cap(got), err)
+	}
+
+	small := &SmallPayload{St: 1, Sid: 2}
+	got, err = MarshalExact(NewStructEncoder(SmallPayload{}), small)
+	if want := mustMarshalBytes(t, small); err != nil || !bytes.Equal(want, got) || cap(got) != len(want) {
+		t.Errorf("want %s got %s of %d %v", want, got, cap(got), err)
+	}
+}
+
+func Test_SegmentedBuffer(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	buf := NewSegmentedBuffer(256)
+	defer buf.ReturnToPool()
+	buf.SetHash(sha256.New())
+	enc.Marshal(largePayload, buf)
+
+	if len(buf.segs) == 0 {
+		t.Fatal("expected the document to span several segments")
+	}
+
+	if buf.Len() != len(want.Bytes) {
+		t.Errorf("want: %d got: %d", len(want.Bytes), buf.Len())
+	}
+
+	var out bytes.Buffer
+	buf.WriteTo(&out)
+	if !bytes.Equal(want.Bytes, out.Bytes()) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, out.Bytes())
+	}
+
+	if c := buf.Clone(); !bytes.Equal(want.Bytes, c.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, c.Bytes)
+	}
+
+	if sum := sha256.Sum256(want.Bytes); !bytes.Equal(sum[:], buf.Sum(nil)) {
+		t.Errorf("want: %x got: %x", sum, buf.Sum(nil))
+	}
+}
+
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func Test_StreamingBuffer(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	var out writeCounter
+	buf := NewStreamingBuffer(&out, 512)
+	defer buf.ReturnToPool()
+
+	enc.Marshal(largePayload, buf)
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.writes < 2 {
+		t.Errorf("expected the document to be flushed incrementally, got %d writes", out.writes)
+	}
+
+	if !bytes.Equal(want.Bytes, out.Bytes()) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, out.Bytes())
+	}
+}
+
+func Test_MarshalChunks(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	var got []byte
+	chunks := 0
+	err := MarshalChunks(enc, largePayload, 1024, func(chunk []byte) error {
+		chunks++
+		got = append(got, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks < len(want.Bytes)/1024 {
+		t.Errorf("expected at least %d chunks, got %d", len(want.Bytes)/1024, chunks)
+	}
+	if !bytes.Equal(want.Bytes, got) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, got)
+	}
+
+	chunks = 0
+	err = MarshalChunks(enc, largePayload, 1024, func(chunk []byte) error {
+		chunks++
+		return errBroken
+	})
+	if err != errBroken || chunks != 1 {
+		t.Errorf("expected encoding to stop at the first error, got %v after %d chunks", err, chunks)
+	}
+}
+
+// chunkyEncoder writes a long run of chunks, closing done once it stops
+type chunkyEncoder struct {
+	done chan struct{}
+}
+
+func (e chunkyEncoder) Marshal(v interface{}, b *Buffer) {
+	defer close(e.done)
+	for i := 0; i < 100 && b.ok(); i++ {
+		b.Write(make([]byte, compressChunk))
+	}
+}
+
+func Test_MarshalReader(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	r := MarshalReader(enc, largePayload)
+	got, err := ioutil.ReadAll(iotest.OneByteReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes, got) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, got)
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ioutil.ReadAll(MarshalReader(failingEncoder{}, largePayload)); err != errBroken {
+		t.Errorf("want %v got %v", errBroken, err)
+	}
+
+	// closing early stops the encoding rather than leaving it blocked
+	stop := chunkyEncoder{make(chan struct{})}
+	r = MarshalReader(stop, nil)
+	r.Read(make([]byte, 1))
+	r.Close()
+	select {
+	case <-stop.done:
+	case <-time.After(time.Second):
+		t.Error("encoding didn't stop once the reader was closed")
+	}
+}
+
+func Test_MarshalTo(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	want.WriteString("prefix")
+	enc.Marshal(largePayload, want)
+
+	for _, size := range []int{16, 600, 4096, 1 << 16} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			var out writeCounter
+			w := bufio.NewWriterSize(&out, size)
+			w.WriteString("prefix")
+
+			if err := MarshalTo(w, enc, largePayload); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(want.Bytes, out.Bytes()) {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, out.Bytes())
+			}
+		})
+	}
+
+	t.Run("unbuffered", func(t *testing.T) {
+		var out writeCounter
+		out.WriteString("prefix")
+		if err := MarshalTo(&out, enc, largePayload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want.Bytes, out.Bytes()) {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, out.Bytes())
+		}
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		w := bufio.NewWriterSize(brokenWriter{}, 1024)
+		if err := MarshalTo(w, enc, largePayload); err != errBroken {
+			t.Errorf("want: %v got: %v", errBroken, err)
+		}
+	})
+
+	w := bufio.NewWriterSize(ioutil.Discard, 4096)
+	if n := testing.AllocsPerRun(100, func() { MarshalTo(w, enc, largePayload) }); n != 0 {
+		t.Errorf("expected no allocations encoding into a bufio.Writer, got %v", n)
+	}
+}
+
+var errBroken = errors.New("broken")
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write(p []byte) (int, error) {
+	return 0, errBroken
+}
+
+func Test_SpillBuffer(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	dir := t.TempDir()
+	buf := NewSpillBuffer(1024, dir)
+	enc.Marshal(largePayload, buf)
+
+	if buf.spill.f == nil {
+		t.Fatal("expected the document to spill to disk")
+	}
+
+	for i := 0; i < 2; i++ { // replaying twice makes sure the file is rewound
+		var out bytes.Buffer
+		buf.WriteTo(&out)
+		if !bytes.Equal(want.Bytes, out.Bytes()) {
+			t.Fatalf("\nwant:\n%s\ngot:\n%s", want.Bytes, out.Bytes())
+		}
+	}
+
+	buf.ReturnToPool()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the spill file to be removed, found %d files", len(files))
+	}
+}
+
+func Test_PoolStats(t *testing.T) {
+
+	EnablePoolStats(true)
+	SetPoolMaxCap(1 << 16)
+	defer func() {
+		EnablePoolStats(false)
+		SetPoolMaxCap(0)
+	}()
+
+	before := ReadPoolStats()
+
+	NewBufferFromPool().ReturnToPool()
+	NewBufferFromPoolWithCap(1 << 17).ReturnToPool()
+
+	after := ReadPoolStats()
+	if d := after.Gets - before.Gets; d != 2 {
+		t.Errorf("gets: want: 2 got: %d", d)
+	}
+	if d := after.Puts - before.Puts; d != 1 {
+		t.Errorf("puts: want: 1 got: %d", d)
+	}
+	if d := after.Dropped - before.Dropped; d != 1 {
+		t.Errorf("dropped: want: 1 got: %d", d)
+	}
+
+	var v struct {
+		Gets uint64 `json:"gets"`
+	}
+	if err := json.Unmarshal([]byte(PoolStatsVar.String()), &v); err != nil || v.Gets < after.Gets {
+		t.Errorf("unexpected expvar output %s: %v", PoolStatsVar.String(), err)
+	}
+}
+
+type failingEncoder struct{}
+
+func (failingEncoder) Marshal(v interface{}, b *Buffer) {
+	b.WriteString(`{"partial":`)
+	b.fail(errBroken)
+}
+
+func Test_Var(t *testing.T) {
+
+	enc := NewStructEncoder(SmallPayload{})
+	v := *smallPayload
+
+	var ev expvar.Var = Var(enc, &v)
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(&v, want)
+	if ev.String() != want.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.String(), ev.String())
+	}
+
+	v.St = 42 // the current value is reported
+	if !strings.Contains(ev.String(), `"st":42`) {
+		t.Errorf("expected the updated value, got %s", ev.String())
+	}
+
+	if n := testing.AllocsPerRun(100, func() { _ = ev.String() }); n != 1 {
+		t.Errorf("expected a single allocation for the string, got %v", n)
+	}
+
+	if s := Var(failingEncoder{}, &v).String(); s != "null" {
+		t.Errorf("want null got %s", s)
+	}
+}
+
+type countingAllocator struct {
+	allocs, bytes int
+}
+
+func (a *countingAllocator) Alloc(n int) []byte {
+	a.allocs++
+	a.bytes += n
+	return make([]byte, 0, n)
+}
+
+func Test_BufferWithAllocator(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	a := &countingAllocator{}
+	buf := NewBufferWithAllocator(a, 64)
+	defer buf.ReturnToPool()
+
+	enc.Marshal(largePayload, buf)
+
+	if a.allocs < 2 || cap(buf.Bytes) > a.bytes {
+		t.Errorf("expected the buffer to grow from the allocator, got %d allocs of %d bytes for %d cap", a.allocs, a.bytes, cap(buf.Bytes))
+	}
+
+	if !bytes.Equal(want.Bytes, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, buf.Bytes)
+	}
+}
+
+func Test_SizeClasses(t *testing.T) {
+
+	for _, tt := range []struct{ n, classFor, classOf int }{
+		{0, 0, -1},
+		{511, 0, -1},
+		{512, 0, 0},
+		{513, 1, 0},
+		{1024, 1, 1},
+		{1 << 21, 12, 12},
+		{1<<21 + 1, -1, -1},
+		{1 << 22, -1, -1},
+	} {
+		if c := classFor(tt.n); c != tt.classFor {
+			t.Errorf("classFor(%d): want: %d got: %d", tt.n, tt.classFor, c)
+		}
+		if c := classOf(tt.n); c != tt.classOf {
+			t.Errorf("classOf(%d): want: %d got: %d", tt.n, tt.classOf, c)
+		}
+	}
+
+	b := NewBufferFromPoolWithCap(3000)
+	if cap(b.Bytes) < 3000 {
+		t.Errorf("want cap >= 3000 got: %d", cap(b.Bytes))
+	}
+	b.ReturnToPool()
+
+	// a sized buffer grown beyond the largest class goes back to the general pool
+	b = NewBufferFromPoolWithCap(1 << 21)
+	b.Bytes = make([]byte, 0, 1<<22)
+	b.ReturnToPool()
+	if b.sized {
+		t.Errorf("expected an oversized buffer to be returned to the general pool")
+	}
+}
+
+func BenchmarkPoolWithCapParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		n := 0
+		for pb.Next() {
+			buf := NewBufferFromPoolWithCap(256 << uint(n%8))
+			buf.ReturnToPool()
+			n++
+		}
+	})
+}
+
+func Test_MarshalCompressed(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	var gz bytes.Buffer
+	if err := MarshalGzip(&gz, enc, largePayload); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); !bytes.Equal(want.Bytes, got) {
+		t.Errorf("gzip\nwant:\n%s\ngot:\n%s", want.Bytes, got)
+	}
+
+	var fl bytes.Buffer
+	if err := MarshalDeflate(&fl, enc, largePayload); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(flate.NewReader(&fl)); !bytes.Equal(want.Bytes, got) {
+		t.Errorf("deflate\nwant:\n%s\ngot:\n%s", want.Bytes, got)
+	}
+}
+
+func Test_BufferString(t *testing.T) {
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	buf.WriteString("before")
+	safe, unsafe := buf.String(), buf.UnsafeString()
+
+	buf.Reset()
+	buf.WriteString("after!")
+
+	if safe != "before" {
+		t.Errorf("want: before got: %s", safe)
+	}
+	if unsafe != "after!" {
+		t.Errorf("expected UnsafeString to share memory with the buffer, got: %s", unsafe)
+	}
+}
+
+func Test_ConfigNewline(t *testing.T) {
+
+	type node struct {
+		Name  string `json:"name"`
+		Child *node  `json:"child"`
+	}
+
+	senc := NewStructEncoderWithConfig(node{}, Config{Newline: true})
+	lenc := NewSliceEncoderWithConfig([]int{}, Config{Newline: true})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	senc.Marshal(&node{Name: "a", Child: &node{Name: "b"}}, buf)
+	senc.Marshal(&node{Name: "c"}, buf)
+	lenc.Marshal(&[]int{1, 2}, buf)
+
+	want := "{\"name\":\"a\",\"child\":{\"name\":\"b\",\"child\":null}}\n{\"name\":\"c\",\"child\":null}\n[1,2]\n"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, buf.String())
+	}
+}
+
+func Test_EnablePooling(t *testing.T) {
+
+	EnablePooling(false)
+	defer EnablePooling(true)
+
+	a := NewBufferFromPoolWithCap(1024)
+	a.WriteString("a")
+	a.ReturnToPool()
+
+	b := NewBufferFromPoolWithCap(1024)
+	defer b.ReturnToPool()
+
+	if a == b {
+		t.Error("expected a fresh buffer with pooling disabled")
+	}
+}
+
+func Test_BufferGrow(t *testing.T) {
+
+	buf := &Buffer{}
+	buf.WriteString("abc")
+	buf.Grow(100)
+	if cap(buf.Bytes)-len(buf.Bytes) < 100 || buf.String() != "abc" {
+		t.Errorf("want 100 bytes free after abc, got %d free after %s", cap(buf.Bytes)-len(buf.Bytes), buf.Bytes)
+	}
+
+	stream := NewStreamingBuffer(ioutil.Discard, 512)
+	defer stream.ReturnToPool()
+	stream.Grow(1 << 20)
+	if cap(stream.Bytes) >= 1<<20 {
+		t.Errorf("expected a streaming buffer's growth to be capped, got cap %d", cap(stream.Bytes))
+	}
+
+	// a fresh buffer should be presized by the encoder's estimate in one go
+	enc := NewSliceEncoder([]SmallPayload{})
+	v := make([]SmallPayload, 100)
+	for i := range v {
+		v[i] = *smallPayload
+	}
+
+	buf = &Buffer{}
+	enc.Marshal(&v, buf)
+	if n := len(buf.Bytes); cap(buf.Bytes) < n || cap(buf.Bytes) > 4*n {
+		t.Errorf("unexpected capacity %d for a %d byte document", cap(buf.Bytes), n)
+	}
+
+	// and a struct whose static bytes and field widths are all known up-front never needs to regrow
+	senc := NewStructEncoder(SmallPayload{})
+	buf = &Buffer{}
+	senc.Marshal(smallPayload, buf)
+	if cap(buf.Bytes) != senc.EstimatedSize() {
+		t.Errorf("want capacity %d from a single grow, got %d", senc.EstimatedSize(), cap(buf.Bytes))
+	}
+}
+
+func Test_BufferReserve(t *testing.T) {
+
+	buf := NewStreamingBuffer(ioutil.Discard, 4)
+	defer buf.ReturnToPool()
+
+	buf.WriteString(`{"n":`)
+	w := buf.Reserve(20)
+	buf.Commit(len(strconv.AppendInt(w[:0], -1234567890, 10)))
+	buf.WriteByte('}')
+
+	if want := `{"n":-1234567890}`; buf.String() != want {
+		t.Errorf("want: %s got: %s", want, buf.String())
+	}
+}
+
+func Test_Marshal(t *testing.T) {
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	NewStructEncoder(SmallPayload{}).Marshal(smallPayload, want)
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	Marshal(smallPayload, buf)
+
+	if !bytes.Equal(want.Bytes, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, buf.Bytes)
+	}
+
+	if got, err := MarshalBytes(&[]int{1, 2, 3}); err != nil || string(got) != "[1,2,3]" {
+		t.Errorf("want: [1,2,3] got: %s %v", got, err)
+	}
+
+	buf.Reset()
+	Marshal(*smallPayload, buf)
+	if !bytes.Equal(want.Bytes, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, buf.Bytes)
+	}
+
+	if got, err := MarshalBytes([]int{1, 2, 3}); err != nil || string(got) != "[1,2,3]" {
+		t.Errorf("want: [1,2,3] got: %s %v", got, err)
+	}
+
+	buf.Reset()
+	Marshal(nil, buf)
+	Marshal((*SmallPayload)(nil), buf)
+	if buf.String() != "nullnull" {
+		t.Errorf("want: nullnull got: %s", buf.String())
+	}
+
+	buf.Reset()
+	if Marshal(42, buf); !errors.Is(buf.Err(), ErrUnsupportedType) || buf.Len() != 0 {
+		t.Errorf("want ErrUnsupportedType got %v", buf.Err())
+	}
+
+	type withMap struct {
+		M map[string]int `json:"m"`
+	}
+	if got, err := MarshalBytes(&withMap{}); !errors.Is(err, ErrUnsupportedType) || got != nil {
+		t.Errorf("want ErrUnsupportedType got %s %v", got, err)
+	}
+
+	// values whose data word is nil are only null when they're pointers
+	buf.Reset()
+	Marshal(onePtr{}, buf)
+	if buf.String() != `{"p":null}` {
+		t.Errorf(`want {"p":null} got %s`, buf.String())
+	}
+	for _, v := range []interface{}{map[string]int(nil), (func())(nil), (*map[string]int)(nil)} {
+		buf.Reset()
+		if Marshal(v, buf); !errors.Is(buf.Err(), ErrUnsupportedType) || buf.Len() != 0 {
+			t.Errorf("%T: want ErrUnsupportedType got %v %s", v, buf.Err(), buf.Bytes)
+		}
+	}
+}
+
+// onePtr is stored directly in an interface's data word, having a single pointer field
+type onePtr struct {
+	P *int `json:"p"`
+}
+
+func BenchmarkMarshalSmallPayload(b *testing.B) {
+
+	buf := NewBufferFromPool()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Marshal(smallPayload, buf)
+		buf.Reset()
+	}
+}
+
+func Test_MarshalWithConfig(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	compact := NewBufferFromPool()
+	defer compact.ReturnToPool()
+	enc.Marshal(largePayload, compact)
+
+	var want bytes.Buffer
+	json.Indent(&want, compact.Bytes, ">", "\t")
+	want.WriteByte('\n')
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc.MarshalWithConfig(largePayload, buf, Config{Prefix: ">", Indent: "\t", Newline: true})
+	if !bytes.Equal(want.Bytes(), buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes(), buf.Bytes)
+	}
+
+	// compiled with a config then overridden per call
+	buf.Reset()
+	NewStructEncoderWithConfig(LargePayload{}, Config{Indent: "  "}).MarshalWithConfig(largePayload, buf, Config{})
+	if !bytes.Equal(compact.Bytes, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", compact.Bytes, buf.Bytes)
+	}
+
+	buf.Reset()
+	lenc := NewSliceEncoderWithConfig([]int{}, Config{Indent: " ", Newline: true})
+	lenc.Marshal(&[]int{1, 2}, buf)
+	lenc.Marshal(&[]int{}, buf)
+	if want := "[\n 1,\n 2\n]\n[]\n"; buf.String() != want {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, buf.String())
+	}
+
+	type id struct {
+		ID int `json:"id"`
+	}
+	buf.Reset()
+	senc := NewStructEncoderWithConfig(id{}, Config{Suffix: ","})
+	senc.Marshal(&id{1}, buf)
+	senc.MarshalWithConfig(&id{2}, buf, Config{Suffix: ",", Newline: true})
+	NewSliceEncoderWithConfig([]int{}, Config{Suffix: ";"}).Marshal(&[]int{3}, buf)
+	if want := "{\"id\":1},{\"id\":2},\n[3];"; buf.String() != want {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, buf.String())
+	}
+}
+
+func Test_Fuse(t *testing.T) {
+
+	// the opening static chunk, then one instruction per field with the chunk after it fused in
+	enc := NewStructEncoder(SmallPayload{})
+	if want := 1 + reflect.TypeOf(SmallPayload{}).NumField(); len(enc.instructions) != want {
+		t.Errorf("want %d instructions got %d", want, len(enc.instructions))
+	}
+
+	want := `{"st":1,"sid":2,"tt":"t","gr":3,"uuid":"u","ip":"i","ua":"a","tz":4,"v":5}`
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(&SmallPayload{1, 2, "t", 3, "u", "i", "a", 4, 5}, buf)
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func Test_WriteFused(t *testing.T) {
+
+	// with and without room for the value and static data together
+	for _, c := range []int{0, 3, 4, 5, 64} {
+		w := &Buffer{Bytes: make([]byte, 0, c)}
+		writeFused(w, "ab", []byte(`",`))
+		if want := `ab",`; w.String() != want {
+			t.Errorf("cap %d: want %s got %s", c, want, w.Bytes)
+		}
+	}
+}
+
+func Test_InlineStruct(t *testing.T) {
+
+	type leaf struct {
+		N    int     `json:"n"`
+		PtrN *int    `json:"ptrn"`
+		F    float64 `json:"f"`
+	}
+	type middle struct {
+		Name string    `json:"name"`
+		Leaf leaf      `json:"leaf"`
+		When time.Time `json:"when"`
+		Tags []string  `json:"tags"`
+	}
+	type outer struct {
+		ID     int    `json:"id"`
+		Middle middle `json:"middle"`
+		Empty  struct {
+			Skipped int
+		} `json:"empty"`
+		Last string `json:"last"`
+	}
+
+	enc := NewStructEncoder(outer{})
+
+	// every value is written by the outer encoder, with nothing left to delegate to
+	if want := 1 + 8; len(enc.instructions) != want {
+		t.Errorf("want %d instructions got %d\n%s", want, len(enc.instructions), enc.Explain())
+	}
+
+	n := 7
+	tests := []struct {
+		v    outer
+		want string
+	}{
+		{outer{}, `{"id":0,"middle":{"name":"","leaf":{"n":0,"ptrn":null,"f":0},"when":"0001-01-01T00:00:00Z","tags":[]},"empty":{},"last":""}`},
+		{
+			outer{ID: 1, Middle: middle{"m", leaf{2, &n, 1.5}, time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC), []string{"a"}}, Last: "l"},
+			`{"id":1,"middle":{"name":"m","leaf":{"n":2,"ptrn":7,"f":1.5},"when":"2000-01-02T03:04:05Z","tags":["a"]},"empty":{},"last":"l"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		buf := NewBufferFromPool()
+		enc.Marshal(&tt.v, buf)
+		if buf.String() != tt.want {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+		}
+		buf.ReturnToPool()
+	}
+}
+
+func Test_ConcurrentMarshal(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+	configured := enc.WithConfig(Config{Newline: true})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	// run with -race, each goroutine shares the encoders and should get the same document
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+			for i := 0; i < 50; i++ {
+				buf.Reset()
+				enc.Marshal(largePayload, buf)
+				if !bytes.Equal(want.Bytes, buf.Bytes) {
+					t.Errorf("unexpected document:\n%s", buf.Bytes)
+					return
+				}
+
+				buf.Reset()
+				if err := enc.MarshalSafe(largePayload, buf); err != nil || !bytes.Equal(want.Bytes, buf.Bytes) {
+					t.Errorf("unexpected document from MarshalSafe, %v:\n%s", err, buf.Bytes)
+					return
+				}
+
+				buf.Reset()
+				configured.Marshal(largePayload, buf)
+				if !bytes.Equal(want.Bytes, bytes.TrimSuffix(buf.Bytes, []byte("\n"))) {
+					t.Errorf("unexpected configured document:\n%s", buf.Bytes)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_Precompile(t *testing.T) {
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// a chain of distinct types, each pointing to the one before, long enough to be precompiled
+	var types []reflect.Type
+	for i := 0; i < minPrecompile+4; i++ {
+		fs := []reflect.StructField{
+			{Name: "N", Type: reflect.TypeOf(0), Tag: reflect.StructTag(fmt.Sprintf(`json:"n%d"`, i))},
+			{Name: "L", Type: reflect.TypeOf([]int{}), Tag: `json:"l"`},
+		}
+		if i > 0 {
+			fs = append(fs, reflect.StructField{Name: "P", Type: reflect.PtrTo(types[i-1]), Tag: `json:"p"`})
+		}
+		types = append(types, reflect.StructOf(fs))
+	}
+
+	root := types[len(types)-1]
+
+	// each type is found once, after those it depends on, skipping those compiled already
+	sharedSlice([]int{}, allVersions, 0)
+	var nested []reflect.Type
+	walkNested(root, allVersions, 0, map[reflect.Type]bool{root: true}, &nested)
+	want := types[:len(types)-1]
+	if !reflect.DeepEqual(want, nested) {
+		t.Errorf("want %d types in dependency order got %v", len(want), nested)
+	}
+
+	enc := NewStructEncoder(reflect.New(root).Elem().Interface())
+	for _, nt := range want {
+		if _, ok := compiled.Load(compiledKey{nt, allVersions, 0}); !ok {
+			t.Errorf("expected %v to have been compiled", nt)
+		}
+	}
+
+	nested = nested[:0]
+	if walkNested(root, allVersions, 0, map[reflect.Type]bool{root: true}, &nested); len(nested) != 0 {
+		t.Errorf("want nothing left to compile got %d types", len(nested))
+	}
+
+	// types the compiler refuses are left to the caller's own compile to report
+	type unsupported struct {
+		C chan int `json:"c"`
+	}
+	if r := precompileType(reflect.TypeOf(unsupported{}), allVersions, 0); r != nil {
+		t.Errorf("want the compile error left to the caller got %v", r)
+	}
+
+	v := reflect.New(root)
+	v.Elem().Field(0).SetInt(1)
+	p := reflect.New(types[len(types)-2])
+	p.Elem().Field(0).SetInt(2)
+	v.Elem().Field(2).Set(p)
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(v.Interface(), buf)
+
+	doc := fmt.Sprintf(`{"n%d":1,"l":[],"p":{"n%d":2,"l":[],"p":null}}`, len(types)-1, len(types)-2)
+	if buf.String() != doc {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", doc, buf.Bytes)
+	}
+}
+
+func Test_Explain(t *testing.T) {
+
+	type inner struct {
+		Name   string `json:"name"`
+		Secret string
+		Next   *inner  `json:"next"`
+		Score  float64 `json:"score,stringer"`
+	}
+
+	got := NewStructEncoder(inner{}).Explain()
+	for _, want := range []string{
+		`Name -> "name": string`,
+		`Secret: skipped, no json tag`,
+		`Next -> "next": nullable struct`,
+		`see above`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %q in:\n%s", want, got)
+		}
+	}
+
+	got = NewSliceEncoder([]*LargePayload{}).Explain()
+	if !strings.HasPrefix(got, "SliceEncoder []*jingo.LargePayload, nullable struct elements") || !strings.Contains(got, "SliceEncoder jingo.DSUsers, nullable struct elements") {
+		t.Errorf("unexpected plan:\n%s", got)
+	}
+}
+
+func Test_EstimatedSize(t *testing.T) {
+
+	type user struct {
+		Name string `json:"name"`
+		Age  int8   `json:"age"`
+	}
+
+	// static `{"name":"","age":}` plus a typical string and int8
+	if got, want := NewStructEncoder(user{}).EstimatedSize(), 18+18+3; got != want {
+		t.Errorf("want %d got %d", want, got)
+	}
+
+	// brackets plus each element and its separator
+	if got, want := NewSliceEncoder([]user{}).EstimatedSize(2), 2+2*(1+39); got != want {
+		t.Errorf("want %d got %d", want, got)
+	}
+}
+
+func Test_EnableLazyCompile(t *testing.T) {
+
+	eager := NewBufferFromPool()
+	defer eager.ReturnToPool()
+	NewStructEncoder(LargePayload{}).Marshal(largePayload, eager)
+
+	EnableLazyCompile(true)
+	defer EnableLazyCompile(false)
+
+	enc := NewStructEncoder(LargePayload{})
+	users := enc.plan[0].nested.(*lazySlice)
+	if users.enc != nil {
+		t.Fatal("nested encoder compiled up-front")
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(largePayload, buf)
+
+	if users.enc == nil {
+		t.Error("nested encoder not compiled on use")
+	}
+	if !bytes.Equal(eager.Bytes, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", eager.Bytes, buf.Bytes)
+	}
+}
+
+func Test_SharedNestedEncoders(t *testing.T) {
+
+	type address struct {
+		Street string `json:"street"`
+	}
+	type person struct {
+		Home    address    `json:"home"`
+		Work    *address   `json:"work"`
+		History []address  `json:"history"`
+		Other   []*address `json:"other"`
+	}
+
+	enc := NewStructEncoder(person{})
+	home := enc.plan[0].nested
+	if home != enc.plan[1].nested {
+		t.Error("struct fields of the same type compiled separately")
+	}
+	if home != enc.plan[2].nested.(*SliceEncoder).nested {
+		t.Error("slice elements compiled separately from struct fields")
+	}
+	if enc.plan[2].nested == enc.plan[3].nested {
+		t.Error("different slice types share an encoder")
+	}
+}
+
+type cents int64
+
+func Test_RegisterTypeEncoder(t *testing.T) {
+
+	RegisterTypeEncoder(reflect.TypeOf(cents(0)), func(v unsafe.Pointer, w *Buffer) {
+		c := *(*cents)(v)
+		w.WriteString(strconv.FormatInt(int64(c/100), 10))
+		w.WriteByte('.')
+		w.WriteString(fmt.Sprintf("%02d", c%100))
+	})
+
+	type price struct {
+		Net    cents    `json:"net"`
+		Gross  *cents   `json:"gross"`
+		Tax    *cents   `json:"tax"`
+		Bands  []cents  `json:"bands"`
+		Extras []*cents `json:"extras"`
+	}
+
+	gross := cents(1250)
+	v := price{Net: 1005, Gross: &gross, Bands: []cents{1, 250}, Extras: []*cents{nil, &gross}}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(price{}).Marshal(&v, buf)
+
+	want := `{"net":10.05,"gross":12.50,"tax":null,"bands":[0.01,2.50],"extras":[null,12.50]}`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func Test_SetHooks(t *testing.T) {
+
+	type node struct {
+		ID   int   `json:"id"`
+		Next *node `json:"next"`
+	}
+
+	plain := NewStructEncoder(node{})
+	enc := plain.SetHooks(func(p unsafe.Pointer, w *Buffer) {
+		w.WriteString(`{"root":`)
+		w.WriteString(strconv.Itoa((*node)(p).ID))
+		w.WriteString(`,"data":`)
+	}, func(p unsafe.Pointer, w *Buffer) {
+		w.WriteByte('}')
+	})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(&node{ID: 1, Next: &node{ID: 2}}, buf)
+
+	want := `{"root":1,"data":{"id":1,"next":{"id":2,"next":null}}}`
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	// the encoder hooks were set on is left as it was
+	buf.Reset()
+	plain.Marshal(&node{ID: 1}, buf)
+	if want := `{"id":1,"next":null}`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	senc := NewSliceEncoder([]int{}).SetHooks(nil, func(p unsafe.Pointer, w *Buffer) {
+		w.WriteByte('\n')
+	})
+	senc.Marshal(&[]int{1, 2}, buf)
+	if want := "[1,2]\n"; buf.String() != want {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, buf.String())
+	}
+}
+
+type observation struct {
+	typ   string
+	bytes int
+}
+
+// recordingMetrics records the observations made, less their durations
+type recordingMetrics struct {
+	mu  sync.Mutex
+	obs []observation
+}
+
+func (m *recordingMetrics) ObserveMarshal(typ string, bytes int, dur time.Duration) {
+	m.mu.Lock()
+	m.obs = append(m.obs, observation{typ, bytes})
+	m.mu.Unlock()
+}
+
+func Test_Metrics(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+	ints := NewSliceEncoder([]int{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	var global, own recordingMetrics
+	SetMetrics(&global)
+	defer SetMetrics(nil)
+
+	// nested documents aren't observed
+	buf.WriteString("prefix")
+	enc.Marshal(largePayload, buf)
+	n := buf.Len() - len("prefix")
+	ints.Marshal(&[]int{1, 2}, buf)
+
+	// variants made with WithConfig are named after the encoder's type
+	buf.Reset()
+	enc.WithConfig(Config{Newline: true}).Marshal(largePayload, buf)
+	ints.WithConfig(Config{Indent: " "}).Marshal(&[]int{1, 2}, buf)
+
+	want := []observation{{"jingo.LargePayload", n}, {"[]int", 5}, {"jingo.LargePayload", n + 1}, {"[]int", 10}}
+	if !reflect.DeepEqual(want, global.obs) {
+		t.Errorf("want %v got %v", want, global.obs)
+	}
+
+	// an encoder's own metrics take precedence, and carry over to its variants
+	small := NewStructEncoder(SmallPayload{}).SetMetrics(&own)
+	buf.Reset()
+	small.Marshal(smallPayload, buf)
+	n = buf.Len()
+	small.WithConfig(Config{Newline: true}).Marshal(smallPayload, buf)
+	if want := []observation{{"jingo.SmallPayload", n}, {"jingo.SmallPayload", n + 1}}; !reflect.DeepEqual(want, own.obs) || len(global.obs) != 4 {
+		t.Errorf("want %v got %v, global %v", want, own.obs, global.obs)
+	}
+
+	// and remain once global metrics are off
+	SetMetrics(nil)
+	enc.Marshal(largePayload, buf)
+	small.Marshal(smallPayload, buf)
+	if len(global.obs) != 4 || len(own.obs) != 3 {
+		t.Errorf("want 4 and 3 observations got %v and %v", global.obs, own.obs)
+	}
+
+	// the variants of Marshal are observed too
+	var variants recordingMetrics
+	sm := NewStructEncoder(SmallPayload{}).SetMetrics(&variants)
+	si := NewSliceEncoder([]int{}).SetMetrics(&variants)
+	buf.Reset()
+	sm.MarshalWithConfig(smallPayload, buf, Config{Newline: true})
+	sm.MarshalVersion(smallPayload, buf, 0)
+	sm.MarshalMasked(smallPayload, buf, sm.CompileMask("st"))
+	si.MarshalWithConfig(&[]int{1}, buf, Config{Newline: true})
+	si.MarshalVersion(&[]int{1}, buf, 0)
+
+	var types []string
+	for _, o := range variants.obs {
+		types = append(types, o.typ)
+	}
+	if want := []string{"jingo.SmallPayload", "jingo.SmallPayload", "jingo.SmallPayload", "[]int", "[]int"}; !reflect.DeepEqual(want, types) {
+		t.Errorf("want %v got %v", want, variants.obs)
+	}
+}
+
+type spanKey struct{}
+
+type span struct {
+	parent interface{}
+	typ    string
+	bytes  int
+	err    error
+	ended  bool
+}
+
+// recordingTracer records a span for each document, parented by the spanKey value of its context
+type recordingTracer struct {
+	spans []*span
+}
+
+func (tr *recordingTracer) StartMarshal(ctx context.Context, typ string) func(bytes int, err error) {
+	s := &span{parent: ctx.Value(spanKey{}), typ: typ}
+	tr.spans = append(tr.spans, s)
+	return func(bytes int, err error) {
+		s.bytes, s.err, s.ended = bytes, err, true
+	}
+}
+
+// spans returns copies of the spans recorded by tr
+func spans(tr recordingTracer) []span {
+	out := make([]span, len(tr.spans))
+	for i, s := range tr.spans {
+		out[i] = *s
+	}
+	return out
+}
+
+func Test_Tracer(t *testing.T) {
+
+	enc := NewStructEncoder(SmallPayload{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	var global recordingTracer
+	SetTracer(&global)
+	defer SetTracer(nil)
+
+	enc.Marshal(smallPayload, buf)
+	n := buf.Len()
+
+	// the span is found in contexts which can't be cancelled too
+	ctx := context.WithValue(context.Background(), spanKey{}, "request")
+	buf.Reset()
+	if err := enc.MarshalContext(ctx, smallPayload, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	buf.SetLimit(64)
+	NewStructEncoder(LargePayload{}).Marshal(largePayload, buf)
+	buf.SetLimit(0)
+
+	want := []span{
+		{nil, "jingo.SmallPayload", n, nil, true},
+		{"request", "jingo.SmallPayload", n, nil, true},
+		{nil, "jingo.LargePayload", buf.Len(), ErrBufferLimit, true},
+	}
+	if got := spans(global); !reflect.DeepEqual(want, got) {
+		t.Errorf("\nwant:\n%+v\ngot:\n%+v", want, got)
+	}
+
+	// an encoder's own tracer takes precedence, and remains once global tracing is off
+	SetTracer(nil)
+	var own recordingTracer
+	ints := NewSliceEncoder([]int{}).SetTracer(&own)
+
+	buf.Reset()
+	if err := ints.MarshalContext(ctx, &[]int{1}, buf); err != nil {
+		t.Fatal(err)
+	}
+	enc.Marshal(smallPayload, buf)
+
+	want = []span{{"request", "[]int", 3, nil, true}}
+	if got := spans(own); !reflect.DeepEqual(want, got) || len(global.spans) != 3 {
+		t.Errorf("\nwant:\n%+v\ngot:\n%+v, global %+v", want, got, spans(global))
+	}
+}
+
+func Test_Wrap(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	got, err := json.Marshal(map[string]json.Marshaler{"payload": Wrap(enc, largePayload)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := `{"payload":` + want.String() + `}`; string(got) != w {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", w, got)
+	}
+}
+
+func Test_WriteResponse(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	rec := httptest.NewRecorder()
+	if err := WriteResponse(rec, http.StatusCreated, enc, largePayload); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("want status %d got %d", http.StatusCreated, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(want.Len()) {
+		t.Errorf("want Content-Length %d got %s", want.Len(), cl)
+	}
+	if !bytes.Equal(want.Bytes, rec.Body.Bytes()) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, rec.Body.Bytes())
+	}
+
+	// a failed document leaves the response untouched for the caller to write
+	rec = httptest.NewRecorder()
+	if err := WriteResponse(rec, http.StatusCreated, failingEncoder{}, nil); err != errBroken {
+		t.Fatalf("want %v got %v", errBroken, err)
+	}
+	if len(rec.Header()) != 0 || rec.Body.Len() != 0 || rec.Code != http.StatusOK {
+		t.Errorf("unexpected response %d %v %q", rec.Code, rec.Header(), rec.Body.Bytes())
+	}
+}
+
+func Test_ResponseEncoder(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	tests := []struct {
+		name         string
+		stream       bool
+		v            interface{}
+		accept       string
+		gzip, length bool
+	}{
+		{"buffered", false, largePayload, "", false, true},
+		{"buffered gzip", false, largePayload, "br, gzip;q=0.8", true, true},
+		{"buffered gzip refused", false, largePayload, "gzip;q=0, deflate", false, true},
+		{"buffered too small to gzip", false, &LargePayload{}, "gzip", false, true},
+		{"streamed", true, largePayload, "", false, false},
+		{"streamed gzip", true, largePayload, "GZIP", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			if err := NewResponseEncoder(enc, tt.stream).Write(rec, r, http.StatusOK, tt.v); err != nil {
+				t.Fatal(err)
+			}
+
+			h := rec.Header()
+			if h.Get("Content-Type") != "application/json" || h.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("unexpected headers %v", h)
+			}
+			if got := h.Get("Content-Length"); (got != "") != tt.length || (tt.length && got != strconv.Itoa(rec.Body.Len())) {
+				t.Errorf("unexpected Content-Length %q for a %d byte body", got, rec.Body.Len())
+			}
+			if got := h.Get("Content-Encoding") == "gzip"; got != tt.gzip {
+				t.Fatalf("want gzip %v got %v", tt.gzip, got)
+			}
+
+			body := rec.Body.Bytes()
+			if tt.gzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = ioutil.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			doc := NewBufferFromPool()
+			defer doc.ReturnToPool()
+			enc.Marshal(tt.v, doc)
+			if !bytes.Equal(doc.Bytes, body) {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", doc.Bytes, body)
+			}
+		})
+	}
+}
+
+func Test_WriteEvent(t *testing.T) {
+
+	type tick struct {
+		Price int `json:"price"`
+	}
+
+	rec := httptest.NewRecorder()
+	if err := WriteEvent(rec, "tick", "7", NewStructEncoder(tick{}), &tick{5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteEvent(rec, "", "", NewStructEncoderWithConfig(tick{}, Config{Indent: " ", Newline: true}), &tick{6}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "event: tick\nid: 7\ndata: {\"price\":5}\n\ndata: {\ndata:  \"price\": 6\ndata: }\n\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, got)
+	}
+	if !rec.Flushed {
+		t.Error("want the response flushed")
+	}
+
+	for _, f := range [][2]string{{"tick\ndata: x", ""}, {"", "7\r"}, {"", "\n"}} {
+		rec := httptest.NewRecorder()
+		if err := WriteEvent(rec, f[0], f[1], NewStructEncoder(tick{}), &tick{5}); err != ErrInvalidEventField || rec.Body.Len() != 0 {
+			t.Errorf("%q: want ErrInvalidEventField got %v %q", f, err, rec.Body.Bytes())
+		}
+	}
+}
+
+func Test_MarshalJSONP(t *testing.T) {
+
+	type msg struct {
+		Text string `json:"text"`
+	}
+	enc := NewStructEncoder(msg{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	for _, text := range []string{"plain", "a\u2028b\u2029c\u2028", "\u2029"} {
+		buf.Reset()
+		if err := MarshalJSONP("jQuery1.cb_$", enc, &msg{text}, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		want := `jQuery1.cb_$({"text":"` + strings.NewReplacer("\u2028", `\u2028`, "\u2029", `\u2029`).Replace(text) + `"});`
+		if buf.String() != want {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+	}
+
+	// a quote in a plain string can't end it early and leave the rest to run
+	buf.Reset()
+	if err := MarshalJSONP("cb", enc, &msg{`"});alert(1);//`}, buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := `cb({"text":"\"});alert(1);//"});`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// nor can one from an encoder of another kind
+	buf.Reset()
+	buf.WriteString("kept")
+	if err := MarshalJSONP("cb", rawEncoder(`""});alert(1);//"`), nil, buf); err != ErrInvalidDocument || buf.String() != "kept" {
+		t.Errorf("want %v got %v %s", ErrInvalidDocument, err, buf.Bytes)
+	}
+
+	// a limit is kept to rather than escaping past it, and once hit nothing more is written
+	buf.Reset()
+	buf.SetLimit(20)
+	if err := MarshalJSONP("cb", enc, &msg{strings.Repeat("\u2028", 20)}, buf); err != ErrBufferLimit {
+		t.Errorf("want %v got %v", ErrBufferLimit, err)
+	}
+	n := buf.Len()
+	if err := MarshalJSONP("cb", enc, &msg{}, buf); err != ErrBufferLimit || buf.Len() != n {
+		t.Errorf("want %v with nothing written got %v %s", ErrBufferLimit, err, buf.Bytes)
+	}
+	buf.SetLimit(0)
+
+	// streaming buffers flush as they go without upsetting the check
+	var out bytes.Buffer
+	sb := NewStreamingBuffer(&out, 16)
+	long := strings.Repeat("a\u2028", 20)
+	if err := MarshalJSONP("cb", enc, &msg{long}, sb); err != nil {
+		t.Fatal(err)
+	}
+	sb.Flush()
+	sb.ReturnToPool()
+	if want := `cb({"text":"` + strings.ReplaceAll(long, "\u2028", `\u2028`) + `"});`; out.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, out.String())
+	}
+
+	for _, cb := range []string{"", "alert(1);f", "1f", "a..b", "a.", ".a", "a.1b"} {
+		buf.Reset()
+		if err := MarshalJSONP(cb, enc, &msg{}, buf); err != ErrInvalidCallback || buf.Len() != 0 {
+			t.Errorf("%q: want ErrInvalidCallback got %v %s", cb, err, buf.Bytes)
+		}
+	}
+}
+
+func Test_TemplateFunc(t *testing.T) {
+
+	type msg struct {
+		Text string `json:"text,escape"`
+		N    int    `json:"n"`
+	}
+	enc := NewStructEncoder(msg{})
+	tojson := TemplateFunc(enc)
+
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{"tojson": tojson}).Parse(
+		`<script>var d = {{tojson .}};</script><a onclick="f({{tojson .}})">{{tojson .}}</a>`))
+
+	v := &msg{Text: "</script><!-- a&b>c \u2028\u2029 \"q\"", N: 1}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, v); err != nil {
+		t.Fatal(err)
+	}
+
+	js := `{"text":"\u003c/script\u003e\u003c!-- a\u0026b\u003ec \u2028\u2029 \"q\"","n":1}`
+	html := strings.ReplaceAll(js, `"`, "&#34;")
+	want := `<script>var d = ` + js + `;</script><a onclick="f(` + html + `)">` + html + `</a>`
+	if out.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, out.String())
+	}
+
+	// the escapes decode to the original text
+	var back msg
+	if err := json.Unmarshal([]byte(js), &back); err != nil || back != *v {
+		t.Errorf("want %+v got %+v %v", *v, back, err)
+	}
+
+	if _, err := TemplateFunc(failingEncoder{})(v); err != errBroken {
+		t.Errorf("want %v got %v", errBroken, err)
+	}
+
+	// strings which aren't escaped normally can't break out of their quotes either
+	type profile struct {
+		Name  string   `json:"name"`
+		Alias *string  `json:"alias"`
+		Tags  []string `json:"tags"`
+		Quip  quip     `json:"quip,stringer"`
+	}
+	hostile := "\"};alert(1);//</script>"
+	p := &profile{Name: hostile, Alias: &hostile, Tags: []string{hostile}, Quip: quip(hostile)}
+	q := `"\"};alert(1);//\u003c/script\u003e"`
+	js = `{"name":` + q + `,"alias":` + q + `,"tags":[` + q + `],"quip":` + q + `}`
+
+	got, err := TemplateFunc(NewStructEncoder(profile{}))(p)
+	if err != nil || string(got) != js {
+		t.Errorf("\nwant:\n%s\ngot:\n%s %v", js, got, err)
+	}
+	var pback profile
+	if err := json.Unmarshal([]byte(got), &pback); err != nil || pback.Name != hostile || *pback.Alias != hostile {
+		t.Errorf("want %+v got %+v %v", *p, pback, err)
+	}
+
+	if got, err := TemplateFunc(NewSliceEncoder([]string{}))(&p.Tags); err != nil || string(got) != `[`+q+`]` {
+		t.Errorf("want [%s] got %s %v", q, got, err)
+	}
+
+	// the encoder it's given is left as it was
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(profile{}).Marshal(&profile{Name: `a"b`}, buf)
+	if want := `{"name":"a"b","alias":null,"tags":[],"quip":""}`; buf.String() != want {
+		t.Errorf("want %s got %s", want, buf.Bytes)
+	}
+
+	// anything else writing invalid JSON is refused rather than trusted
+	if got, err := TemplateFunc(rawEncoder(`""};alert(1);//"`))(nil); err != ErrInvalidDocument || got != "" {
+		t.Errorf("want %v got %q %v", ErrInvalidDocument, got, err)
+	}
+}
+
+type quip string
+
+func (q quip) String() string { return string(q) }
+
+// rawEncoder writes itself whatever it's given
+type rawEncoder string
+
+func (r rawEncoder) Marshal(v interface{}, b *Buffer) { b.WriteString(string(r)) }
+
+func Test_ObjectStream(t *testing.T) {
+
+	type user struct {
+		Name string `json:"name"`
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	buf.BeginArray()
+	for i := 0; i < 2; i++ {
+		o := NewObjectStream(buf)
+		o.Field("user", NewStructEncoder(user{}), &user{"a"})
+		o.RawField("meta", []byte(`{"cached":true}`))
+		o.Field("\"none\"", nil, nil)
+		o.RawField("empty", nil)
+		o.Close()
+	}
+	buf.EndArray()
+
+	obj := `{"user":{"name":"a"},"meta":{"cached":true},"\"none\"":null,"empty":null}`
+	if want := "[" + obj + "," + obj + "]"; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func Test_MarshalEnveloped(t *testing.T) {
+
+	enc := NewSliceEncoder([]int{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	MarshalEnveloped("data", enc, &[]int{1, 2}, buf)
+	if want := `{"data":[1,2]}`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	MarshalEnvelope(buf,
+		EnvelopeField{Key: "data", Enc: enc, Value: &[]int{3}},
+		EnvelopeField{Key: "error"},
+		EnvelopeField{Key: "warnings", Enc: enc, Value: &[]int{}},
+	)
+	if want := `{"data":[3],"error":null,"warnings":[]}`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	// encoders within using the token writer themselves start afresh
+	type doc struct {
+		A int      `json:"a"`
+		C tokenObj `json:"c,encoder"`
+		D int      `json:"d"`
+	}
+	buf.Reset()
+	MarshalEnveloped("data", NewStructEncoder(doc{}), &doc{A: 1, C: 2, D: 3}, buf)
+	if want := `{"data":{"a":1,"c":{"n":2},"d":3}}`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+// tokenObj writes itself with the token writer, i.e {"n":2}
+type tokenObj int
+
+func (o *tokenObj) JSONEncode(w *Buffer) {
+	w.BeginObject()
+	w.WriteKey("n")
+	w.WriteInt(int64(*o))
+	w.EndObject()
+}
+
+func Test_MarshalBatch(t *testing.T) {
+
+	type user struct {
+		Name string `json:"name"`
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	MarshalBatch(buf,
+		BatchItem{Enc: NewStructEncoder(user{}), Value: &user{Name: "a"}},
+		BatchItem{},
+		BatchItem{Enc: NewSliceEncoder([]int{}), Value: &[]int{1, 2}},
+	)
+	if want := `[{"name":"a"},null,[1,2]]`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	MarshalBatch(buf)
+	if want := `[]`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+type panicky struct{}
+
+func (panicky) String() string { panic("corrupt record") }
+
+func Test_MarshalSafe(t *testing.T) {
+
+	type record struct {
+		ID  int     `json:"id"`
+		Bad panicky `json:"bad,stringer"`
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	buf.WriteString("[")
+
+	err := NewStructEncoder(record{}).MarshalSafe(&record{ID: 1}, buf)
+	merr, ok := err.(*MarshalError)
+	if !ok {
+		t.Fatalf("want *MarshalError got %v", err)
+	}
+	if merr.Path != "jingo.record.Bad" || merr.Panic != "corrupt record" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if buf.String() != "[" {
+		t.Errorf("partial document left in buffer %q", buf.String())
+	}
+
+	if err := NewStructEncoder(LargePayload{}).MarshalSafe(largePayload, buf); err != nil {
+		t.Error(err)
+	}
+
+	buf.Reset()
+	err = NewSliceEncoder([]record{}).MarshalSafe(&[]record{{ID: 2}}, buf)
+	if merr, ok := err.(*MarshalError); !ok || merr.Path != "[]jingo.record[0].Bad" || buf.Len() != 0 {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// the element which panicked is found among others which don't
+	type maybe struct {
+		ID  int      `json:"id"`
+		Bad *panicky `json:"bad,stringer"`
+	}
+	recs := []*maybe{{ID: 1}, nil, {ID: 3}, {ID: 4, Bad: &panicky{}}}
+	err = NewSliceEncoder([]*maybe{}).MarshalSafe(&recs, buf)
+	if merr, ok := err.(*MarshalError); !ok || merr.Path != "[]*jingo.maybe[3].Bad" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	type corrupt int
+	RegisterTypeEncoder(reflect.TypeOf(corrupt(0)), func(v unsafe.Pointer, w *Buffer) {
+		if *(*corrupt)(v) < 0 {
+			panic("corrupt value")
+		}
+		w.WriteString("0")
+	})
+	vals := []corrupt{0, 0, -1}
+	err = NewSliceEncoder([]corrupt{}).MarshalSafe(&vals, buf)
+	if merr, ok := err.(*MarshalError); !ok || merr.Path != "[]jingo.corrupt[2]" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func Test_MarshalChecked(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	if err := enc.MarshalChecked(largePayload, buf); err != nil {
+		t.Error(err)
+	}
+	if err := enc.MarshalChecked(*largePayload, buf); err != nil {
+		t.Error(err)
+	}
+
+	n := buf.Len()
+	if err := enc.MarshalChecked(&DSUser{}, buf); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("want ErrTypeMismatch got %v", err)
+	}
+	if err := NewStructEncoderWithConfig(LargePayload{}, Config{Newline: true}).MarshalChecked(DSUser{}, buf); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("want ErrTypeMismatch got %v", err)
+	}
+
+	senc := NewSliceEncoder([]int{})
+	if err := senc.MarshalChecked(&[]int{1}, buf); err != nil {
+		t.Error(err)
+	}
+	if err := senc.MarshalChecked([]int{1}, buf); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("want ErrTypeMismatch got %v", err)
+	}
+	if err := senc.MarshalChecked(&[]int64{1}, buf); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("want ErrTypeMismatch got %v", err)
+	}
+
+	if buf.Len() != n+len("[1]") {
+		t.Errorf("mismatched values were written: %s", buf.Bytes[n:])
+	}
+
+	// a struct holding a single pointer is stored in the interface itself
+	x := 7
+	for _, v := range []interface{}{onePtr{P: &x}, &onePtr{P: &x}, onePtr{}} {
+		buf.Reset()
+		if err := NewStructEncoder(onePtr{}).MarshalChecked(v, buf); err != nil {
+			t.Error(err)
+		}
+		want := `{"p":7}`
+		if v == (onePtr{}) {
+			want = `{"p":null}`
+		}
+		if buf.String() != want {
+			t.Errorf("want %s got %s", want, buf.Bytes)
+		}
+	}
+}
+
+func Test_Registry(t *testing.T) {
+
+	var r Registry
+	r.Register("SmallV1", NewStructEncoder(SmallPayload{}))
+	r.Register("Large", NewStructEncoder(LargePayload{}))
+	r.Register("Ints", NewSliceEncoder([]int{}))
+	r.Register("Fails", failingEncoder{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	NewStructEncoder(SmallPayload{}).Marshal(smallPayload, want)
+
+	if err := r.Marshal("SmallV1", smallPayload, buf); err != nil || buf.String() != want.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s %v", want.Bytes, buf.Bytes, err)
+	}
+
+	buf.Reset()
+	if err := r.Marshal("Ints", &[]int{1, 2}, buf); err != nil || buf.String() != "[1,2]" {
+		t.Errorf("want [1,2] got %s %v", buf.Bytes, err)
+	}
+
+	x := 7
+	r.Register("OnePtr", NewStructEncoder(onePtr{}))
+	buf.Reset()
+	if err := r.Marshal("OnePtr", onePtr{P: &x}, buf); err != nil || buf.String() != `{"p":7}` {
+		t.Errorf(`want {"p":7} got %s %v`, buf.Bytes, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		v    interface{}
+		err  error
+	}{
+		{"Large", smallPayload, ErrTypeMismatch},
+		{"Ints", &[]string{}, ErrTypeMismatch},
+		{"OrderV2", smallPayload, ErrUnregistered},
+		{"Fails", smallPayload, errBroken},
+	} {
+		buf.Reset()
+		if err := r.Marshal(tc.name, tc.v, buf); !errors.Is(err, tc.err) {
+			t.Errorf("%s: want %v got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// registering again replaces the encoder
+	r.Register("SmallV1", NewSliceEncoder([]int{}))
+	if enc, ok := r.Encoder("SmallV1"); !ok || enc == nil {
+		t.Error("expected an encoder for SmallV1")
+	} else if _, ok := enc.(*SliceEncoder); !ok {
+		t.Errorf("want *SliceEncoder got %T", enc)
+	}
+}
+
+func Test_MarshalNilPointer(t *testing.T) {
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	NewStructEncoder(LargePayload{}).Marshal((*LargePayload)(nil), buf)
+	buf.WriteByte(',')
+	NewSliceEncoder([]int{}).Marshal((*[]int)(nil), buf)
+	buf.WriteByte(',')
+	NewStructEncoder(LargePayload{}).MarshalSafe((*LargePayload)(nil), buf)
+
+	if want := "null,null,null"; buf.String() != want {
+		t.Errorf("want %s got %s", want, buf.String())
+	}
+}
+
+func Test_MarshalContext(t *testing.T) {
+
+	enc := NewSliceEncoder([]int{})
+	big := make([]int, 1<<20)
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	if err := enc.MarshalContext(context.Background(), &big, buf); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Len()
+
+	// cancel part way through, from the first check of the context
+	buf.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	cctx := cancelAfter{ctx, func() {
+		if calls++; calls == 2 {
+			cancel()
+		}
+	}}
+	if err := enc.MarshalContext(cctx, &big, buf); err != context.Canceled {
+		t.Fatalf("want context.Canceled got %v", err)
+	}
+	if buf.Len() >= full || buf.Len() > 2*ctxChunk {
+		t.Errorf("encoding carried on after cancellation, wrote %d of %d bytes", buf.Len(), full)
+	}
+	if buf.Err() != context.Canceled || buf.ctx != nil {
+		t.Errorf("want context.Canceled from Err got %v", buf.Err())
+	}
+
+	buf.Reset()
+	if err := MarshalContext(ctx, &big, buf); err != context.Canceled || buf.Len() != 0 {
+		t.Errorf("want context.Canceled before writing got %v", err)
+	}
+}
+
+// cancelAfter calls fn each time its Err is checked
+type cancelAfter struct {
+	context.Context
+	fn func()
+}
+
+func (c cancelAfter) Err() error {
+	c.fn()
+	return c.Context.Err()
+}
+
+func Test_WithConfig(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+	pretty := enc.WithConfig(Config{Indent: "  "})
+	ndjson := pretty.WithConfig(Config{Newline: true})
+
+	if pretty.base != enc || ndjson.base != enc || ndjson.WithConfig(Config{}) != enc {
+		t.Error("variants don't share the compiled encoder")
+	}
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+	want.WriteByte('\n')
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	ndjson.Marshal(largePayload, buf)
+
+	if !bytes.Equal(want.Bytes, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, buf.Bytes)
+	}
+
+	senc := NewSliceEncoder([]int{})
+	if senc.WithConfig(Config{Suffix: ","}).WithConfig(Config{}) != senc {
+		t.Error("variants don't share the compiled encoder")
+	}
+
+	// failures while indenting reach the caller's buffer rather than leaving a broken document
+	type texts struct {
+		T marshalText `json:"t,text"`
+	}
+	buf.Reset()
+	NewStructEncoderWithConfig(texts{}, Config{Indent: "  "}).Marshal(&texts{"bad"}, buf)
+	if buf.Err() == nil || buf.Len() != 0 {
+		t.Errorf("want the text error and nothing written, got %v %q", buf.Err(), buf.Bytes)
+	}
+
+	buf.Reset()
+	buf.SetLimit(64)
+	defer buf.SetLimit(0)
+	pretty.Marshal(largePayload, buf)
+	if buf.Err() != ErrBufferLimit {
+		t.Errorf("want ErrBufferLimit got %v", buf.Err())
+	}
+}
+
+func Test_ConfigEscaping(t *testing.T) {
+
+	type inner struct {
+		Note string `json:"note,escape"`
+	}
+	type doc struct {
+		Text  string         `json:"text,escape"`
+		Plain string         `json:"plain"`
+		Tags  []EscapeString `json:"tags"`
+		In    *inner         `json:"in"`
+	}
+	d := doc{Text: "<b>é</b>", Plain: "é", Tags: []EscapeString{"a&b"}, In: &inner{"\u2028"}}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(doc{})
+	for _, tc := range []struct {
+		c    Config
+		want string
+	}{
+		{Config{}, `{"text":"<b>é</b>","plain":"é","tags":["a&b"],"in":{"note":"` + "\u2028" + `"}}`},
+		{Config{EscapeHTML: true}, `{"text":"\u003cb\u003eé\u003c/b\u003e","plain":"é","tags":["a\u0026b"],"in":{"note":"\u2028"}}`},
+		{Config{ASCII: true}, `{"text":"<b>\u00e9</b>","plain":"é","tags":["a&b"],"in":{"note":"\u2028"}}`},
+		{Config{EscapeHTML: true, ASCII: true, Newline: true}, `{"text":"\u003cb\u003e\u00e9\u003c/b\u003e","plain":"é","tags":["a\u0026b"],"in":{"note":"\u2028"}}` + "\n"},
+	} {
+		buf.Reset()
+		enc.WithConfig(tc.c).Marshal(&d, buf)
+		if buf.String() != tc.want {
+			t.Errorf("%+v\nwant:\n%s\ngot:\n%s", tc.c, tc.want, buf.Bytes)
+		}
+
+		buf.Reset()
+		enc.MarshalWithConfig(&d, buf, tc.c)
+		if buf.String() != tc.want {
+			t.Errorf("MarshalWithConfig %+v\nwant:\n%s\ngot:\n%s", tc.c, tc.want, buf.Bytes)
+		}
+	}
+
+	// the default table is back once the options are dropped
+	if e := enc.WithConfig(Config{ASCII: true}).WithConfig(Config{}); e.esc != 0 || e.base != nil {
+		t.Errorf("want an encoder without escaping options got mode %d", e.esc)
+	}
+
+	buf.Reset()
+	NewSliceEncoderWithConfig([]EscapeString{}, Config{EscapeHTML: true}).Marshal(&[]EscapeString{"<"}, buf)
+	if want := `["\u003c"]`; buf.String() != want {
+		t.Errorf("want %s got %s", want, buf.Bytes)
+	}
+}
+
+func Test_MarshalVersion(t *testing.T) {
+
+	type account struct {
+		ID     int    `json:"id"`
+		Login  string `json:"login,until=1"`
+		Handle string `json:"handle,since=2"`
+		Beta   bool   `json:"beta,since=1,until=2"`
+	}
+	type page struct {
+		Items []account `json:"items"`
+		Owner *account  `json:"owner"`
+	}
+
+	a := account{ID: 1, Login: "l", Handle: "h", Beta: true}
+	p := page{Items: []account{a}, Owner: &a}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(page{})
+	for version, want := range []string{
+		`{"items":[{"id":1,"login":"l"}],"owner":{"id":1,"login":"l"}}`,
+		`{"items":[{"id":1,"login":"l","beta":true}],"owner":{"id":1,"login":"l","beta":true}}`,
+		`{"items":[{"id":1,"handle":"h","beta":true}],"owner":{"id":1,"handle":"h","beta":true}}`,
+		`{"items":[{"id":1,"handle":"h"}],"owner":{"id":1,"handle":"h"}}`,
+	} {
+		buf.Reset()
+		enc.MarshalVersion(&p, buf, version)
+		if buf.String() != want {
+			t.Errorf("version %d\nwant:\n%s\ngot:\n%s", version, want, buf.String())
+		}
+	}
+
+	// Marshal writes every field
+	buf.Reset()
+	NewStructEncoder(account{}).Marshal(&a, buf)
+	NewStructEncoderWithConfig(account{}, Config{Newline: true}).MarshalVersion(&a, buf, 3)
+	NewSliceEncoder([]account{}).MarshalVersion(&p.Items, buf, 0)
+	if want := `{"id":1,"login":"l","handle":"h","beta":true}{"id":1,"handle":"h"}` + "\n" + `[{"id":1,"login":"l"}]`; buf.String() != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func Test_MarshalMasked(t *testing.T) {
+
+	type node struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+		Tag  string `json:"tag"`
+		Next *node  `json:"next"`
+	}
+
+	v := node{ID: 1, Name: "a", Tag: "t", Next: &node{ID: 2, Name: "b"}}
+	enc := NewStructEncoder(node{})
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	for _, tc := range []struct {
+		keys []string
+		want string
+	}{
+		{[]string{"id", "name"}, `{"id":1,"name":"a"}`},
+		{[]string{"name", "tag", "nope"}, `{"name":"a","tag":"t"}`},
+		{[]string{"next"}, `{"next":{"id":2,"name":"b","tag":"","next":null}}`},
+		{nil, `{}`},
+	} {
+		buf.Reset()
+		enc.MarshalMasked(&v, buf, enc.CompileMask(tc.keys...))
+		if buf.String() != tc.want {
+			t.Errorf("%v\nwant:\n%s\ngot:\n%s", tc.keys, tc.want, buf.String())
+		}
+	}
+}
+
+func Test_StructDecoder(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+	type doc struct {
+		S     string    `json:"s"`
+		B     bool      `json:"b"`
+		I     int       `json:"i"`
+		I8    int8      `json:"i8"`
+		U16   uint16    `json:"u16"`
+		F32   float32   `json:"f32"`
+		F64   float64   `json:"f64"`
+		T     time.Time `json:"t"`
+		In    inner     `json:"in"`
+		PIn   *inner    `json:"pin"`
+		PS    *string   `json:"ps"`
+		Next  *doc      `json:"next"`
+		NoTag string
+		Nil   *inner     `json:"nil"`
+		Arr   [2]int     `json:"arr"`
+		TP    *time.Time `json:"tp"`
+	}
+
+	in := []byte(` {"s":"a\"b\\c\n\u00e9\ud83d\ude00", "unknown":{"x":[1,{"y":null}],"z":"}"}, "b":true,"i":-42,"i8":127,"u16":65535,
+		"f32":1.5,"f64":-2.5e3,"t":"2020-01-02T03:04:05.123Z","in":{"name":"x"},"pin":{"name":"y"},"ps":"p",
+		"next":{"i":1,"next":null},"NoTag":"ignored","nil":null,"tp":null,"arr":[1,2,3]} `)
+
+	var got doc
+	got.Nil = &inner{}
+	if err := NewStructDecoder(doc{}).Unmarshal(in, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	p := "p"
+	want := doc{S: "a\"b\\c\né😀", B: true, I: -42, I8: 127, U16: 65535, F32: 1.5, F64: -2500,
+		T: time.Date(2020, 1, 2, 3, 4, 5, 123e6, time.UTC), In: inner{"x"}, PIn: &inner{"y"}, PS: &p,
+		Next: &doc{I: 1}, Arr: [2]int{1, 2}}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("\nwant:\n%+v\ngot:\n%+v", want, got)
+	}
+
+	for _, bad := range []string{
+		``,
+		`[]`,
+		`{"s":1}`,
+		`{"i":"1"}`,
+		`{"i8":128}`,
+		`{"u16":-1}`,
+		`{"s":"unterminated}`,
+		`{"s":"\x"}`,
+		`{"b":tru}`,
+		`{"in":{"name":"x"}`,
+		`{"s":"a"} x`,
+		`{"s" "a"}`,
+		`{"t":"yesterday"}`,
+		`{"unknown":1-+e}`,
+		`{"unknown":[01]}`,
+		`{"unknown":{"x":.5}}`,
+	} {
+		var d doc
+		err := NewStructDecoder(doc{}).Unmarshal([]byte(bad), &d)
+		if _, ok := err.(*DecodeError); !ok {
+			t.Errorf("%s: want *DecodeError got %v", bad, err)
+		}
+	}
+
+	func() {
+		defer func() {
+			if _, ok := recover().(compileError); !ok {
+				t.Error("want a compileError for an unsupported field type")
+			}
+		}()
+		NewStructDecoder(struct {
+			C chan int `json:"c"`
+		}{})
+	}()
+
+	for _, dst := range []interface{}{doc{}, &inner{}, (*doc)(nil), nil, onePtr{}} {
+		err := NewStructDecoder(doc{}).Unmarshal([]byte(`{"s":"a"}`), dst)
+		if _, ok := err.(*InvalidUnmarshalError); !ok {
+			t.Errorf("%T: want *InvalidUnmarshalError got %v", dst, err)
+		}
+	}
+}
+
+func Test_SliceDecoder(t *testing.T) {
+
+	dec := NewSliceDecoder([]int{})
+
+	for _, dst := range []interface{}{[]int{}, &[]int64{}, (*[]int)(nil), nil} {
+		if _, ok := dec.Unmarshal([]byte(`[1]`), dst).(*InvalidUnmarshalError); !ok {
+			t.Errorf("%T: want *InvalidUnmarshalError", dst)
+		}
+	}
+
+	var ints []int
+	if err := dec.Unmarshal([]byte(`[1, 2,3 ,4,5]`), &ints); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ints, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("got %v", ints)
+	}
+
+	// capacity is reused when there's enough of it
+	data := &ints[0]
+	if err := dec.Unmarshal([]byte(`[7,8]`), &ints); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ints, []int{7, 8}) || &ints[0] != data {
+		t.Errorf("got %v", ints)
+	}
+
+	if err := dec.Unmarshal([]byte(`[]`), &ints); err != nil || ints == nil || len(ints) != 0 {
+		t.Errorf("want empty slice got %v %v", ints, err)
+	}
+	if err := dec.Unmarshal([]byte(`null`), &ints); err != nil || ints != nil {
+		t.Errorf("want nil slice got %v %v", ints, err)
+	}
+	if err := dec.Unmarshal([]byte(`[1,"2"]`), &ints); err == nil {
+		t.Error("want error decoding a string into an int")
+	}
+
+	// reused struct elements don't keep stale fields
+	type node struct {
+		ID       int       `json:"id"`
+		Name     string    `json:"name"`
+		Children []node    `json:"children"`
+		Tags     []*string `json:"tags"`
+	}
+	nodes := []node{{ID: 9, Name: "stale"}}
+	in := `[{"id":1,"children":[{"id":2,"children":[]}],"tags":["a",null]}]`
+	if err := NewSliceDecoder([]node{}).Unmarshal([]byte(in), &nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	a := "a"
+	want := []node{{ID: 1, Children: []node{{ID: 2, Children: []node{}}}, Tags: []*string{&a, nil}}}
+	if !reflect.DeepEqual(want, nodes) {
+		t.Errorf("\nwant:\n%+v\ngot:\n%+v", want, nodes)
+	}
+
+	// round trip through the encoder
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(LargePayload{}).Marshal(largePayload, buf)
+
+	var again LargePayload
+	if err := NewStructDecoder(LargePayload{}).Unmarshal(buf.Bytes, &again); err != nil || !reflect.DeepEqual(largePayload, &again) {
+		t.Errorf("round trip of %s gave %+v %v", buf.Bytes, again, err)
+	}
+}
+
+func Test_Codec(t *testing.T) {
+
+	// the shape of gRPC's encoding.Codec
+	var c interface {
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+		Name() string
+	} = Codec{}
+
+	b, err := c.Marshal(largePayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got LargePayload
+	if err := c.Unmarshal(b, &got); err != nil || !reflect.DeepEqual(largePayload, &got) {
+		t.Errorf("round trip of %s gave %+v %v", b, got, err)
+	}
+
+	var ints []int
+	if err := c.Unmarshal([]byte(`[1,2,3]`), &ints); err != nil || !reflect.DeepEqual(ints, []int{1, 2, 3}) {
+		t.Errorf("want [1 2 3] got %v %v", ints, err)
+	}
+
+	type withMap struct {
+		M map[string]int `json:"m"`
+	}
+	var i int
+	for _, v := range []interface{}{nil, got, &i, &withMap{}} {
+		if err := c.Unmarshal([]byte(`{}`), v); !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("%T: want ErrUnsupportedType got %v", v, err)
+		}
+	}
+	if _, err := c.Marshal(&i); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("want ErrUnsupportedType got %v", err)
+	}
+
+	if c.Name() != "json" {
+		t.Errorf("want json got %s", c.Name())
+	}
+}
+
+func Test_DecoderIntern(t *testing.T) {
+
+	type event struct {
+		Status string   `json:"status,intern"`
+		Codes  []string `json:"codes,intern"`
+		Note   string   `json:"note"`
+	}
+
+	dec := NewStructDecoder(event{})
+	in := []byte(`{"status":"interned-ok","codes":["interned-a","interned-ok"],"note":"copied"}`)
+
+	var a, b event
+	if err := dec.Unmarshal(in, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Unmarshal(in, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := event{Status: "interned-ok", Codes: []string{"interned-a", "interned-ok"}, Note: "copied"}
+	if !reflect.DeepEqual(want, a) || !reflect.DeepEqual(want, b) {
+		t.Fatalf("\nwant:\n%+v\ngot:\n%+v\n%+v", want, a, b)
+	}
+
+	if stringData(a.Status) != stringData(b.Status) || stringData(a.Status) != stringData(b.Codes[1]) {
+		t.Error("interned strings don't share memory")
+	}
+	if stringData(a.Note) == stringData(b.Note) {
+		t.Error("want strings without the intern option copied")
+	}
+}
+
+// stringData returns the address of the bytes of s
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func Test_TokenReader(t *testing.T) {
+
+	in := ` {"a": [1, -2.5e3, "x\u00e9y", true, false, null], "b": {}, "c": [], "d": {"e": "\ud83d\ude00"}} [0]`
+	want := "{ key:a [ number:1 number:-2.5e3 string:xéy true false null ] key:b { } key:c [ ] key:d { key:e string:😀 } } [ number:0 ] "
+
+	read := func(r *TokenReader) (string, error) {
+		var sb strings.Builder
+		for {
+			tok, err := r.Next()
+			if err == io.EOF {
+				return sb.String(), nil
+			}
+			if err != nil {
+				return sb.String(), err
+			}
+			sb.WriteString(tok.Kind.String())
+			if tok.Value != nil {
+				sb.WriteString(":" + string(tok.Value))
+			}
+			sb.WriteByte(' ')
+		}
+	}
+
+	if got, err := read(NewTokenReader([]byte(in))); err != nil || got != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s %v", want, got, err)
+	}
+
+	// a byte at a time, so every token straddles a read
+	if got, err := read(NewTokenReaderFrom(iotest.OneByteReader(strings.NewReader(in)))); err != nil || got != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s %v", want, got, err)
+	}
+
+	for _, bad := range []string{`{"a" 1}`, `[1,]`, `{"a":1,}`, `[1 2]`, `{1:2}`, `[`, `{"a":`, `]`, `[nul]`} {
+		if _, err := read(NewTokenReader([]byte(bad))); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+		if _, err := read(NewTokenReaderFrom(strings.NewReader(bad))); err == nil {
+			t.Errorf("%s: want error from reader", bad)
+		}
+	}
+
+	// skip past values we're not interested in
+	r := NewTokenReader([]byte(`{"skip": {"x": [1, {"y": 2}]}, "keep": 3}`))
+	r.Next()
+	r.Next()
+	if err := r.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	if tok, _ := r.Next(); string(tok.Value) != "keep" {
+		t.Errorf("want key keep got %s %s", tok.Kind, tok.Value)
+	}
+}
+
+func Test_Valid(t *testing.T) {
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(LargePayload{}).Marshal(largePayload, buf)
+
+	for _, in := range []string{
+		buf.String(),
+		` {"a": [1, -0.5, 2e10, 1E-2, "\u00e9\n", true, false, null], "b": {}} `,
+		`0`, `-0`, `""`, `[]`, `{}`, `[[[]]]`,
+		``, ` `, `{`, `}`, `[1,]`, `{"a":1,}`, `{"a" 1}`, `{a:1}`, `[1 2]`, `01`, `1.`, `.5`, `-`, `1e`, `1e+`,
+		`+1`, `tru`, `nul`, `"\x"`, `"\u12"`, `"\u12g4"`, "\"\x01\"", `"abc`, `[] []`, `{"a":1}}`, `NaN`,
+		strings.Repeat("[", maxDepth) + strings.Repeat("]", maxDepth),
+		strings.Repeat("[", maxDepth+1) + strings.Repeat("]", maxDepth+1),
+	} {
+		if got, want := Valid([]byte(in)), json.Valid([]byte(in)); got != want {
+			t.Errorf("%.40q: want %v got %v", in, want, got)
+		}
+	}
+
+	if n := testing.AllocsPerRun(10, func() { Valid(buf.Bytes) }); n != 0 {
+		t.Errorf("want no allocations, got %v", n)
+	}
+}
+
+func BenchmarkValid(b *testing.B) {
+
+	buf := NewBufferFromPool()
+	NewStructEncoder(LargePayload{}).Marshal(largePayload, buf)
+
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Valid(buf.Bytes)
+	}
+}
+
+func BenchmarkValidStdlib(b *testing.B) {
+
+	buf := NewBufferFromPool()
+	NewStructEncoder(LargePayload{}).Marshal(largePayload, buf)
+
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Valid(buf.Bytes)
+	}
+}
+
+func Test_Compact(t *testing.T) {
+
+	for _, in := range []string{
+		"{\n  \"a b\": [1, 2, \"x \\\" y\\\\\"],\n\t\"c\" : { }\r\n}",
+		`[]`,
+		`  1  `,
+		``,
+	} {
+		var want bytes.Buffer
+		json.Compact(&want, []byte(in))
+
+		buf := NewBufferFromPool()
+		Compact(buf, []byte(in))
+		if buf.String() != want.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want.String(), buf.String())
+		}
+		buf.ReturnToPool()
+	}
+}
+
+func Test_Indent(t *testing.T) {
+
+	for _, in := range []string{
+		string(mustMarshalBytes(t, largePayload)),
+		`{"a b":[1,2,"x \" y\\"],"c":{},"d":[],"e":[{}]}`,
+		` { "a" : 1 } `,
+	} {
+		var want bytes.Buffer
+		json.Indent(&want, []byte(strings.TrimSpace(in)), "> ", "\t")
+
+		buf := NewBufferFromPool()
+		Indent(buf, []byte(in), "> ", "\t")
+		if buf.String() != want.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want.String(), buf.String())
+		}
+		buf.ReturnToPool()
+	}
+}
+
+func Test_IndentColor(t *testing.T) {
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	IndentColor(buf, []byte(`{"a":[1,"x",true,null],"b":{"c":-2.5e3},"d":[]}`), "", " ")
+	want := "{\n \x1b[34m\"a\"\x1b[0m: [\n  \x1b[36m1\x1b[0m,\n  \x1b[32m\"x\"\x1b[0m,\n  \x1b[33mtrue\x1b[0m,\n  \x1b[90mnull\x1b[0m\n ],\n" +
+		" \x1b[34m\"b\"\x1b[0m: {\n  \x1b[34m\"c\"\x1b[0m: \x1b[36m-2.5e3\x1b[0m\n },\n \x1b[34m\"d\"\x1b[0m: []\n}"
+	if buf.String() != want {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, buf.String())
+	}
+
+	// without the escapes it's the same as Indent
+	buf.Reset()
+	IndentColor(buf, mustMarshalBytes(t, largePayload), "> ", "\t")
+	plain := NewBufferFromPool()
+	defer plain.ReturnToPool()
+	Indent(plain, mustMarshalBytes(t, largePayload), "> ", "\t")
+
+	if got := regexp.MustCompile("\x1b\\[[0-9]+m").ReplaceAllString(buf.String(), ""); got != plain.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", plain.String(), got)
+	}
+
+	buf.Reset()
+	IndentColor(buf, []byte(`7`), "", " ")
+	if buf.String() != "\x1b[36m7\x1b[0m" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func Test_Get(t *testing.T) {
+
+	doc := []byte(`{"a": {"skip": [1, {"x": "}"}], "b": [10, {"c": "d"}, [true, null]]}, "e\"f": 1.5, "g": {}}`)
+
+	for path, want := range map[string]string{
+		"":          string(doc),
+		"a.b[0]":    "10",
+		"a.b[1]":    `{"c": "d"}`,
+		"a.b[1].c":  `"d"`,
+		"a.b[2][1]": "null",
+		`e"f`:       "1.5",
+		"g":         "{}",
+	} {
+		got, err := Get(doc, path)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: want %s got %s %v", path, want, got, err)
+		}
+	}
+
+	for _, path := range []string{"x", "a.b[3]", "a.b[0].c", "a[0]", "g.x", "a.b[1].c.d"} {
+		if _, err := Get(doc, path); !errors.Is(err, ErrPathNotFound) {
+			t.Errorf("%s: want ErrPathNotFound got %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"a.b[", "a.b[x]", "a.b[-1]"} {
+		if _, err := Get(doc, path); err == nil || errors.Is(err, ErrPathNotFound) {
+			t.Errorf("%s: want invalid path got %v", path, err)
+		}
+	}
+
+	if _, err := Get([]byte(`{"a": [1 2], "b": 1}`), "b"); err == nil {
+		t.Error("want error for an invalid document")
+	}
+}
+
+func Test_MarshalPatch(t *testing.T) {
+
+	type address struct {
+		Street string `json:"street"`
+		Town   string `json:"town"`
+	}
+	type person struct {
+		Name  string   `json:"name"`
+		Age   int      `json:"age"`
+		Home  address  `json:"home"`
+		Work  *address `json:"work"`
+		Tags  []string `json:"a/b~c"`
+		Notes string
+	}
+
+	enc := NewStructEncoder(person{})
+	from := person{Name: "a", Age: 1, Home: address{"x", "y"}, Tags: []string{"p"}}
+	to := person{Name: "a", Age: 2, Home: address{"x", "z"}, Work: &address{Street: "w"}, Tags: []string{"p", "q"}, Notes: "ignored"}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc.MarshalPatch(&from, &to, buf)
+	want := `[{"op":"replace","path":"/age","value":2},{"op":"replace","path":"/home/town","value":"z"},` +
+		`{"op":"replace","path":"/work","value":{"street":"w","town":""}},{"op":"replace","path":"/a~1b~0c","value":["p","q"]}]`
+	if string(buf.Bytes) != want {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	buf.Reset()
+	enc.MarshalPatch(&to, &to, buf)
+	if string(buf.Bytes) != "[]" {
+		t.Errorf("want an empty patch got %s", buf.Bytes)
+	}
+
+	buf.Reset()
+	enc.MarshalPatch((*person)(nil), &from, buf)
+	if !strings.HasPrefix(string(buf.Bytes), `[{"op":"replace","path":"","value":{"name":"a"`) || buf.Err() != nil {
+		t.Errorf("want the whole document replaced got %s %v", buf.Bytes, buf.Err())
+	}
+
+	buf.Reset()
+	enc.MarshalPatch(&from, (*person)(nil), buf)
+	if want := `[{"op":"replace","path":"","value":null}]`; buf.String() != want {
+		t.Errorf("want %s got %s", want, buf.Bytes)
+	}
+
+	// only the fields which differ are encoded
+	type counted struct {
+		Same  tally `json:"same,stringer"`
+		Other tally `json:"other,stringer"`
+	}
+	tallies := 0
+	cenc := NewStructEncoder(counted{})
+	buf.Reset()
+	cenc.MarshalPatch(&counted{tally{&tallies}, tally{}}, &counted{tally{&tallies}, tally{&tallies}}, buf)
+	if want := `[{"op":"replace","path":"/other","value":"1"}]`; buf.String() != want || tallies != 1 {
+		t.Errorf("want %s from 1 call got %s from %d", want, buf.Bytes, tallies)
+	}
+
+	// errors writing a field abandon the patch
+	type broken struct {
+		B failingField `json:"b,encoder"`
+	}
+	benc := NewStructEncoder(broken{})
+	buf.Reset()
+	benc.MarshalPatch(&broken{}, &broken{1}, buf)
+	if buf.Err() != errBroken {
+		t.Errorf("want %v got %v", errBroken, buf.Err())
+	}
+	buf.Reset()
+	benc.MarshalMergePatch(nil, &broken{1}, buf)
+	if buf.Err() != errBroken {
+		t.Errorf("want %v got %v", errBroken, buf.Err())
+	}
+}
+
+// tally counts its calls to String, and writes the count so far
+type tally struct{ n *int }
+
+func (t tally) String() string {
+	if t.n == nil {
+		return ""
+	}
+	*t.n++
+	return strconv.Itoa(*t.n)
+}
+
+type failingField int
+
+func (f *failingField) JSONEncode(w *Buffer) { w.fail(errBroken) }
+
+func Test_MarshalMergePatch(t *testing.T) {
+
+	type address struct {
+		Street string `json:"street"`
+		Town   string `json:"town"`
+	}
+	type person struct {
+		Name string   `json:"name"`
+		Age  int      `json:"age"`
+		Home address  `json:"home"`
+		Work *address `json:"work"`
+		Tags []string `json:"tags"`
+	}
+
+	enc := NewStructEncoder(person{})
+	base := person{Name: "a", Age: 1, Home: address{"x", "y"}, Work: &address{}, Tags: []string{"p"}}
+	v := person{Name: "a", Age: 2, Home: address{"x", "z"}, Tags: []string{"p", "q"}}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	for _, tt := range []struct {
+		base, v interface{}
+		want    string
+	}{
+		{&base, &v, `{"age":2,"home":{"town":"z"},"work":null,"tags":["p","q"]}`},
+		{&v, &v, `{}`},
+		{nil, &person{Name: "n", Home: address{Town: "t"}}, `{"name":"n","home":{"town":"t"}}`},
+		{&base, (*person)(nil), `null`},
+	} {
+		buf.Reset()
+		enc.MarshalMergePatch(tt.base, tt.v, buf)
+		if string(buf.Bytes) != tt.want || buf.Err() != nil {
+			t.Errorf("\nwant:\n%s\ngot:\n%s %v", tt.want, buf.Bytes, buf.Err())
+		}
+	}
+}
+
+func Test_MarshalCBOR(t *testing.T) {
+
+	type doc struct {
+		Name  string   `json:"name"`
+		Count int      `json:"n"`
+		Neg   int      `json:"neg"`
+		Big   uint64   `json:"big"`
+		Ratio float64  `json:"r"`
+		OK    bool     `json:"ok"`
+		Ptr   *string  `json:"p"`
+		Tags  []string `json:"tags"`
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	v := doc{Name: "é", Count: 500, Neg: -25, Big: 1 << 40, Ratio: 1.5, OK: true, Tags: []string{}}
+	if err := MarshalCBOR(NewStructEncoder(doc{}), &v, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0xbf,
+		0x64, 'n', 'a', 'm', 'e', 0x62, 0xc3, 0xa9,
+		0x61, 'n', 0x19, 0x01, 0xf4,
+		0x63, 'n', 'e', 'g', 0x38, 24,
+		0x63, 'b', 'i', 'g', 0x1b, 0, 0, 1, 0, 0, 0, 0, 0,
+		0x61, 'r', 0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0x62, 'o', 'k', 0xf5,
+		0x61, 'p', 0xf6,
+		0x64, 't', 'a', 'g', 's', 0x9f, 0xff,
+		0xff}
+	if !bytes.Equal(want, buf.Bytes) {
+		t.Errorf("\nwant: %x\ngot:  %x", want, buf.Bytes)
+	}
+
+	buf.Reset()
+	if err := ToCBOR(buf, []byte(`[-0, "a\u0041", {}]`)); err != nil || !bytes.Equal(buf.Bytes, []byte{0x9f, 0xfb, 0x80, 0, 0, 0, 0, 0, 0, 0, 0x62, 'a', 'A', 0xbf, 0xff, 0xff}) {
+		t.Errorf("got %x %v", buf.Bytes, err)
+	}
+	if err := ToCBOR(buf, []byte(`[1,]`)); err == nil {
+		t.Error("want error for invalid JSON")
+	}
+
+	// the buffer's limit applies, as for JSON
+	buf.Reset()
+	buf.SetLimit(8)
+	if err := ToCBOR(buf, []byte(`["abcdefgh", 70000, 1.5]`)); err != ErrBufferLimit {
+		t.Errorf("want %v got %v", ErrBufferLimit, err)
+	}
+	buf.SetLimit(0)
+	buf.Reset()
+	if err := ToCBOR(buf, []byte(`[70000, 1.5]`)); err != nil || !bytes.Equal(buf.Bytes, []byte{0x9f, 0x1a, 0, 1, 0x11, 0x70, 0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xff}) {
+		t.Errorf("got %x %v", buf.Bytes, err)
+	}
+
+	// it's transcoded, so values the JSON quotes stay text
+	type quoted struct {
+		N  int       `json:"n,string"`
+		At time.Time `json:"at"`
+	}
+	buf.Reset()
+	if err := MarshalCBOR(NewStructEncoder(quoted{}), &quoted{N: 7, At: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}, buf); err != nil {
+		t.Fatal(err)
+	}
+	want = append([]byte{0xbf, 0x61, 'n', 0x61, '7', 0x62, 'a', 't', 0x74}, "2020-01-02T03:04:05Z"...)
+	if want = append(want, 0xff); !bytes.Equal(want, buf.Bytes) {
+		t.Errorf("\nwant: %x\ngot:  %x", want, buf.Bytes)
+	}
+}
+
+func Test_LinesWriter(t *testing.T) {
+
+	type entry struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}
+	enc := NewStructEncoder(entry{})
+
+	var out writeCounter
+	lw := NewLinesWriter(&out, enc)
+	for _, e := range []entry{{"info", "a"}, {"warn", "b"}} {
+		if err := lw.Write(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "{\"level\":\"info\",\"msg\":\"a\"}\n{\"level\":\"warn\",\"msg\":\"b\"}\n"
+	if out.String() != want || out.writes != 2 {
+		t.Errorf("want %q in 2 writes got %q in %d", want, out.String(), out.writes)
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	AppendLine(buf, enc, &entry{"info", "a"})
+	AppendLine(buf, enc, &entry{"warn", "b"})
+	if buf.String() != want {
+		t.Errorf("want %q got %q", want, buf.String())
+	}
+
+	// encoders which end documents with a newline already don't leave blank lines
+	buf.Reset()
+	nl := enc.WithConfig(Config{Newline: true})
+	AppendLine(buf, nl, &entry{"info", "a"})
+	AppendLine(buf, nl, &entry{"warn", "b"})
+	if buf.String() != want {
+		t.Errorf("want %q got %q", want, buf.String())
+	}
+
+	var ints writeCounter
+	if err := NewLinesWriter(&ints, NewSliceEncoder([]int{}).WithConfig(Config{Newline: true})).Write(&[]int{1}); err != nil || ints.String() != "[1]\n" {
+		t.Errorf("want %q got %q %v", "[1]\n", ints.String(), err)
+	}
+}
+
+func BenchmarkSlice(b *testing.B) {
+
+	ss := []string{
+		"a name",
+		"another name",
+		"another",
+		"and one more",
+		"last one, promise",
+	}
+
+	var enc = NewSliceEncoder([]string{})
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&ss, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func BenchmarkSliceEscape(b *testing.B) {
+
+	ss := []string{
+		"a name",
+		"another name",
+		"another",
+		"and one more",
+		"last one, promise",
+	}
+
+	var enc = NewSliceEncoder([]EscapeString{})
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&ss, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func BenchmarkEscapeLong(b *testing.B) {
+	b.ReportAllocs()
+
+	v := StructWithEscapes{String: strings.Repeat("a long description with \"quotes\" now and then. ", 20)}
+
+	var enc = NewStructEncoder(StructWithEscapes{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&v, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func BenchmarkSliceStdLib(b *testing.B) {
+	ss := []string{
+		"a name",
+		"another name",
+		"another",
+		"and one more",
+		"last one, promise",
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(&ss)
+	}
+}
+
+// var fakeType = SmallPayload{}
+// var fake = NewSmallPayload()
+
+// var fakeType = LargePayload{}
+// var fake = NewLargePayload()
+
+var s = "test pointer string b"
+var fakeType = all{}
+var fake = &all{
+	PropBool:    false,
+	PropInt:     1234567878910111212,
+	PropInt8:    123,
+	PropInt16:   12349,
+	PropInt32:   1234567891,
+	PropInt64:   1234567878910111213,
+	PropUint:    12345678789101112138,
+	PropUint8:   255,
+	PropUint16:  12345,
+	PropUint32:  1234567891,
+	PropUint64:  12345678789101112139,
+	PropFloat32: 21.232426,
+	PropFloat64: 2799999999888.28293031999999,
+	PropString:  "thirty two thirty four",
+	PropStruct: struct {
+		PropNames        []string  `json:"propName"`
+		PropPs           []*string `json:"ps"`
+		PropNamesEscaped []string  `json:"propNameEscaped,escape"`
+	}{
+		PropNames:        []string{"a name", "another name", "another"},
+		PropPs:           []*string{&s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s, nil, &s},
+		PropNamesEscaped: []string{"one\\two\\,three\"", "\"four\\five\\,six\""},
+	},
+}
+
+func BenchmarkJson(b *testing.B) {
+
+	e := NewStructEncoder(fakeType)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		e.Marshal(fake, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func BenchmarkStdJson(b *testing.B) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		by, _ := json.Marshal(fake)
+		_ = by
+	}
+}
+
+//
+//
+//
+
+type SmallPayload struct {
+	St   int    `json:"st"`
+	Sid  int    `json:"sid"`
+	Tt   string `json:"tt"`
+	Gr   int    `json:"gr"`
+	UUID string `json:"uuid"`
+	IP   string `json:"ip"`
+	Ua   string `json:"ua"`
+	Tz   int    `json:"tz"`
+	V    int    `json:"v"`
+}
+
+func NewSmallPayload() *SmallPayload {
+	s := &SmallPayload{
+		St:   1,
+		Sid:  2,
 		Tt:   "TestString",
 		Gr:   4,
 		UUID: "8f9a65eb-4807-4d57-b6e0-bda5d62f1429",
@@ -667,6 +3966,17 @@ func BenchmarkLargePayload(b *testing.B) {
 	}
 }
 
+func BenchmarkMarshalTo(b *testing.B) {
+
+	e := NewStructEncoder(LargePayload{})
+	w := bufio.NewWriterSize(ioutil.Discard, 4096)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MarshalTo(w, e, largePayload)
+	}
+}
+
 func BenchmarkLargePayloadStdLib(b *testing.B) {
 
 	b.ResetTimer()
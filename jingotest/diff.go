@@ -0,0 +1,105 @@
+// Package jingotest provides helpers for testing code which encodes with jingo, for use from the
+// tests of packages adopting it.
+package jingotest
+
+// diff.go compares jingo's output with that of encoding/json. jingo isn't a drop in replacement for
+// the stdlib, see the README, so teams adopting it for a type can use DiffStdlib to check the
+// documents are the same for their data before switching over.
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bet365/jingo"
+)
+
+// DiffStdlib marshals v with both jingo.Marshal and encoding/json, and compares the documents
+// semantically, so key order and formatting are ignored. ok reports whether they're the same, and
+// where they aren't diff describes each difference on its own line, i.e
+//
+//	.items[2].name: jingo "a", stdlib "b"
+func DiffStdlib(v interface{}) (diff string, ok bool) {
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	jingo.Marshal(v, buf)
+	if err := buf.Err(); err != nil {
+		return fmt.Sprintf("jingo: %v", err), false
+	}
+	std, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("stdlib: %v", err), false
+	}
+
+	var a, b interface{}
+	if err := json.Unmarshal(buf.Bytes, &a); err != nil {
+		return fmt.Sprintf("jingo wrote invalid JSON: %v\n%s", err, buf.Bytes), false
+	}
+	if err := json.Unmarshal(std, &b); err != nil {
+		return fmt.Sprintf("stdlib wrote invalid JSON: %v\n%s", err, std), false
+	}
+
+	var w strings.Builder
+	diffValues(&w, "", a, b)
+	return w.String(), w.Len() == 0
+}
+
+// diffValues writes the differences between a, written by jingo, and b, written by the stdlib
+func diffValues(w *strings.Builder, path string, a, b interface{}) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			va, ina := a[k]
+			vb, inb := b[k]
+			switch {
+			case !ina:
+				fmt.Fprintf(w, "%s.%s: missing from jingo, stdlib %s\n", path, k, show(vb))
+			case !inb:
+				fmt.Fprintf(w, "%s.%s: jingo %s, missing from stdlib\n", path, k, show(va))
+			default:
+				diffValues(w, path+"."+k, va, vb)
+			}
+		}
+		return
+
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			break
+		}
+
+		for i := range a {
+			diffValues(w, fmt.Sprintf("%s[%d]", path, i), a[i], b[i])
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		fmt.Fprintf(w, "%s: jingo %s, stdlib %s\n", path, show(a), show(b))
+	}
+}
+
+// show formats a decoded value as JSON for a diff
+func show(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
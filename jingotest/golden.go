@@ -0,0 +1,108 @@
+package jingotest
+
+// golden.go provides the scaffolding for golden file tests of encoded documents, comparing the
+// output of an encoder for a fixture with a file checked in alongside the test. Run the tests with
+// -jingotest.update to write the files afresh after an intended change.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/bet365/jingo"
+)
+
+var update = flag.Bool("jingotest.update", false, "write golden files rather than comparing with them")
+
+// Compile returns an encoder for v, a struct or slice, failing the test if it can't be compiled.
+func Compile(t testing.TB, v interface{}) (enc jingo.Encoder) {
+	t.Helper()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("jingotest: compiling %T: %v", v, r)
+		}
+	}()
+
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Struct:
+		return jingo.NewStructEncoder(v)
+	case reflect.Slice:
+		return jingo.NewSliceEncoder(v)
+	}
+
+	t.Fatalf("jingotest: can't compile an encoder for %T, want a struct or slice", v)
+	return nil
+}
+
+// Marshal returns the document enc writes for v, failing the test if the buffer reports an error.
+func Marshal(t testing.TB, enc jingo.Encoder, v interface{}) []byte {
+	t.Helper()
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc.Marshal(v, buf)
+	if err := buf.Err(); err != nil {
+		t.Fatalf("jingotest: marshaling %T: %v", v, err)
+	}
+
+	out := make([]byte, len(buf.Bytes))
+	copy(out, buf.Bytes)
+	return out
+}
+
+// Normalise returns b re-encoded with its object keys sorted and indented by two spaces, so
+// documents can be compared regardless of key order and diffs of them are readable. Numbers are
+// kept as written.
+func Normalise(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// Golden compares the normalised form of got with the golden file at path, failing the test if
+// they differ. With -jingotest.update the file is written instead.
+func Golden(t testing.TB, path string, got []byte) {
+	t.Helper()
+
+	n, err := Normalise(got)
+	if err != nil {
+		t.Fatalf("jingotest: normalising %s: %v\n%s", path, err, got)
+	}
+
+	if *update {
+		if err := ioutil.WriteFile(path, n, 0644); err != nil {
+			t.Fatalf("jingotest: %v", err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("jingotest: %v, run with -jingotest.update to create it", err)
+	}
+	if !bytes.Equal(want, n) {
+		t.Errorf("jingotest: output doesn't match %s\nwant:\n%sgot:\n%s", path, want, n)
+	}
+}
+
+// MarshalGolden marshals v with enc and compares the document with the golden file at path, see
+// Golden.
+func MarshalGolden(t testing.TB, path string, enc jingo.Encoder, v interface{}) {
+	t.Helper()
+	Golden(t, path, Marshal(t, enc, v))
+}
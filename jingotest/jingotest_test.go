@@ -0,0 +1,59 @@
+package jingotest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_DiffStdlib(t *testing.T) {
+
+	type item struct {
+		Name  string  `json:"name"`
+		Price float64 `json:"price"`
+	}
+	type order struct {
+		ID    int      `json:"id"`
+		Items []item   `json:"items"`
+		Tags  []string `json:"tags"`
+	}
+
+	if diff, ok := DiffStdlib(&order{ID: 1, Items: []item{{"a", 1.5}}, Tags: []string{"x"}}); !ok {
+		t.Errorf("want no differences got\n%s", diff)
+	}
+
+	// fields without a json tag are written by the stdlib but not by jingo
+	type untagged struct {
+		ID   int `json:"id"`
+		Note string
+	}
+	diff, ok := DiffStdlib(&untagged{ID: 1, Note: "n"})
+	if want := ".Note: missing from jingo, stdlib \"n\"\n"; ok || diff != want {
+		t.Errorf("want:\n%sgot:\n%s", want, diff)
+	}
+
+	if diff, ok := DiffStdlib(42); ok || diff == "" {
+		t.Error("want unsupported types reported")
+	}
+}
+
+func Test_Golden(t *testing.T) {
+
+	type item struct {
+		Name  string  `json:"name"`
+		Price float64 `json:"price"`
+	}
+
+	path := filepath.Join(t.TempDir(), "item.golden")
+	if err := ioutil.WriteFile(path, []byte("{\n  \"name\": \"a\",\n  \"price\": 1.5\n}\n"), 0644); err != nil {
+		t.Fatal("write", err)
+	}
+
+	enc := Compile(t, item{})
+	MarshalGolden(t, path, enc, &item{Name: "a", Price: 1.50})
+
+	n, err := Normalise([]byte(`{"z":1,"a":{"y":[2.50],"b":null}}`))
+	if want := "{\n  \"a\": {\n    \"b\": null,\n    \"y\": [\n      2.50\n    ]\n  },\n  \"z\": 1\n}\n"; err != nil || string(n) != want {
+		t.Errorf("want:\n%sgot:\n%s %v", want, n, err)
+	}
+}
@@ -0,0 +1,99 @@
+package jingo
+
+// jsonp.go serves documents as JSONP, wrapping them in a call to a callback function for the legacy
+// clients which load them with a script tag.
+
+import (
+	"errors"
+)
+
+// ErrInvalidCallback is returned by MarshalJSONP for a callback which isn't a JavaScript identifier.
+var ErrInvalidCallback = errors.New("jingo: invalid JSONP callback")
+
+// MarshalJSONP writes v, encoded by enc, into buf wrapped in a call to callback, i.e
+// callback({...});. U+2028 and U+2029, which are valid in JSON strings but end the line in
+// JavaScript, are escaped. The callback usually comes from the request, so to keep it from
+// being used to inject script anything other than a dotted path of identifiers is refused with
+// ErrInvalidCallback, and nothing is written.
+//
+// The document is run as script too, so a *StructEncoder or *SliceEncoder writes every string
+// escaped, plain ones included, as for TemplateFunc, and should enc write anything other than valid
+// JSON nothing is written and ErrInvalidDocument is returned. The document is encoded to scratch
+// space to be checked, which is held to what's left of any limit on buf, before it's written.
+func MarshalJSONP(callback string, enc Encoder, v interface{}, buf *Buffer) error {
+	if !validCallback(callback) {
+		return ErrInvalidCallback
+	}
+	if err := buf.Err(); err != nil {
+		return err
+	}
+
+	doc := scratchFor(buf)
+	defer putScratch(doc)
+
+	scriptEncoder(enc, 0).Marshal(v, doc)
+	if err := doc.Err(); err != nil {
+		buf.fail(err)
+		return err
+	}
+	if !Valid(doc.Bytes) {
+		return ErrInvalidDocument
+	}
+
+	buf.WriteString(callback)
+	buf.WriteByte('(')
+	writeScript(buf, doc.Bytes, false)
+	buf.WriteString(");")
+	buf.ok() // apply any limit, or flush, now the whole thing's written
+
+	return buf.Err()
+}
+
+// validCallback reports whether s is a dotted path of JavaScript identifiers, i.e jQuery123.cb
+func validCallback(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == '$':
+		case c >= '0' && c <= '9':
+			if i == 0 || s[i-1] == '.' {
+				return false
+			}
+		case c == '.':
+			if s[i-1] == '.' {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// writeScript writes the document src to w with U+2028 and U+2029, which are valid in JSON strings
+// but end the line in JavaScript, replaced by their \u escapes, as are <, > and & should html be
+// set. In valid JSON those characters only appear within strings, where the escapes decode to the
+// same text.
+func writeScript(w *Buffer, src []byte, html bool) {
+	last := 0
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case html && (c == '<' || c == '>' || c == '&'):
+			w.Write(src[last:i])
+			w.WriteString(`\u00`)
+			w.WriteByte(hexDigits[c>>4])
+			w.WriteByte(hexDigits[c&0xF])
+			last = i + 1
+		case c == 0xe2 && i+2 < len(src) && src[i+1] == 0x80 && src[i+2]&^1 == 0xa8:
+			w.Write(src[last:i])
+			w.WriteString(`\u202`)
+			w.WriteByte('8' + src[i+2] - 0xa8)
+			i += 2
+			last = i + 1
+		}
+	}
+	w.Write(src[last:])
+}
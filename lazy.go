@@ -0,0 +1,107 @@
+package jingo
+
+// lazy.go supports deferring the compilation of nested encoders until they're first used. By
+// default NewStructEncoder compiles the whole type graph up-front, which for large models can
+// take noticeable time at startup. With lazy compilation on each nested struct or slice encoder
+// is compiled on the first Marshal which reaches it, guarded by a sync.Once per node.
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+var lazyOn uint32
+
+// EnableLazyCompile switches lazy compilation of nested encoders on or off, it's off by default.
+// Only encoders compiled after the call are affected. Lazily compiled encoders can't contribute
+// to the size estimate of their parent, so each grows the buffer as it's reached instead.
+func EnableLazyCompile(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+	atomic.StoreUint32(&lazyOn, v)
+}
+
+func lazyEnabled() bool {
+	return atomic.LoadUint32(&lazyOn) == 1
+}
+
+// nestedEncoder is an encoder which other encoders delegate to. They pass the value's pointer to
+// marshalPtr directly, rather than boxing it in an interface for Marshal to unpack again.
+type nestedEncoder interface {
+	Encoder
+	explainer
+	marshalPtr(p unsafe.Pointer, w *Buffer)
+}
+
+// compileStruct returns the encoder for a nested struct of type t, along with its size estimate
+func compileStruct(t interface{}, version int, esc escapeMode) (nestedEncoder, int) {
+	if lazyEnabled() {
+		return &lazyStruct{t: t, version: version, esc: esc}, 0
+	}
+	enc := sharedStruct(t, version, esc)
+	return enc, enc.size
+}
+
+// compileSlice returns the encoder for a nested slice of type t
+func compileSlice(t interface{}, version int, esc escapeMode) nestedEncoder {
+	if lazyEnabled() {
+		return &lazySlice{t: t, version: version, esc: esc}
+	}
+	return sharedSlice(t, version, esc)
+}
+
+// lazyStruct compiles a StructEncoder on first use
+type lazyStruct struct {
+	once    sync.Once
+	t       interface{}
+	version int
+	esc     escapeMode
+	enc     *StructEncoder
+}
+
+func (l *lazyStruct) get() *StructEncoder {
+	l.once.Do(func() { l.enc = sharedStruct(l.t, l.version, l.esc) })
+	return l.enc
+}
+
+func (l *lazyStruct) Marshal(s interface{}, w *Buffer) {
+	l.get().Marshal(s, w)
+}
+
+func (l *lazyStruct) marshalPtr(p unsafe.Pointer, w *Buffer) {
+	l.get().marshalPtr(p, w)
+}
+
+func (l *lazyStruct) explain(w *strings.Builder, depth int, seen map[explainer]bool) {
+	l.get().explain(w, depth, seen)
+}
+
+// lazySlice compiles a SliceEncoder on first use
+type lazySlice struct {
+	once    sync.Once
+	t       interface{}
+	version int
+	esc     escapeMode
+	enc     *SliceEncoder
+}
+
+func (l *lazySlice) get() *SliceEncoder {
+	l.once.Do(func() { l.enc = sharedSlice(l.t, l.version, l.esc) })
+	return l.enc
+}
+
+func (l *lazySlice) Marshal(s interface{}, w *Buffer) {
+	l.get().Marshal(s, w)
+}
+
+func (l *lazySlice) marshalPtr(p unsafe.Pointer, w *Buffer) {
+	l.get().marshalPtr(p, w)
+}
+
+func (l *lazySlice) explain(w *strings.Builder, depth int, seen map[explainer]bool) {
+	l.get().explain(w, depth, seen)
+}
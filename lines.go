@@ -0,0 +1,57 @@
+package jingo
+
+// lines.go writes JSON Lines (https://jsonlines.org), one document per line, as used by log
+// shippers and bulk import files.
+
+import (
+	"io"
+)
+
+// LinesWriter writes each value passed to Write as a line of JSON to an io.Writer. It's not safe
+// for concurrent use.
+type LinesWriter struct {
+	w   io.Writer
+	enc Encoder
+}
+
+// NewLinesWriter returns a LinesWriter which encodes values with enc and writes them to w.
+func NewLinesWriter(w io.Writer, enc Encoder) *LinesWriter {
+	return &LinesWriter{w: w, enc: enc}
+}
+
+// Write encodes v, a pointer to the type the encoder was compiled for, into a pooled buffer and
+// writes it to the underlying writer followed by a newline, with a single call to its Write. Any
+// error encoding or writing the line is returned.
+func (lw *LinesWriter) Write(v interface{}) error {
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	AppendLine(b, lw.enc, v)
+	if err := b.Err(); err != nil {
+		return err
+	}
+
+	_, err := lw.w.Write(b.Bytes)
+	return err
+}
+
+// AppendLine encodes v with enc into buf followed by a newline, building up a batch of lines in one
+// buffer. Encoders configured with Config.Newline already end each document with one, so aren't
+// given another.
+func AppendLine(buf *Buffer, enc Encoder, v interface{}) {
+	enc.Marshal(v, buf)
+	if !endsLine(enc) {
+		buf.WriteByte('\n')
+	}
+}
+
+// endsLine reports whether enc writes a newline after each document itself, see Config.Newline
+func endsLine(enc Encoder) bool {
+	switch e := enc.(type) {
+	case *StructEncoder:
+		return e.base != nil && e.cfg.Newline
+	case *SliceEncoder:
+		return e.base != nil && e.cfg.Newline
+	}
+	return false
+}
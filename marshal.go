@@ -0,0 +1,96 @@
+package jingo
+
+// marshal.go provides package level Marshal functions for call sites which would rather not manage
+// encoder instances themselves. Encoders are compiled the first time a type is seen and cached
+// against it, so beyond the first call for each type the cost is a single concurrent map lookup.
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ErrUnsupportedType is reported by Buffer.Err when Marshal is given a value it can't encode.
+var ErrUnsupportedType = errors.New("jingo: unsupported type")
+
+// encoders caches the encoder for each type passed to Marshal, keyed by its reflect.Type
+var encoders sync.Map
+
+// Marshal encodes v, a struct or slice or a pointer to one, into buf. The encoder for the type is
+// compiled on first use and cached thereafter. Values are copied before encoding, so passing a
+// pointer is cheaper. nil, and a nil pointer to a type which can be encoded, is written as null.
+// Should v be of a type which can't be encoded nothing is written, and buf.Err reports an error
+// wrapping ErrUnsupportedType.
+func Marshal(v interface{}, buf *Buffer) {
+	if v == nil {
+		buf.Write(null)
+		return
+	}
+
+	// the value's data word can't be tested for nil until it's known to be a pointer, as a struct
+	// holding a single pointer is stored in it directly. The encoders write nil pointers as null.
+	t := reflect.TypeOf(v)
+	if t.Kind() != reflect.Ptr {
+		p := reflect.New(t)
+		p.Elem().Set(reflect.ValueOf(v))
+		v, t = p.Interface(), p.Type()
+	}
+
+	enc, err := encoderFor(t)
+	if err != nil {
+		buf.fail(err)
+		return
+	}
+	enc.Marshal(v, buf)
+}
+
+// MarshalBytes returns the encoding of v, as written by Marshal, as a new byte slice. Should v be
+// of a type which can't be encoded, or the encoders fail, the error reported by Buffer.Err is
+// returned in place of the document.
+func MarshalBytes(v interface{}) ([]byte, error) {
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	Marshal(v, b)
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(b.Bytes))
+	copy(out, b.Bytes)
+
+	return out, nil
+}
+
+// encoderFor returns the cached encoder for t, a pointer type, compiling one if needed
+func encoderFor(t reflect.Type) (e Encoder, err error) {
+	if e, ok := encoders.Load(t); ok {
+		return e.(Encoder), nil
+	}
+
+	// the compilers panic on unsupported field types, report those in the same way as our own.
+	// Anything else is a fault rather than a type we can't encode, so carries on up.
+	defer func() {
+		if r := recover(); r != nil {
+			ce, ok := r.(compileError)
+			if !ok {
+				panic(r)
+			}
+			e, err = nil, fmt.Errorf("%w: %s, %s", ErrUnsupportedType, t.Elem(), ce)
+		}
+	}()
+
+	switch t.Elem().Kind() {
+	case reflect.Struct:
+		e = sharedStruct(reflect.New(t.Elem()).Elem().Interface(), allVersions, 0)
+	case reflect.Slice:
+		e = sharedSlice(reflect.New(t.Elem()).Elem().Interface(), allVersions, 0)
+	default:
+		return nil, fmt.Errorf("%w: %s, want a struct or slice", ErrUnsupportedType, t.Elem())
+	}
+
+	// another goroutine may have beaten us to it, in which case we'll use theirs
+	actual, _ := encoders.LoadOrStore(t, e)
+	return actual.(Encoder), nil
+}
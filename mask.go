@@ -0,0 +1,32 @@
+package jingo
+
+// mask.go supports writing a subset of a struct's fields, i.e for GraphQL style sparse field sets.
+// Rather than filtering as each document is written, a mask compiles a variant of the encoder with
+// only the fields asked for, so it costs nothing per document and can be reused across requests.
+
+// FieldMask nominates the fields written by MarshalMasked. It's created with CompileMask.
+type FieldMask struct {
+	enc *StructEncoder
+}
+
+// CompileMask returns a mask of the top level fields with the given JSON keys, for use with
+// MarshalMasked on this encoder. Keys which don't belong to the struct are ignored.
+func (e *StructEncoder) CompileMask(keys ...string) *FieldMask {
+	if e.base != nil {
+		e = e.base
+	}
+
+	m := &StructEncoder{version: e.version, esc: e.esc, mask: make(map[string]bool, len(keys))}
+	for _, k := range keys {
+		m.mask[k] = true
+	}
+	m.compile(e.t)
+
+	return &FieldMask{enc: m}
+}
+
+// MarshalMasked is Marshal, but writes only the fields in m, which must have been compiled by this
+// encoder. The encoder's Config, hooks, Metrics and Tracer apply as they do to Marshal.
+func (e *StructEncoder) MarshalMasked(s interface{}, w *Buffer, m *FieldMask) {
+	e.marshalVariant(s, w, m.enc)
+}
@@ -0,0 +1,125 @@
+package jingo
+
+// metrics.go reports the size and duration of each document marshalled to a Metrics, i.e to export
+// encode latency and bytes per payload type to Prometheus without wrapping every call site, and
+// brackets it with the calls of a Tracer, see trace.go. Both are off by default, when the cost to
+// Marshal is an atomic load and a couple of nil checks. Only top level documents are observed, not
+// those of the encoders they're nested within.
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Metrics receives an observation for each document an encoder marshals, with the name of the
+// type encoded, the number of bytes written and the time taken. It's called on the marshalling
+// goroutine so must be safe for concurrent use, and quick.
+type Metrics interface {
+	ObserveMarshal(typ string, bytes int, dur time.Duration)
+}
+
+// bits of observeOn, set while there's a global Metrics or Tracer
+const (
+	observeMetrics uint32 = 1 << iota
+	observeTracer
+)
+
+var (
+	observeOn uint32
+	observeMu sync.Mutex   // serialises updates to observeOn
+	metrics   atomic.Value // metricsBox
+)
+
+// metricsBox holds the global Metrics, as atomic.Value needs the same concrete type each time
+type metricsBox struct {
+	m Metrics
+}
+
+// SetMetrics nominates m to observe the documents marshalled by every encoder which hasn't had
+// Metrics of its own set. nil switches global metrics off.
+func SetMetrics(m Metrics) {
+	metrics.Store(metricsBox{m})
+	setObserving(observeMetrics, m != nil)
+}
+
+// setObserving sets or clears bit in observeOn
+func setObserving(bit uint32, on bool) {
+	observeMu.Lock()
+	defer observeMu.Unlock()
+
+	v := atomic.LoadUint32(&observeOn)
+	if on {
+		v |= bit
+	} else {
+		v &^= bit
+	}
+	atomic.StoreUint32(&observeOn, v)
+}
+
+// observing reports whether there's a global Metrics or Tracer
+func observing() bool {
+	return atomic.LoadUint32(&observeOn) != 0
+}
+
+// globalMetrics returns the Metrics set with SetMetrics, if any
+func globalMetrics() Metrics {
+	b, _ := metrics.Load().(metricsBox)
+	return b.m
+}
+
+// SetMetrics returns a copy of the encoder whose documents are observed by m in place of any
+// Metrics set with SetMetrics. The encoder itself is left as it is.
+func (e *StructEncoder) SetMetrics(m Metrics) *StructEncoder {
+	v := *e
+	v.metrics = m
+	return &v
+}
+
+// SetMetrics returns a copy of the encoder whose documents are observed by m in place of any
+// Metrics set with SetMetrics. The encoder itself is left as it is.
+func (e *SliceEncoder) SetMetrics(m Metrics) *SliceEncoder {
+	v := *e
+	v.metrics = m
+	return &v
+}
+
+// observe calls marshal for p, reporting the document written to m and tr, or the global Metrics
+// and Tracer for those which are nil. t names the type encoded.
+func observe(m Metrics, tr Tracer, t reflect.Type, p unsafe.Pointer, w *Buffer, marshal func(unsafe.Pointer, *Buffer)) {
+	if m == nil {
+		m = globalMetrics()
+	}
+	if tr == nil {
+		tr = globalTracer()
+	}
+	if m == nil && tr == nil { // switched off since the check
+		marshal(p, w)
+		return
+	}
+
+	typ := t.String()
+
+	var finish func(bytes int, err error)
+	if tr != nil {
+		ctx := w.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		finish = tr.StartMarshal(ctx, typ)
+	}
+
+	start, n := time.Now(), w.Len()
+	marshal(p, w)
+	n = w.Len() - n
+
+	if m != nil {
+		m.ObserveMarshal(typ, n, time.Since(start))
+	}
+	if finish != nil {
+		finish(n, w.Err())
+	}
+}
@@ -0,0 +1,61 @@
+package jingo
+
+// nameregistry.go provides Registry, which holds encoders under the names of the payload types
+// they encode, for gateway services which route many types and pick one by a name carried in the
+// message or route rather than by the Go type in hand.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnregistered is returned by Registry.Marshal for a name nothing has been registered under.
+var ErrUnregistered = errors.New("jingo: no encoder registered")
+
+// Registry holds encoders by name. It's built for registering once, i.e on startup, and looking
+// up many times concurrently. The zero value is an empty registry ready to use.
+type Registry struct {
+	encoders sync.Map
+}
+
+// checkedEncoder is implemented by the encoders which can verify the type of the value they're given
+type checkedEncoder interface {
+	MarshalChecked(v interface{}, w *Buffer) error
+}
+
+// Register adds enc under name, replacing any encoder already registered under it.
+func (r *Registry) Register(name string, enc Encoder) {
+	r.encoders.Store(name, enc)
+}
+
+// Encoder returns the encoder registered under name, and whether there is one.
+func (r *Registry) Encoder(name string) (Encoder, bool) {
+	enc, ok := r.encoders.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return enc.(Encoder), true
+}
+
+// Marshal encodes v into buf with the encoder registered under name. As the name and value
+// usually arrive separately, StructEncoders and SliceEncoders check v is of the type they were
+// compiled for, returning an error wrapping ErrTypeMismatch if not. An error wrapping
+// ErrUnregistered is returned for an unknown name. Nothing is written in either case, otherwise
+// the buffer's Err is returned.
+func (r *Registry) Marshal(name string, v interface{}, buf *Buffer) error {
+	enc, ok := r.Encoder(name)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnregistered, name)
+	}
+
+	if c, ok := enc.(checkedEncoder); ok {
+		if err := c.MarshalChecked(v, buf); err != nil {
+			return err
+		}
+		return buf.Err()
+	}
+
+	enc.Marshal(v, buf)
+	return buf.Err()
+}
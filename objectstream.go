@@ -0,0 +1,43 @@
+package jingo
+
+// objectstream.go composes an object from parts encoded independently, i.e a response built from
+// several cached fragments and encoders, without declaring a wrapper struct for it.
+
+// ObjectStream writes the keys of an object to a Buffer one at a time, taking care of the commas
+// and escaping of keys. It's created with NewObjectStream and finished with Close.
+type ObjectStream struct {
+	buf *Buffer
+}
+
+// NewObjectStream writes the opening brace of an object to buf, returning an ObjectStream to write
+// its keys with.
+func NewObjectStream(buf *Buffer) *ObjectStream {
+	buf.BeginObject()
+	return &ObjectStream{buf: buf}
+}
+
+// Field writes the key k with v, encoded by enc, as its value. A nil enc writes null.
+func (o *ObjectStream) Field(k string, enc Encoder, v interface{}) {
+	o.buf.WriteKey(k)
+	if enc == nil {
+		o.buf.WriteNull()
+		return
+	}
+	o.buf.WriteValue(enc, v)
+}
+
+// RawField writes the key k with the pre-encoded JSON value b, as-is. Empty b writes null.
+func (o *ObjectStream) RawField(k string, b []byte) {
+	o.buf.WriteKey(k)
+	if len(b) == 0 {
+		o.buf.WriteNull()
+		return
+	}
+	o.buf.WriteRawValue(b)
+}
+
+// Close writes the closing brace of the object. The stream can't be used afterwards.
+func (o *ObjectStream) Close() {
+	o.buf.EndObject()
+	o.buf = nil
+}
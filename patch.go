@@ -0,0 +1,224 @@
+package jingo
+
+// patch.go describes the changes between two values of a struct as patch documents, for PATCH
+// endpoints and change feeds. The values are compared field by field off the encoder's plan: a
+// field whose memory is the same in both is skipped without being encoded, structs held within
+// ours are compared field by field in turn, and only the fields left are written, each on its own,
+// to see whether their JSON differs.
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// MarshalPatch writes a JSON Patch (RFC 6902) document to w holding the operations which transform
+// from into to, both pointers to the encoder's struct. Each field which differs is replaced, with
+// nested structs patched field by field and any other value, including slices, replaced whole.
+// Nothing beyond the array brackets is written when the values encode the same.
+func (e *StructEncoder) MarshalPatch(from, to interface{}, w *Buffer) {
+	if e.base != nil {
+		e = e.base
+	}
+
+	pa := (*(*iface)(unsafe.Pointer(&from))).Data
+	pb := (*(*iface)(unsafe.Pointer(&to))).Data
+
+	a, b := getScratch(), getScratch()
+	defer putScratch(a)
+	defer putScratch(b)
+
+	w.BeginArray()
+	switch {
+	case pa == pb:
+	case pa == nil || pb == nil: // a nil struct pointer at the top level replaces the whole document
+		e.marshal(pb, b)
+		if err := b.Err(); err != nil {
+			w.fail(err)
+			break
+		}
+		writeReplace("", b.Bytes, w)
+	default:
+		if err := writePatch(e, pa, pb, "", w, a, b); err != nil {
+			w.fail(err)
+		}
+	}
+	w.EndArray()
+}
+
+// writePatch writes a replace operation to w for each field which differs between the structs at
+// pa and pb, prefixing their paths with path. Values are written to a and b to compare them.
+func writePatch(e *StructEncoder, pa, pb unsafe.Pointer, path string, w, a, b *Buffer) error {
+	for i := range e.plan {
+		f := &e.plan[i]
+		if f.key == "" || f.same(pa, pb) {
+			continue
+		}
+
+		p := path + "/" + pointerEscaper.Replace(f.key)
+		if se := f.structEncoder(); se != nil {
+			if err := writePatch(se, add(pa, f.offset), add(pb, f.offset), p, w, a, b); err != nil {
+				return err
+			}
+			continue
+		}
+
+		va, vb, err := f.values(pa, pb, a, b)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(va, vb) {
+			writeReplace(p, vb, w)
+		}
+	}
+	return nil
+}
+
+// MarshalMergePatch writes a JSON Merge Patch (RFC 7386) document to w holding only the fields of v
+// which differ from base, both pointers to the encoder's struct. A nil base compares v with the
+// zero value of the struct. Nested structs are patched field by field, any other value which
+// differs, including slices, is written whole.
+func (e *StructEncoder) MarshalMergePatch(base, v interface{}, w *Buffer) {
+	if e.base != nil {
+		e = e.base
+	}
+
+	pa := (*(*iface)(unsafe.Pointer(&base))).Data
+	if pa == nil {
+		pa = (*(*iface)(unsafe.Pointer(&e.t))).Data
+	}
+	pb := (*(*iface)(unsafe.Pointer(&v))).Data
+
+	if pb == nil { // a nil struct pointer replaces the whole document
+		w.WriteNull()
+		return
+	}
+
+	a, b := getScratch(), getScratch()
+	defer putScratch(a)
+	defer putScratch(b)
+
+	if err := writeMergePatch(e, pa, pb, w, a, b); err != nil {
+		w.fail(err)
+	}
+}
+
+// writeMergePatch writes an object to w with the fields of the struct at pb whose values differ
+// from those of the struct at pa. Values are written to a and b to compare them.
+func writeMergePatch(e *StructEncoder, pa, pb unsafe.Pointer, w, a, b *Buffer) error {
+	w.BeginObject()
+	for i := range e.plan {
+		f := &e.plan[i]
+		if f.key == "" || f.same(pa, pb) {
+			continue
+		}
+
+		// the memory differing doesn't mean a field of a nested struct does, i.e padding, so its
+		// patch is only kept should it hold anything
+		if se := f.structEncoder(); se != nil {
+			nested := getScratch()
+			err := writeMergePatch(se, add(pa, f.offset), add(pb, f.offset), nested, a, b)
+			if err == nil && len(nested.Bytes) > 2 {
+				w.WriteKey(f.key)
+				w.WriteRawValue(nested.Bytes)
+			}
+			putScratch(nested)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		va, vb, err := f.values(pa, pb, a, b)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(va, vb) {
+			w.WriteKey(f.key)
+			w.WriteRawValue(vb)
+		}
+	}
+	w.EndObject()
+	return nil
+}
+
+func writeReplace(path string, v []byte, w *Buffer) {
+	w.BeginObject()
+	w.WriteKey("op")
+	w.WriteStringValue("replace")
+	w.WriteKey("path")
+	w.WriteStringValue(path)
+	w.WriteKey("value")
+	w.WriteRawValue(v)
+	w.EndObject()
+}
+
+// pointerEscaper escapes keys for use in a JSON Pointer (RFC 6901)
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// add returns p moved on by offset bytes
+func add(p unsafe.Pointer, offset uintptr) unsafe.Pointer {
+	return unsafe.Pointer(uintptr(p) + offset)
+}
+
+// same reports whether the field holds the same bytes in the structs at pa and pb, in which case
+// it encodes the same too. Pointers are compared rather than what they point to.
+func (f *fieldPlan) same(pa, pb unsafe.Pointer) bool {
+	if f.size == 0 {
+		return true
+	}
+	n := int(f.size)
+	sa := sliceHeader{Data: add(pa, f.offset), Len: n, Cap: n}
+	sb := sliceHeader{Data: add(pb, f.offset), Len: n, Cap: n}
+	return bytes.Equal(*(*[]byte)(unsafe.Pointer(&sa)), *(*[]byte)(unsafe.Pointer(&sb)))
+}
+
+// structEncoder returns the encoder of a struct held within ours, to be compared field by field,
+// or nil for any other field
+func (f *fieldPlan) structEncoder() *StructEncoder {
+	if !f.inline {
+		return nil
+	}
+	switch n := f.nested.(type) {
+	case *StructEncoder:
+		return n
+	case *lazyStruct:
+		return n.get()
+	}
+	return nil
+}
+
+// values writes the field of the structs at pa and pb to a and b, returning their JSON
+func (f *fieldPlan) values(pa, pb unsafe.Pointer, a, b *Buffer) ([]byte, []byte, error) {
+	va := f.value.write(pa, a)
+	if err := a.Err(); err != nil {
+		return nil, nil, err
+	}
+	vb := f.value.write(pb, b)
+	if err := b.Err(); err != nil {
+		return nil, nil, err
+	}
+	return va, vb, nil
+}
+
+// fieldValue writes the value of a single field of a struct, using a mask of just its key which is
+// compiled on first use
+type fieldValue struct {
+	once sync.Once
+	e    *StructEncoder // the encoder the field belongs to
+	key  string
+	mask *StructEncoder
+}
+
+// write resets w and writes the field of the struct at p to it, returning the value
+func (v *fieldValue) write(p unsafe.Pointer, w *Buffer) []byte {
+	v.once.Do(func() { v.mask = v.e.CompileMask(v.key).enc })
+
+	w.Reset()
+	v.mask.marshal(p, w)
+	if w.Err() != nil {
+		return nil
+	}
+	return w.Bytes[len(`{"`+v.key+`":`) : len(w.Bytes)-1] // the mask writes {"key":value}
+}
@@ -0,0 +1,103 @@
+package jingo
+
+// poolstats.go manages the counters kept on the buffer pool. They're off by default, as even an
+// uncontended atomic add isn't free, and can be switched on with EnablePoolStats to help tune
+// pool behaviour in production.
+
+import (
+	"sync/atomic"
+)
+
+// PoolStats is a snapshot of the buffer pool's counters
+type PoolStats struct {
+	Gets    uint64 `json:"gets"`    // buffers requested from the pool
+	Puts    uint64 `json:"puts"`    // buffers returned to the pool
+	Misses  uint64 `json:"misses"`  // requests the pool had to allocate a new buffer for
+	Dropped uint64 `json:"dropped"` // buffers discarded on return for exceeding the maximum capacity
+	PeakCap int64  `json:"peakCap"` // largest capacity seen on a buffer returned to the pool
+}
+
+var (
+	poolStatsOn uint32
+	poolStats   PoolStats
+	poolMaxCap  int64
+
+	poolStatsEnc = NewStructEncoder(PoolStats{})
+)
+
+// EnablePoolStats switches the buffer pool's counters on or off. The counters aren't reset.
+func EnablePoolStats(on bool) {
+	var v uint32
+	if on {
+		v = 1
+	}
+	atomic.StoreUint32(&poolStatsOn, v)
+}
+
+// ReadPoolStats returns a snapshot of the buffer pool's counters
+func ReadPoolStats() PoolStats {
+	return PoolStats{
+		Gets:    atomic.LoadUint64(&poolStats.Gets),
+		Puts:    atomic.LoadUint64(&poolStats.Puts),
+		Misses:  atomic.LoadUint64(&poolStats.Misses),
+		Dropped: atomic.LoadUint64(&poolStats.Dropped),
+		PeakCap: atomic.LoadInt64(&poolStats.PeakCap),
+	}
+}
+
+// SetPoolMaxCap stops buffers with a capacity larger than n from being returned to the pool, so
+// the occasional huge document doesn't keep its memory alive. Zero or less removes the maximum.
+func SetPoolMaxCap(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&poolMaxCap, int64(n))
+}
+
+// String encodes the stats as a JSON document
+func (s PoolStats) String() string {
+	b := NewBufferFromPool()
+	poolStatsEnc.Marshal(&s, b)
+	v := string(b.Bytes)
+	b.ReturnToPool()
+	return v
+}
+
+// PoolStatsVar reports a fresh snapshot of the pool's counters each time its String method is
+// called. It satisfies expvar.Var, so it can be published with e.g
+// expvar.Publish("jingo.pool", jingo.PoolStatsVar)
+var PoolStatsVar poolStatsVar
+
+type poolStatsVar struct{}
+
+func (poolStatsVar) String() string {
+	return ReadPoolStats().String()
+}
+
+func poolStatsEnabled() bool {
+	return atomic.LoadUint32(&poolStatsOn) != 0
+}
+
+// countPut records a buffer being returned to the pool and reports whether it should be kept
+func countPut(b *Buffer) bool {
+	c := int64(cap(b.Bytes))
+
+	if m := atomic.LoadInt64(&poolMaxCap); m > 0 && c > m {
+		if poolStatsEnabled() {
+			atomic.AddUint64(&poolStats.Dropped, 1)
+		}
+		return false
+	}
+
+	if !poolStatsEnabled() {
+		return true
+	}
+
+	atomic.AddUint64(&poolStats.Puts, 1)
+	for {
+		p := atomic.LoadInt64(&poolStats.PeakCap)
+		if c <= p || atomic.CompareAndSwapInt64(&poolStats.PeakCap, p, c) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package jingo
+
+// precompile.go compiles the nested encoders of large type graphs concurrently. Compiling a struct
+// compiles every type nested within it, one after another, which for root API types referencing
+// hundreds of others adds up to a noticeable pause on startup. Before the root is compiled its
+// graph is walked, cheaply, to find the nested types, and when there are enough of them they're
+// compiled into the registry by a pool of workers. The root's own compile then finds them there.
+// Each type is queued once, though a worker may still compile a type another is part way through,
+// in which case the registry keeps whichever finishes first.
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// minPrecompile is the least number of nested types worth starting workers for, smaller graphs
+// compile faster than the goroutines can be started
+const minPrecompile = 16
+
+// precompile compiles the struct and slice types nested within t into the registry concurrently,
+// if there are enough of them not compiled already. Types which fail to compile are left for the
+// caller's own compile to report, any other panic in a worker is raised again on the caller's
+// goroutine once the workers are done.
+func precompile(t reflect.Type, version int, esc escapeMode) {
+	workers := runtime.GOMAXPROCS(0)
+	if lazyEnabled() || workers == 1 {
+		return
+	}
+
+	var nested []reflect.Type
+	walkNested(t, version, esc, map[reflect.Type]bool{t: true}, &nested)
+	if len(nested) < minPrecompile {
+		return
+	}
+
+	var (
+		mu     sync.Mutex
+		failed interface{} // the first panic other than a compileError
+	)
+
+	types := make(chan reflect.Type)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range types {
+				if r := precompileType(t, version, esc); r != nil {
+					mu.Lock()
+					if failed == nil {
+						failed = r
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, t := range nested {
+		types <- t
+	}
+	close(types)
+	wg.Wait()
+
+	if failed != nil {
+		panic(failed)
+	}
+}
+
+// precompileType compiles the shared encoder for t, a struct or slice type. It returns the value
+// of any panic other than a compileError, which are left for the caller to report, see precompile.
+func precompileType(t reflect.Type, version int, esc escapeMode) (failed interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(compileError); !ok {
+				failed = r
+			}
+		}
+	}()
+
+	v := reflect.New(t).Elem().Interface()
+	if t.Kind() == reflect.Slice {
+		sharedSlice(v, version, esc)
+	} else {
+		sharedStruct(v, version, esc)
+	}
+	return nil
+}
+
+// walkNested appends the struct and slice types nested within the struct t, which compiling it
+// would compile shared encoders for, to nested. Fields written by their own methods or a
+// registered encoder aren't followed.
+func walkNested(t reflect.Type, version int, esc escapeMode, seen map[reflect.Type]bool, nested *[]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag, opts := parseTag(f.Tag.Get("json"))
+		if tag == "" || !opts.inVersion(version) {
+			continue
+		}
+		if opts.Contains("stringer") || opts.Contains("encoder") || opts.Contains("raw") ||
+			opts.Contains("escape") || opts.Contains("text") {
+			continue
+		}
+
+		walkType(f.Type, version, esc, seen, nested)
+	}
+}
+
+// walkType walks the types within t, then adds t to nested if it's a struct or slice type the
+// compiler would share and hasn't yet. Types come after those nested within them, so workers taking them in order
+// mostly find what a type depends on already compiled.
+func walkType(t reflect.Type, version int, esc escapeMode, seen map[reflect.Type]bool, nested *[]reflect.Type) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if seen[t] || t == timeType || typeEncoderFor(t) != nil {
+		return
+	}
+	if _, ok := compiled.Load(compiledKey{t, version, esc}); ok { // along with everything nested within it
+		seen[t] = true
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		seen[t] = true
+		walkNested(t, version, esc, seen, nested)
+		*nested = append(*nested, t)
+	case reflect.Slice:
+		seen[t] = true
+		walkType(t.Elem(), version, esc, seen, nested)
+		*nested = append(*nested, t)
+	}
+}
@@ -1,14 +1,20 @@
 package jingo
 
 // ptrconvert.go declares a number of primitive form -> buffer conversion
-// functions based on an unsafe.Pointer input. We're using the implementation
-// from the standard library here, which don't perform badly but are a
-// candidate for a more high performance implementation to be introduced.
+// functions based on an unsafe.Pointer input. Integers are written with our
+// own table driven conversions, as they dominate the encode time of numeric
+// payloads. Floats use the implementation from the standard library, which
+// has produced the shortest representation with the Ryū algorithm since Go
+// 1.17, so there's nothing to be gained from carrying our own.
 
 import (
+	"math/bits"
 	"reflect"
+	"runtime"
 	"strconv"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -29,55 +35,161 @@ var typeconv = map[reflect.Kind]func(unsafe.Pointer, *Buffer){
 	reflect.String:  ptrStringToBuf,
 }
 
-var btrue, bfalse = []byte("true"), []byte("false")
+// bools and quotedBools hold the encodings of false and true, indexed by the byte a bool is held in
+var (
+	bools       = [2][]byte{[]byte("false"), []byte("true")}
+	quotedBools = [2][]byte{[]byte(`"false"`), []byte(`"true"`)}
+)
 
 func ptrBoolToBuf(v unsafe.Pointer, b *Buffer) {
-	r := *(*bool)(v)
-	if r {
-		b.Write(btrue)
-	} else {
-		b.Write(bfalse)
-	}
+	b.Write(bools[*(*uint8)(v)&1])
+}
+
+// ptrQuotedBoolToBuf writes a bool as a string, for the `,string` option
+func ptrQuotedBoolToBuf(v unsafe.Pointer, b *Buffer) {
+	b.Write(quotedBools[*(*uint8)(v)&1])
 }
 
 func ptrIntToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendInt(b.Bytes, int64(*(*int)(v)), 10)
+	b.Bytes = appendInt64(b.Bytes, int64(*(*int)(v)))
 }
 
 func ptrInt8ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendInt(b.Bytes, int64(*(*int8)(v)), 10)
+	b.Bytes = appendInt32(b.Bytes, int32(*(*int8)(v)))
 }
 
 func ptrInt16ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendInt(b.Bytes, int64(*(*int16)(v)), 10)
+	b.Bytes = appendInt32(b.Bytes, int32(*(*int16)(v)))
 }
 
 func ptrInt32ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendInt(b.Bytes, int64(*(*int32)(v)), 10)
+	b.Bytes = appendInt32(b.Bytes, int32(*(*int32)(v)))
 }
 
 func ptrInt64ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendInt(b.Bytes, *(*int64)(v), 10)
+	b.Bytes = appendInt64(b.Bytes, *(*int64)(v))
 }
 
 func ptrUintToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendUint(b.Bytes, uint64(*(*uint)(v)), 10)
+	b.Bytes = appendUint64(b.Bytes, uint64(*(*uint)(v)))
 }
 
 func ptrUint8ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendUint(b.Bytes, uint64(*(*uint8)(v)), 10)
+	b.Bytes = appendUint32(b.Bytes, uint32(*(*uint8)(v)))
 }
 
 func ptrUint16ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendUint(b.Bytes, uint64(*(*uint16)(v)), 10)
+	b.Bytes = appendUint32(b.Bytes, uint32(*(*uint16)(v)))
 }
 
 func ptrUint32ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendUint(b.Bytes, uint64(*(*uint32)(v)), 10)
+	b.Bytes = appendUint32(b.Bytes, uint32(*(*uint32)(v)))
 }
 
 func ptrUint64ToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = strconv.AppendUint(b.Bytes, *(*uint64)(v), 10)
+	b.Bytes = appendUint64(b.Bytes, *(*uint64)(v))
+}
+
+// digitPairs holds the two digit decimal representation of each number below 100, so integers can
+// be converted two digits per division
+const digitPairs = "00010203040506070809" +
+	"10111213141516171819" +
+	"20212223242526272829" +
+	"30313233343536373839" +
+	"40414243444546474849" +
+	"50515253545556575859" +
+	"60616263646566676869" +
+	"70717273747576777879" +
+	"80818283848586878889" +
+	"90919293949596979899"
+
+// appendUint32 appends the decimal representation of v to b, as strconv.AppendUint does. 32 bit
+// division is cheaper, so narrower integers are kept to it.
+func appendUint32(b []byte, v uint32) []byte {
+	if v < 100 {
+		return appendSmall(b, v)
+	}
+
+	b, i := extend(b, digits(uint64(v)))
+	for v >= 100 {
+		j := v % 100 * 2 // below 200, so indexing digitPairs needs no bounds check
+		v /= 100
+		i -= 2
+		b[i], b[i+1] = digitPairs[j], digitPairs[j+1]
+	}
+	writeLeading(b, i, v)
+	return b
+}
+
+// appendUint64 appends the decimal representation of v to b, as strconv.AppendUint does
+func appendUint64(b []byte, v uint64) []byte {
+	if v>>32 == 0 {
+		return appendUint32(b, uint32(v))
+	}
+
+	b, i := extend(b, digits(v))
+	for v >= 100 {
+		j := v % 100 * 2 // below 200, so indexing digitPairs needs no bounds check
+		v /= 100
+		i -= 2
+		b[i], b[i+1] = digitPairs[j], digitPairs[j+1]
+	}
+	writeLeading(b, i, uint32(v))
+	return b
+}
+
+// appendSmall appends v, which is below 100, without going through the general case
+func appendSmall(b []byte, v uint32) []byte {
+	if v < 10 {
+		return append(b, byte('0'+v))
+	}
+	return append(b, digitPairs[v*2], digitPairs[v*2+1])
+}
+
+// writeLeading writes the last one or two digits, v being below 100, ending at b[i]
+func writeLeading(b []byte, i int, v uint32) {
+	if v < 10 {
+		b[i-1] = byte('0' + v)
+		return
+	}
+	b[i-2], b[i-1] = digitPairs[v*2], digitPairs[v*2+1]
+}
+
+// extend lengthens b by n bytes, returning it along with its new length. Digits are written into
+// the new bytes from the end, so no intermediate array is needed.
+func extend(b []byte, n int) ([]byte, int) {
+	l := len(b) + n
+	if l > cap(b) {
+		b = append(b, make([]byte, n)...)
+	}
+	return b[:l], l
+}
+
+// digits returns the number of decimal digits in v, which mustn't be zero
+func digits(v uint64) int {
+	n := (bits.Len64(v) * 1233) >> 12 // approximates log10 from log2, being at most one short
+	if v >= pow10[n] {
+		n++
+	}
+	return n
+}
+
+var pow10 = [20]uint64{1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19}
+
+// appendInt32 appends the decimal representation of v to b, as strconv.AppendInt does
+func appendInt32(b []byte, v int32) []byte {
+	if v < 0 {
+		return appendUint32(append(b, '-'), uint32(-int64(v)))
+	}
+	return appendUint32(b, uint32(v))
+}
+
+// appendInt64 appends the decimal representation of v to b, as strconv.AppendInt does
+func appendInt64(b []byte, v int64) []byte {
+	if v < 0 {
+		return appendUint64(append(b, '-'), uint64(-v)) // also right for math.MinInt64
+	}
+	return appendUint64(b, uint64(v))
 }
 
 func ptrFloat32ToBuf(v unsafe.Pointer, b *Buffer) {
@@ -93,48 +205,230 @@ func ptrStringToBuf(v unsafe.Pointer, b *Buffer) {
 }
 
 func ptrTimeToBuf(v unsafe.Pointer, b *Buffer) {
-	b.Bytes = (*time.Time)(v).AppendFormat(b.Bytes, time.RFC3339Nano)
+	b.Grow(len(time.RFC3339Nano))
+	b.Bytes = appendTime(b.Bytes, *(*time.Time)(v))
+}
+
+// appendTime appends t formatted as time.RFC3339Nano, as t.AppendFormat does but without the
+// general layout interpreter. Years beyond four digits and offsets which the layout can't express
+// exactly are rare enough to leave to AppendFormat.
+func appendTime(b []byte, t time.Time) []byte {
+	_, off := t.Zone()
+	year, month, day := t.Date()
+	if year < 0 || year > 9999 || off%60 != 0 || off <= -24*60*60 || off >= 24*60*60 {
+		return t.AppendFormat(b, time.RFC3339Nano)
+	}
+	hour, min, sec := t.Clock()
+
+	b = append(b,
+		byte('0'+year/1000), byte('0'+year/100%10), byte('0'+year/10%10), byte('0'+year%10), '-',
+		byte('0'+month/10), byte('0'+month%10), '-',
+		byte('0'+day/10), byte('0'+day%10), 'T',
+		byte('0'+hour/10), byte('0'+hour%10), ':',
+		byte('0'+min/10), byte('0'+min%10), ':',
+		byte('0'+sec/10), byte('0'+sec%10))
+
+	if ns := t.Nanosecond(); ns != 0 { // as many digits as needed, trailing zeros are dropped
+		n := 9
+		for ns%10 == 0 {
+			ns /= 10
+			n--
+		}
+		var i int
+		b, i = extend(append(b, '.'), n)
+		for j := 0; j < n; j++ {
+			b[i-1-j] = byte('0' + ns%10)
+			ns /= 10
+		}
+	}
+	return appendZone(b, off)
+}
+
+// appendZone appends a zone offset in seconds, which is a multiple of a minute, as RFC 3339 does
+func appendZone(b []byte, off int) []byte {
+	if off == 0 {
+		return append(b, 'Z')
+	}
+
+	sign := byte('+')
+	if off < 0 {
+		sign, off = '-', -off
+	}
+	h, m := off/3600, off/60%60
+	return append(b, sign, byte('0'+h/10), byte('0'+h%10), ':', byte('0'+m/10), byte('0'+m%10))
+}
+
+const hexDigits = "0123456789abcdef"
+
+// unaligned reports whether the platform loads words from any address, which the escaping fast path
+// relies on. It's a constant, so the fast path is compiled out elsewhere.
+const unaligned = runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" || runtime.GOARCH == "386" ||
+	runtime.GOARCH == "ppc64le" || runtime.GOARCH == "s390x"
+
+// word masks for finding bytes which need escaping eight at a time, see cleanWord
+const (
+	lsb = 0x0101010101010101
+	msb = 0x8080808080808080
+)
+
+// escapeMode selects how escaped strings are written beyond what JSON requires, see Config.EscapeHTML
+// and Config.ASCII. Encoders are compiled for a mode, and nested encoders share their parent's.
+type escapeMode uint8
+
+const (
+	escapeHTML escapeMode = 1 << iota
+	escapeASCII
+
+	// escapeAll escapes the strings which are otherwise written as they are, i.e plain string
+	// fields and String() results, for documents embedded in scripts, see TemplateFunc. It leaves
+	// the escaper used unchanged.
+	escapeAll
+)
+
+// escaper writes escaped strings for one escapeMode
+type escaper struct {
+	// table holds, for each byte, the character written after a backslash to escape it, 'u' for a
+	// \u00XX escape, or 'U' for the first byte of a rune which is decoded to decide. Bytes which are
+	// written as they are hold zero, so one lookup decides each byte.
+	table [256]byte
+
+	html  bool   // whether <, > and & need escaping, see cleanWord
+	ascii bool   // whether every rune beyond ASCII is escaped
+	high  uint64 // msb if bytes with the high bit set need looking at, zero to skip them
+}
+
+// escapers holds the escaper for each escapeMode
+var escapers = func() (es [(escapeHTML | escapeASCII | escapeAll) + 1]*escaper) {
+	for m := range es {
+		es[m] = newEscaper(escapeMode(m))
+	}
+	return es
+}()
+
+func newEscaper(m escapeMode) *escaper {
+	e := &escaper{html: m&escapeHTML != 0, ascii: m&escapeASCII != 0}
+	for c := 0; c < 0x20; c++ {
+		e.table[c] = 'u'
+	}
+	e.table['"'], e.table['\\'], e.table['\n'], e.table['\r'], e.table['\t'] = '"', '\\', 'n', 'r', 't'
+
+	if e.html {
+		e.table['<'], e.table['>'], e.table['&'] = 'u', 'u', 'u'
+		e.table[0xE2] = 'U' // begins U+2028 and U+2029, which end a line of JavaScript
+		e.high = msb
+	}
+	if e.ascii {
+		for c := utf8.RuneSelf; c < 0x100; c++ {
+			e.table[c] = 'U'
+		}
+		e.high = msb
+	}
+	return e
+}
+
+// cleanWord reports whether none of the eight bytes in x need escaping by an escaper with the
+// given html and high fields. It's the word-at-a-time equivalent of the table, and lets long runs
+// of plain text be skipped without looking at each byte.
+func cleanWord(x uint64, html bool, high uint64) bool {
+	q := x ^ (lsb * '"')
+	s := x ^ (lsb * '\\')
+
+	// each term has the high bit of a byte set where it's below 0x20, or zero after the xor with
+	// one of the characters escaped. Bytes with their own high bit set are masked out by &^ unless
+	// high asks for them.
+	dirty := (x - lsb*0x20) | (q - lsb) | (s - lsb)
+	if html {
+		dirty |= ((x ^ (lsb * '<')) - lsb) | ((x ^ (lsb * '>')) - lsb) | ((x ^ (lsb * '&')) - lsb)
+	}
+	return (dirty&^x|x&high)&msb == 0
+}
+
+// plain reports whether b can be written in a JSON string as it is
+func (e *escaper) plain(b []byte) bool {
+	for _, c := range b {
+		if e.table[c] != 0 {
+			return false
+		}
+	}
+	return true
 }
 
-func ptrEscapeStringToBuf(v unsafe.Pointer, w *Buffer) {
-	bs := *(*string)(v)
+// ptrEscape writes the string v points to, escaped
+func (e *escaper) ptrEscape(v unsafe.Pointer, w *Buffer) {
+	e.escape(*(*string)(v), w)
+}
+
+// escape writes bs to w, escaped for use within a JSON string
+func (e *escaper) escape(bs string, w *Buffer) {
+
+	p := (*sliceHeader)(unsafe.Pointer(&bs)).Data // a string header begins the same way
+	html, high := e.html, e.high                  // held locally, so the word test needn't load them
 
 	pos := 0
 	for i := 0; i < len(bs); i++ {
-		switch bs[i] {
-		case '\\', '"':
-			if pos < i {
-				w.WriteString(bs[pos:i])
+		if unaligned && i+8 <= len(bs) { // skip plain text a word at a time while there's a word left
+			for i+8 <= len(bs) && cleanWord(*(*uint64)(unsafe.Pointer(uintptr(p) + uintptr(i))), html, high) {
+				i += 8
+			}
+			if i == len(bs) {
+				break
 			}
-			pos = i + 1
+		}
 
-			w.WriteByte('\\')
-			w.WriteByte(bs[i])
-		case '\n':
-			if pos < i {
-				w.WriteString(bs[pos:i])
+		esc := e.table[bs[i]]
+		if esc == 0 {
+			continue
+		}
+
+		if esc == 'U' {
+			r, size := utf8.DecodeRuneInString(bs[i:])
+			if !e.ascii && r != '\u2028' && r != '\u2029' {
+				i += size - 1
+				continue
 			}
-			pos = i + 1
 
-			w.WriteString(`\n`)
-		case '\r':
 			if pos < i {
 				w.WriteString(bs[pos:i])
 			}
-			pos = i + 1
+			pos = i + size
+			i += size - 1
 
-			w.WriteString(`\r`)
-		case '\t':
-			if pos < i {
-				w.WriteString(bs[pos:i])
+			// invalid UTF-8 decodes as utf8.RuneError, written as \ufffd as encoding/json does
+			if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+				writeU(w, r1)
+				r = r2
 			}
-			pos = i + 1
+			writeU(w, r)
+			continue
+		}
 
-			w.WriteString(`\t`)
+		if pos < i {
+			w.WriteString(bs[pos:i])
 		}
+		pos = i + 1
+
+		if esc != 'u' {
+			w.WriteByte('\\')
+			w.WriteByte(esc)
+			continue
+		}
+
+		/// remaining control characters have no short form
+		w.WriteString(`\u00`)
+		w.WriteByte(hexDigits[bs[i]>>4])
+		w.WriteByte(hexDigits[bs[i]&0xF])
 	}
 
 	if pos < len(bs) {
 		w.WriteString(bs[pos:])
 	}
 }
+
+// writeU writes the \uXXXX escape of r, which must be below 0x10000
+func writeU(w *Buffer, r rune) {
+	w.WriteString(`\u`)
+	w.WriteByte(hexDigits[r>>12&0xF])
+	w.WriteByte(hexDigits[r>>8&0xF])
+	w.WriteByte(hexDigits[r>>4&0xF])
+	w.WriteByte(hexDigits[r&0xF])
+}
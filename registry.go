@@ -0,0 +1,44 @@
+package jingo
+
+// registry.go shares compiled encoders between every place a type is nested. Without it each
+// field of a given struct type would compile and hold its own copy of the same instructions, which
+// adds up quickly in large models where a type such as an address is referenced from many others.
+
+import (
+	"reflect"
+	"sync"
+)
+
+// compiled holds the shared nested encoders, keyed by compiledKey
+var compiled sync.Map
+
+// compiledKey identifies a shared encoder by its type, and the API version and escapeMode it was
+// compiled for
+type compiledKey struct {
+	t       reflect.Type
+	version int
+	esc     escapeMode
+}
+
+// sharedStruct returns the shared StructEncoder for t, compiling it if this is the first use
+func sharedStruct(t interface{}, version int, esc escapeMode) *StructEncoder {
+	k := compiledKey{reflect.TypeOf(t), version, esc}
+	if e, ok := compiled.Load(k); ok {
+		return e.(*StructEncoder)
+	}
+
+	// another goroutine may have beaten us to it, in which case we'll use theirs
+	e, _ := compiled.LoadOrStore(k, newStructEncoder(t, version, esc))
+	return e.(*StructEncoder)
+}
+
+// sharedSlice returns the shared SliceEncoder for t, compiling it if this is the first use
+func sharedSlice(t interface{}, version int, esc escapeMode) *SliceEncoder {
+	k := compiledKey{reflect.TypeOf(t), version, esc}
+	if e, ok := compiled.Load(k); ok {
+		return e.(*SliceEncoder)
+	}
+
+	e, _ := compiled.LoadOrStore(k, newSliceEncoder(t, version, esc))
+	return e.(*SliceEncoder)
+}
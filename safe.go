@@ -0,0 +1,154 @@
+package jingo
+
+// safe.go provides Marshal variants which recover from panics raised while encoding, so that one
+// malformed record, i.e a custom encoder dereferencing nil, can be reported and skipped rather than
+// taking down a whole batch. They're slower than Marshal and intended for untrusted data only.
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// MarshalError is returned by the MarshalSafe functions when encoding a value panics.
+type MarshalError struct {
+	Path  string      // the type and, where known, the element and top level field being written
+	Panic interface{} // the value recovered from the panic
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("jingo: panic encoding %s: %v", e.Path, e.Panic)
+}
+
+// MarshalSafe is Marshal, but recovers any panic raised while encoding and returns it as a
+// *MarshalError. Anything written to the buffer for the failed document is discarded, unless it
+// has already been flushed or sealed away.
+func (e *StructEncoder) MarshalSafe(s interface{}, w *Buffer) (err error) {
+	p := (*(*iface)(unsafe.Pointer(&s))).Data
+	start, at := len(w.Bytes), -1
+
+	defer func() {
+		if r := recover(); r != nil {
+			if len(w.Bytes) > start {
+				w.Bytes = w.Bytes[:start]
+			}
+			err = &MarshalError{Path: e.pathOf(at), Panic: r}
+		}
+	}()
+
+	marshal := func(p unsafe.Pointer, w *Buffer) { e.marshalAt(p, w, &at) }
+	if e.hooks != nil {
+		e.hooks.run(p, w, marshal)
+		return nil
+	}
+	marshal(p, w)
+	return nil
+}
+
+// MarshalSafe is Marshal, but recovers any panic raised while encoding and returns it as a
+// *MarshalError. Anything written to the buffer for the failed document is discarded, unless it
+// has already been flushed or sealed away.
+func (e *SliceEncoder) MarshalSafe(s interface{}, w *Buffer) (err error) {
+	p := (*(*iface)(unsafe.Pointer(&s))).Data
+	start := len(w.Bytes)
+
+	defer func() {
+		if r := recover(); r != nil {
+			if len(w.Bytes) > start {
+				w.Bytes = w.Bytes[:start]
+			}
+			err = &MarshalError{Path: e.tt.String() + e.failedAt(p), Panic: r}
+		}
+	}()
+
+	e.Marshal(s, w)
+	return nil
+}
+
+// failedAt finds the element of the slice at p which panicked by writing them again one at a time,
+// returning its index and, for structs, the field being written, or "" should none panic twice
+func (e *SliceEncoder) failedAt(p unsafe.Pointer) string {
+	if e.base != nil {
+		e = e.base
+	}
+	if p == nil {
+		return ""
+	}
+
+	w := getScratch()
+	defer putScratch(w)
+
+	sl := *(*sliceHeader)(p)
+	for i := 0; i < sl.Len; i++ {
+		v := unsafe.Pointer(uintptr(sl.Data) + uintptr(i)*e.offset)
+		if path, failed := e.elemFailed(v, w); failed {
+			return fmt.Sprintf("[%d]%s", i, path)
+		}
+	}
+	return ""
+}
+
+// elemFailed writes the element at v to w, reporting whether it panicked along with the path
+// within it of what did
+func (e *SliceEncoder) elemFailed(v unsafe.Pointer, w *Buffer) (path string, failed bool) {
+	var se *StructEncoder
+	switch n := e.nested.(type) {
+	case *StructEncoder:
+		se = n
+	case *lazyStruct:
+		se = n.get()
+	}
+
+	at := -1
+	defer func() {
+		if r := recover(); r != nil {
+			if se != nil {
+				path = se.fieldOf(at)
+			}
+			failed = true
+		}
+	}()
+
+	w.Reset()
+	if se != nil && e.tt.Elem().Kind() == reflect.Struct {
+		se.marshalAt(v, w, &at)
+		return "", false
+	}
+	if se != nil && e.tt.Elem().Kind() == reflect.Ptr {
+		if v = *(*unsafe.Pointer)(v); v != nil {
+			se.marshalAt(v, w, &at)
+		}
+		return "", false
+	}
+
+	// anything else is written as a slice of just the element
+	one := sliceHeader{Data: v, Len: 1, Cap: 1}
+	e.instruction(unsafe.Pointer(&one), w)
+	return "", false
+}
+
+// pathOf returns the path of the field instruction i belongs to
+func (e *StructEncoder) pathOf(i int) string {
+	if e.base != nil {
+		// configured encoders share the instructions of their base, unless they're indenting
+		if len(e.instructions) != len(e.base.instructions) {
+			i = -1
+		}
+		e = e.base
+	}
+	return reflect.TypeOf(e.t).String() + e.fieldOf(i)
+}
+
+// fieldOf returns the name of the field instruction i of an unconfigured encoder belongs to,
+// prefixed with a dot, or "" if it's outside of any
+func (e *StructEncoder) fieldOf(i int) string {
+	if i < 0 {
+		return ""
+	}
+	for _, f := range e.plan {
+		if f.key != "" && i < f.end {
+			return "." + f.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,350 @@
+package jingo
+
+// scanner.go provides the low level reading of JSON used by the decoders. Like the encoders, the
+// decoders do all of their type work at compile time, leaving the scanner to walk the input a
+// token at a time on behalf of the decode instructions with as little overhead as possible.
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// DecodeError is returned by the decoders when their input isn't valid JSON, or doesn't fit the
+// type being decoded into.
+type DecodeError struct {
+	Offset int    // offset into the input at which the problem was found
+	Msg    string // description of the problem
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("jingo: invalid JSON at offset %d: %s", e.Offset, e.Msg)
+}
+
+// InvalidUnmarshalError is returned by the decoders' Unmarshal when the destination isn't a non-nil
+// pointer to the type the decoder was compiled for, which they'd otherwise write over blindly.
+type InvalidUnmarshalError struct {
+	Type reflect.Type // type of the destination given, nil for a nil interface
+	Want reflect.Type // pointer type the decoder needs
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	switch e.Type {
+	case nil:
+		return "jingo: Unmarshal into nil"
+	case e.Want:
+		return "jingo: Unmarshal into nil " + e.Type.String()
+	}
+	return "jingo: Unmarshal into " + e.Type.String() + ", want " + e.Want.String()
+}
+
+// target returns the address s points to, having checked it's a non-nil pointer of the type ptrTyp
+// the decoder was compiled for, described by want.
+func target(s interface{}, ptrTyp unsafe.Pointer, want reflect.Type) (unsafe.Pointer, error) {
+	i := (*iface)(unsafe.Pointer(&s))
+	if i.Type != ptrTyp || i.Data == nil {
+		return nil, &InvalidUnmarshalError{Type: reflect.TypeOf(s), Want: want}
+	}
+	return i.Data, nil
+}
+
+// scanner holds the state of a single decode
+type scanner struct {
+	data []byte
+	pos  int
+	buf  []byte // scratch space for unescaping strings
+}
+
+var scanpool = sync.Pool{
+	New: func() interface{} {
+		return &scanner{buf: make([]byte, 0, 64)}
+	},
+}
+
+func getScanner(data []byte) *scanner {
+	s := scanpool.Get().(*scanner)
+	s.data, s.pos = data, 0
+	return s
+}
+
+func putScanner(s *scanner) {
+	s.data = nil
+	scanpool.Put(s)
+}
+
+func (s *scanner) errorf(format string, args ...interface{}) error {
+	return &DecodeError{Offset: s.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// next skips any whitespace and returns the next byte without consuming it, or 0 at the end
+func (s *scanner) next() byte {
+	for s.pos < len(s.data) {
+		switch c := s.data[s.pos]; c {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return c
+		}
+	}
+	return 0
+}
+
+// consume skips any whitespace and then c, which must be the next byte
+func (s *scanner) consume(c byte) error {
+	if s.next() != c {
+		return s.unexpected(fmt.Sprintf("%q", c))
+	}
+	s.pos++
+	return nil
+}
+
+// unexpected returns an error for the input at the current position, when want was expected
+func (s *scanner) unexpected(want string) error {
+	if s.pos >= len(s.data) {
+		return s.errorf("unexpected end of input, expected %s", want)
+	}
+	return s.errorf("unexpected %q, expected %s", s.data[s.pos], want)
+}
+
+// literal consumes lit if it's next
+func (s *scanner) literal(lit string) bool {
+	if s.next() == lit[0] && len(s.data)-s.pos >= len(lit) && string(s.data[s.pos:s.pos+len(lit)]) == lit {
+		s.pos += len(lit)
+		return true
+	}
+	return false
+}
+
+// null consumes a null if it's next
+func (s *scanner) null() bool {
+	return s.literal("null")
+}
+
+// bool reads a boolean
+func (s *scanner) bool() (bool, error) {
+	switch {
+	case s.literal("true"):
+		return true, nil
+	case s.literal("false"):
+		return false, nil
+	}
+	return false, s.unexpected("a boolean")
+}
+
+// number returns the text of a number, leaving its validation to strconv
+func (s *scanner) number() ([]byte, error) {
+	s.next()
+	start := s.pos
+	for ; s.pos < len(s.data); s.pos++ {
+		if c := s.data[s.pos]; (c < '0' || c > '9') && c != '-' && c != '+' && c != '.' && c != 'e' && c != 'E' {
+			break
+		}
+	}
+	if s.pos == start {
+		return nil, s.unexpected("a number")
+	}
+	return s.data[start:s.pos], nil
+}
+
+// string reads a quoted string, returning its unescaped content. The result refers to either the
+// input or scratch space, so is only valid until the next call.
+func (s *scanner) string() ([]byte, error) {
+	if err := s.consume('"'); err != nil {
+		return nil, err
+	}
+
+	// the common case of a string without escapes can be returned as-is
+	for start := s.pos; s.pos < len(s.data); s.pos++ {
+		switch c := s.data[s.pos]; {
+		case c == '"':
+			s.pos++
+			return s.data[start : s.pos-1], nil
+		case c == '\\':
+			return s.unescape(append(s.buf[:0], s.data[start:s.pos]...))
+		case c < 0x20:
+			return nil, s.errorf("control character in string")
+		}
+	}
+	return nil, s.errorf("unterminated string")
+}
+
+// unescape continues reading a string from the first escape, appending the unescaped content to b
+func (s *scanner) unescape(b []byte) ([]byte, error) {
+	defer func() { s.buf = b[:0] }()
+
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return b, nil
+		case c < 0x20:
+			return nil, s.errorf("control character in string")
+		case c != '\\':
+			b = append(b, c)
+			s.pos++
+			continue
+		}
+
+		if s.pos+1 >= len(s.data) {
+			break
+		}
+		s.pos++
+
+		switch c := s.data[s.pos]; c {
+		case '"', '\\', '/':
+			b = append(b, c)
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r, ok := s.hex4(s.pos + 1)
+			if !ok {
+				return nil, s.errorf("invalid unicode escape")
+			}
+			s.pos += 4
+
+			// characters outside the BMP are escaped as a surrogate pair
+			if utf16.IsSurrogate(r) {
+				hi := r
+				r = utf8.RuneError
+				if len(s.data)-s.pos > 2 && s.data[s.pos+1] == '\\' && s.data[s.pos+2] == 'u' {
+					if lo, ok := s.hex4(s.pos + 3); ok {
+						if dr := utf16.DecodeRune(hi, lo); dr != utf8.RuneError {
+							r = dr
+							s.pos += 6
+						}
+					}
+				}
+			}
+
+			var rb [utf8.UTFMax]byte
+			b = append(b, rb[:utf8.EncodeRune(rb[:], r)]...)
+		default:
+			return nil, s.errorf("invalid escape '\\%c' in string", c)
+		}
+		s.pos++
+	}
+	return nil, s.errorf("unterminated string")
+}
+
+// hex4 reads the four hex digits of a unicode escape starting at i
+func (s *scanner) hex4(i int) (rune, bool) {
+	if len(s.data)-i < 4 {
+		return 0, false
+	}
+
+	var r rune
+	for _, c := range s.data[i : i+4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		case c >= 'A' && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	return r, true
+}
+
+// skip reads past the next value, whatever it is
+func (s *scanner) skip() error {
+	switch s.next() {
+	case '"':
+		_, err := s.string()
+		return err
+
+	case '{':
+		s.pos++
+		if s.next() == '}' {
+			s.pos++
+			return nil
+		}
+		for {
+			if _, err := s.string(); err != nil {
+				return err
+			}
+			if err := s.consume(':'); err != nil {
+				return err
+			}
+			if err := s.skip(); err != nil {
+				return err
+			}
+			if done, err := s.more('}'); done || err != nil {
+				return err
+			}
+		}
+
+	case '[':
+		s.pos++
+		if s.next() == ']' {
+			s.pos++
+			return nil
+		}
+		for {
+			if err := s.skip(); err != nil {
+				return err
+			}
+			if done, err := s.more(']'); done || err != nil {
+				return err
+			}
+		}
+
+	case 't', 'f':
+		_, err := s.bool()
+		return err
+
+	case 'n':
+		if s.null() {
+			return nil
+		}
+		return s.unexpected("a value")
+	}
+
+	// nothing else checks a skipped number, so it's held to the grammar here
+	n, err := s.number()
+	if err != nil {
+		return err
+	}
+	if end, ok := validNumber(n, 0); !ok || end != len(n) {
+		s.pos -= len(n) - end
+		return s.errorf("invalid number %q", n)
+	}
+	return nil
+}
+
+// more reads the separator after an element of an object or array, reporting whether it was the
+// closing end rather than a comma
+func (s *scanner) more(end byte) (bool, error) {
+	switch s.next() {
+	case ',':
+		s.pos++
+		return false, nil
+	case end:
+		s.pos++
+		return true, nil
+	}
+	return false, s.unexpected(fmt.Sprintf("',' or %q", end))
+}
+
+// end checks nothing but whitespace follows the document
+func (s *scanner) end() error {
+	if s.next() != 0 {
+		return s.errorf("unexpected %q after document", s.data[s.pos])
+	}
+	return nil
+}
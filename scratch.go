@@ -0,0 +1,49 @@
+package jingo
+
+// scratch.go pools the buffers used for intermediate work, i.e a document rendered once to be
+// indented, diffed or transcoded, or text which has to be escaped before it's written. They're
+// kept apart from the output buffer pool so that short lived scratch space doesn't skew its stats
+// or size classes, and is never handed out as somebody's output buffer with state left over.
+
+import (
+	"sync"
+)
+
+// maxScratch is the largest capacity of buffer kept for reuse, anything bigger is left to the GC
+// rather than pinning the memory for the sake of an occasional huge document
+const maxScratch = 1 << 20
+
+var scratchPool = sync.Pool{
+	New: func() interface{} {
+		return &Buffer{}
+	},
+}
+
+// getScratch returns an empty buffer for intermediate work, return it with putScratch once done
+func getScratch() *Buffer {
+	return scratchPool.Get().(*Buffer)
+}
+
+// scratchFor returns a scratch buffer, as getScratch, for a document to be worked on before it's
+// written to w. It's held to what's left of any limit on w.
+func scratchFor(w *Buffer) *Buffer {
+	b := getScratch()
+	if w.limit > 0 {
+		n := w.limit - w.Len()
+		if n < 1 {
+			n = 1 // already over, so the first write fails
+		}
+		b.SetLimit(n)
+	}
+	return b
+}
+
+// putScratch returns b to the scratch pool. Nothing may refer to its bytes afterwards.
+func putScratch(b *Buffer) {
+	if cap(b.Bytes) > maxScratch {
+		return
+	}
+	b.Reset()
+	b.SetLimit(0)
+	scratchPool.Put(b)
+}
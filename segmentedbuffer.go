@@ -0,0 +1,65 @@
+package jingo
+
+// segmentedbuffer.go manages segmented Buffers. Rather than one contiguous slice, which has to be
+// regrown and copied as a large document is written, a segmented buffer seals Bytes off into a
+// chain of pooled segments whenever it reaches the segment size. The segments are written out in
+// a single vectored write, so a document is never copied into one giant allocation on its way to
+// the socket.
+
+import (
+	"io"
+	"net"
+)
+
+// NewSegmentedBuffer returns a Buffer from the pool which keeps its content as a chain of
+// segments of around `size` bytes each. Bytes only holds the content written since the last
+// segment was sealed; use WriteTo to write out the whole document, or Clone to get a copy of it
+// in a single slice. When you're done with it, call 'ReturnToPool'.
+func NewSegmentedBuffer(size int) *Buffer {
+	b := NewBufferFromPoolWithCap(size)
+	b.segSize = size
+	b.mark = 0
+	return b
+}
+
+// seal moves the content of Bytes into a new segment and replaces it with an empty one
+func (b *Buffer) seal() {
+	if b.hash != nil {
+		b.hashPending()
+	}
+
+	s := NewBufferFromPoolWithCap(b.segSize)
+	s.Bytes, b.Bytes = b.Bytes, s.Bytes[:0]
+	b.segs = append(b.segs, s)
+
+	b.off += len(s.Bytes)
+	b.hashed = 0
+}
+
+// releaseSegments returns any sealed segments to the pool
+func (b *Buffer) releaseSegments() {
+	for i, s := range b.segs {
+		s.ReturnToPool()
+		b.segs[i] = nil
+	}
+	b.segs = b.segs[:0]
+}
+
+// writeSegmentsTo writes each of the segments followed by Bytes using net.Buffers, which uses
+// writev where the writer supports it.
+func (b *Buffer) writeSegmentsTo(w io.Writer) (int64, error) {
+	for _, s := range b.segs {
+		b.iov = append(b.iov, s.Bytes)
+	}
+	b.iov = append(b.iov, b.Bytes)
+
+	iov := net.Buffers(b.iov)
+	n, err := iov.WriteTo(w)
+
+	for i := range b.iov {
+		b.iov[i] = nil
+	}
+	b.iov = b.iov[:0]
+
+	return n, err
+}
@@ -0,0 +1,93 @@
+package jingo
+
+// sizeclasses.go shards the buffer pool by capacity. sync.Pool already caches per processor, but
+// with a single pool every Get that misses its local cache contends on the shared lists, and
+// recycled buffers are handed out without regard for their size. Requests which state the capacity
+// they need are instead served from a pool holding buffers of that size class, which spreads the
+// load across pools and means a small request doesn't pin a huge buffer (or a big one regrow a
+// small buffer). NewBufferFromPool, which has no size to go on, keeps using the general pool.
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minClassShift = 9  // the smallest class holds 512 byte buffers
+	numClasses    = 13 // and the largest 2MB, anything bigger is served from the general pool
+)
+
+var classpools [numClasses]sync.Pool
+
+func init() {
+	for i := range classpools {
+		classpools[i].New = func() interface{} {
+			if poolStatsEnabled() {
+				atomic.AddUint64(&poolStats.Misses, 1)
+			}
+			return &Buffer{}
+		}
+	}
+}
+
+// classFor returns the smallest size class whose buffers can hold n bytes, or -1 if n is too
+// large for any of them
+func classFor(n int) int {
+	if n <= 1<<minClassShift {
+		return 0
+	}
+
+	c := bits.Len(uint(n-1)) - minClassShift
+	if c >= numClasses {
+		return -1
+	}
+	return c
+}
+
+// classOf returns the largest size class a buffer with a capacity of n bytes can serve, or -1 if
+// it's too small for any of them or bigger than the largest, so that it isn't kept around for
+// requests a fraction of its size
+func classOf(n int) int {
+	if n < 1<<minClassShift || n > 1<<(minClassShift+numClasses-1) {
+		return -1
+	}
+	return bits.Len(uint(n)) - 1 - minClassShift
+}
+
+// getClassBuffer retrieves a buffer with a capacity of at least n bytes from its size class,
+// falling back to the general pool for sizes no class caters for
+func getClassBuffer(n int) *Buffer {
+	c := classFor(n)
+	if c < 0 || !poolingEnabled() {
+		return getBuffer()
+	}
+
+	if poolStatsEnabled() {
+		atomic.AddUint64(&poolStats.Gets, 1)
+	}
+
+	b := classpools[c].Get().(*Buffer)
+	b.sized = true
+	if cap(b.Bytes) < n {
+		b.Bytes = make([]byte, 0, 1<<(uint(c)+minClassShift))
+	}
+	return b
+}
+
+// putBuffer returns a buffer to the pool it belongs in
+func putBuffer(b *Buffer) {
+	if !poolingEnabled() || !countPut(b) {
+		return
+	}
+
+	if b.sized {
+		if c := classOf(cap(b.Bytes)); c >= 0 {
+			classpools[c].Put(b)
+			return
+		}
+		b.sized = false
+	}
+
+	bufpool.Put(b)
+}
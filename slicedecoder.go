@@ -0,0 +1,116 @@
+package jingo
+
+// slicedecoder.go manages SliceDecoder, the decoding counterpart to SliceEncoder. It reads a JSON
+// array into a slice, reusing whatever capacity the destination slice already has so that hot
+// ingestion loops decoding into the same slice don't allocate per element.
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// SliceDecoder stores the instruction for decoding a JSON array into a slice.
+type SliceDecoder struct {
+	tt     reflect.Type
+	ptrTyp unsafe.Pointer // type pointer of a pointer to tt, which Unmarshal checks its destination against
+	size   uintptr
+	zero   reflect.Value
+	elem   func(*scanner, unsafe.Pointer) error
+}
+
+// NewSliceDecoder compiles a decoder for JSON arrays into slices of the type of t.
+func NewSliceDecoder(t interface{}) *SliceDecoder {
+	return newSliceDecoder(reflect.TypeOf(t), &StructDecoder{})
+}
+
+// newSliceDecoder compiles a SliceDecoder for slices of type t, nested within the struct decoded by
+// parent
+func newSliceDecoder(t reflect.Type, parent *StructDecoder) *SliceDecoder {
+	return &SliceDecoder{
+		tt:     t,
+		ptrTyp: typeOf(reflect.New(t).Interface()),
+		size:   t.Elem().Size(),
+		zero:   reflect.Zero(t.Elem()),
+		elem:   parent.decoderFor(t.Elem()),
+	}
+}
+
+// Unmarshal decodes the JSON array in data into s, a pointer to a slice of the type the decoder was
+// compiled for. The slice's existing capacity is reused where possible. A *DecodeError is returned
+// should the document be invalid, and an *InvalidUnmarshalError should s be anything other than a
+// non-nil pointer to the slice.
+func (d *SliceDecoder) Unmarshal(data []byte, s interface{}) error {
+	p, err := target(s, d.ptrTyp, reflect.PtrTo(d.tt))
+	if err != nil {
+		return err
+	}
+
+	sc := getScanner(data)
+	defer putScanner(sc)
+
+	if err := d.decode(sc, p); err != nil {
+		return err
+	}
+	return sc.end()
+}
+
+// decode reads an array into the slice p points to. null sets the slice to nil.
+func (d *SliceDecoder) decode(s *scanner, p unsafe.Pointer) error {
+	h := (*sliceHeader)(p)
+	if s.null() {
+		*h = sliceHeader{}
+		return nil
+	}
+
+	if err := s.consume('['); err != nil {
+		return err
+	}
+
+	n := 0
+	dirty := h.Cap // elements beyond this have never been written, so are already zeroed
+	defer func() { h.Len = n }()
+
+	if h.Data == nil { // an empty array is an empty slice, not a nil one
+		d.grow(p, 0)
+		dirty = 0
+	}
+
+	if s.next() == ']' {
+		s.pos++
+		return nil
+	}
+
+	for {
+		if n == h.Cap {
+			d.grow(p, n)
+			dirty = n
+		}
+
+		e := unsafe.Pointer(uintptr(h.Data) + uintptr(n)*d.size)
+		if n < dirty {
+			reflect.NewAt(d.tt.Elem(), e).Elem().Set(d.zero)
+		}
+		if err := d.elem(s, e); err != nil {
+			return err
+		}
+		n++
+
+		if done, err := s.more(']'); done || err != nil {
+			return err
+		}
+	}
+}
+
+// grow moves the slice p points to onto a larger backing array, keeping its first n elements
+func (d *SliceDecoder) grow(p unsafe.Pointer, n int) {
+	v := reflect.NewAt(d.tt, p).Elem()
+
+	c := 2 * v.Cap()
+	if c < 4 {
+		c = 4
+	}
+
+	ns := reflect.MakeSlice(d.tt, c, c)
+	reflect.Copy(ns, v.Slice(0, n))
+	v.Set(ns)
+}
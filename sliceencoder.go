@@ -17,29 +17,108 @@ type SliceEncoder struct {
 	instruction func(t unsafe.Pointer, w *Buffer)
 	tt          reflect.Type
 	offset      uintptr
+	elemSize    int            // estimated length of an element, see estimate.go
+	base        *SliceEncoder  // the encoder without any Config applied, if this has one
+	how         string         // description of how elements are encoded, see Explain
+	nested      explainer      // encoder elements are delegated to
+	hooks       *hooks         // callbacks run around Marshal, see SetHooks
+	metrics     Metrics        // observes each document, see SetMetrics
+	tracer      Tracer         // traces each document, see SetTracer
+	ptrTyp      unsafe.Pointer // type pointer of a pointer to the slice, see MarshalChecked
+	version     int            // API version the encoder was compiled for, see MarshalVersion
+	esc         escapeMode     // how escaped strings are written, see Config.EscapeHTML
+	cfg         Config         // the Config applied, if base is set
 }
 
 // Marshal executes the instruction set built up by NewSliceEncoder
 func (e *SliceEncoder) Marshal(s interface{}, w *Buffer) {
+	if e.metrics != nil || e.tracer != nil || observing() {
+		observe(e.metrics, e.tracer, e.tt, (*(*iface)(unsafe.Pointer(&s))).Data, w, e.marshalPtr)
+		return
+	}
+	e.marshalPtr((*(*iface)(unsafe.Pointer(&s))).Data, w)
+}
+
+// marshalPtr is Marshal for the slice p points to, see nestedEncoder
+func (e *SliceEncoder) marshalPtr(p unsafe.Pointer, w *Buffer) {
+	if e.hooks != nil {
+		e.hooks.run(p, w, e.marshal)
+		return
+	}
+	e.marshal(p, w)
+}
+
+// run writes s using marshal in place of the encoder's instruction, i.e that of a variant of it,
+// applying the encoder's hooks and observing the document as Marshal does
+func (e *SliceEncoder) run(s interface{}, w *Buffer, marshal func(unsafe.Pointer, *Buffer)) {
+	p := (*(*iface)(unsafe.Pointer(&s))).Data
+	if e.metrics != nil || e.tracer != nil || observing() {
+		observe(e.metrics, e.tracer, e.tt, p, w, func(p unsafe.Pointer, w *Buffer) {
+			e.hooked(p, w, marshal)
+		})
+		return
+	}
+	e.hooked(p, w, marshal)
+}
+
+// hooked calls marshal within the encoder's hooks, if it has any
+func (e *SliceEncoder) hooked(p unsafe.Pointer, w *Buffer, marshal func(unsafe.Pointer, *Buffer)) {
+	if e.hooks != nil {
+		e.hooks.run(p, w, marshal)
+		return
+	}
+	marshal(p, w)
+}
+
+// marshal executes the instruction against the slice p points to
+func (e *SliceEncoder) marshal(p unsafe.Pointer, w *Buffer) {
+	if p == nil { // a nil pointer at the top level, as for nested ones
+		w.Write(null)
+		return
+	}
 
-	p := unsafe.Pointer(reflect.ValueOf(s).Pointer())
+	w.Grow(e.EstimatedSize((*sliceHeader)(p).Len))
 	e.instruction(p, w)
 }
 
 // NewSliceEncoder builds a new SliceEncoder
 func NewSliceEncoder(t interface{}) *SliceEncoder {
-	e := &SliceEncoder{}
+	return newSliceEncoder(t, allVersions, 0)
+}
+
+// newSliceEncoder builds a SliceEncoder whose elements include only the fields of the given API
+// version, see MarshalVersion, and write escaped strings as esc selects
+func newSliceEncoder(t interface{}, version int, esc escapeMode) *SliceEncoder {
+	e := &SliceEncoder{version: version, esc: esc}
 
 	e.tt = reflect.TypeOf(t)
+	e.ptrTyp = typeOf(reflect.New(e.tt).Interface())
 	e.offset = e.tt.Elem().Size()
+	e.elemSize = 1 + typicalWidth(e.tt.Elem()) // plus separator
+
+	// types with an encoder registered via RegisterTypeEncoder
+	if conv := typeEncoderFor(e.tt.Elem()); conv != nil {
+		e.convInstr(escaping(esc, conv))
+		e.how = "registered type encoder"
+		return e
+	}
+	if e.tt.Elem().Kind() == reflect.Ptr {
+		if conv := typeEncoderFor(e.tt.Elem().Elem()); conv != nil {
+			e.ptrConvInstr(escaping(esc, conv))
+			e.how = "nullable registered type encoder"
+			return e
+		}
+	}
 
 	// see if we can select based on a specific type
 	switch e.tt.Elem() {
 	case timeType:
 		e.timeInstr()
+		e.how = "time"
 		return e
 	case escapeStringType:
-		e.stringInstr(ptrEscapeStringToBuf)
+		e.stringInstr(escapers[esc].ptrEscape)
+		e.how = "escaped string"
 		return e
 	}
 
@@ -47,12 +126,19 @@ func NewSliceEncoder(t interface{}) *SliceEncoder {
 	switch e.tt.Elem().Kind() {
 	case reflect.Slice:
 		e.sliceInstr()
+		e.how = "slice"
 
 	case reflect.Struct:
 		e.structInstr()
+		e.how = "struct"
 
 	case reflect.String:
-		e.stringInstr(ptrStringToBuf)
+		if esc&escapeAll != 0 {
+			e.stringInstr(escapers[esc].ptrEscape)
+		} else {
+			e.plainStringInstr()
+		}
+		e.how = "string"
 
 	case reflect.Ptr:
 
@@ -60,37 +146,49 @@ func NewSliceEncoder(t interface{}) *SliceEncoder {
 		switch e.tt.Elem().Elem() {
 		case timeType:
 			e.ptrTimeInstr()
+			e.how = "nullable time"
 			return e
 		case escapeStringType:
-			e.ptrStringInstr(ptrEscapeStringToBuf)
+			e.ptrStringInstr(escapers[esc].ptrEscape)
+			e.how = "nullable escaped string"
 			return e
 		}
 
 		switch e.tt.Elem().Elem().Kind() {
 		case reflect.Slice:
 			e.ptrSliceInstr()
+			e.how = "nullable slice"
 
 		case reflect.Struct:
 			e.ptrStrctInstr()
+			e.how = "nullable struct"
 
 		case reflect.String:
-			e.ptrStringInstr(ptrStringToBuf)
+			if esc&escapeAll != 0 {
+				e.ptrStringInstr(escapers[esc].ptrEscape)
+			} else {
+				e.ptrStringInstr(ptrStringToBuf)
+			}
+			e.how = "nullable string"
 
 		default:
 			e.ptrOtherInstr()
+			e.how = "nullable " + e.tt.Elem().Elem().Kind().String()
 		}
 
 	default:
 		e.otherInstr()
+		e.how = e.tt.Elem().Kind().String()
 	}
 
 	return e
 }
 
-// // avoid allocs in the instruction
+// // avoid allocs in the instructions, these are shared by the struct and slice encoders
 var (
-	null = []byte("null")
-	zero = uintptr(0)
+	null     = []byte("null")
+	zero     = uintptr(0)
+	quoteSep = []byte(`","`) // separates elements of a quoted string slice
 )
 
 // sliceHeader is a replacement for reflect.SliceHeader which forces the uintptr conversion to be done inline to
@@ -102,17 +200,21 @@ type sliceHeader struct {
 }
 
 func (e *SliceEncoder) sliceInstr() {
-	enc := NewSliceEncoder(reflect.New(e.tt.Elem()).Elem().Interface())
+	enc := compileSlice(reflect.New(e.tt.Elem()).Elem().Interface(), e.version, e.esc)
+	e.nested = enc
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
 			s := unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))
-			enc.Marshal(s, w)
+			enc.marshalPtr(s, w)
 		}
 
 		w.WriteByte(']')
@@ -120,17 +222,22 @@ func (e *SliceEncoder) sliceInstr() {
 }
 
 func (e *SliceEncoder) structInstr() {
-	enc := NewStructEncoder(reflect.New(e.tt.Elem()).Elem().Interface())
+	enc, size := compileStruct(reflect.New(e.tt.Elem()).Elem().Interface(), e.version, e.esc)
+	e.nested = enc
+	e.elemSize += size
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
 			s := unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))
-			enc.Marshal(s, w)
+			enc.marshalPtr(s, w)
 		}
 
 		w.WriteByte(']')
@@ -143,13 +250,15 @@ func (e *SliceEncoder) stringInstr(conv func(unsafe.Pointer, *Buffer)) {
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
-
+			if !w.ok() {
+				return
+			}
 			if i == 0 {
 				w.WriteByte('"')
 			}
 
 			if i > zero {
-				w.Write([]byte(`","`))
+				w.Write(quoteSep)
 			}
 
 			conv(unsafe.Pointer(uintptr(sl.Data)+(i*e.offset)), w)
@@ -163,18 +272,51 @@ func (e *SliceEncoder) stringInstr(conv func(unsafe.Pointer, *Buffer)) {
 	}
 }
 
+// plainStringInstr is stringInstr for strings which aren't escaped. Nothing in them needs looking
+// at, so each is appended along with the separator before it in one go rather than a byte at a time.
+func (e *SliceEncoder) plainStringInstr() {
+	e.instruction = func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('[')
+
+		sl := *(*[]string)(v) // any named string type has the same layout
+		for i, s := range sl {
+			if !w.ok() {
+				return
+			}
+
+			sep := quoteSep
+			if i == 0 {
+				sep = quoteSep[2:] // just the opening quote
+			}
+			w.Grow(len(sep) + len(s))
+			w.Bytes = append(append(w.Bytes, sep...), s...)
+		}
+
+		if len(sl) > 0 {
+			w.WriteByte('"')
+		}
+		w.WriteByte(']')
+	}
+}
+
 func (e *SliceEncoder) otherInstr() {
 
 	conv, ok := typeconv[e.tt.Elem().Kind()]
 	if !ok {
 		return
 	}
+	e.convInstr(conv)
+}
 
+func (e *SliceEncoder) convInstr(conv func(unsafe.Pointer, *Buffer)) {
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
@@ -191,6 +333,9 @@ func (e *SliceEncoder) timeInstr() {
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
@@ -204,12 +349,16 @@ func (e *SliceEncoder) timeInstr() {
 }
 
 func (e *SliceEncoder) ptrSliceInstr() {
-	enc := NewSliceEncoder(reflect.New(e.tt.Elem()).Elem().Elem().Interface())
+	enc := compileSlice(reflect.New(e.tt.Elem()).Elem().Elem().Interface(), e.version, e.esc)
+	e.nested = enc
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
@@ -219,7 +368,7 @@ func (e *SliceEncoder) ptrSliceInstr() {
 				w.Write(null)
 				continue
 			}
-			enc.Marshal(s, w)
+			enc.marshalPtr(s, w)
 		}
 
 		w.WriteByte(']')
@@ -227,12 +376,17 @@ func (e *SliceEncoder) ptrSliceInstr() {
 }
 
 func (e *SliceEncoder) ptrStrctInstr() {
-	enc := NewStructEncoder(reflect.New(e.tt.Elem().Elem()).Elem().Interface())
+	enc, size := compileStruct(reflect.New(e.tt.Elem().Elem()).Elem().Interface(), e.version, e.esc)
+	e.nested = enc
+	e.elemSize += size
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
@@ -242,7 +396,7 @@ func (e *SliceEncoder) ptrStrctInstr() {
 				w.Write(null)
 				continue
 			}
-			enc.Marshal(s, w)
+			enc.marshalPtr(s, w)
 		}
 
 		w.WriteByte(']')
@@ -255,6 +409,9 @@ func (e *SliceEncoder) ptrStringInstr(conv func(unsafe.Pointer, *Buffer)) {
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
@@ -279,12 +436,18 @@ func (e *SliceEncoder) ptrOtherInstr() {
 	if !ok {
 		return
 	}
+	e.ptrConvInstr(conv)
+}
 
+func (e *SliceEncoder) ptrConvInstr(conv func(unsafe.Pointer, *Buffer)) {
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
@@ -307,6 +470,9 @@ func (e *SliceEncoder) ptrTimeInstr() {
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if !w.ok() {
+				return
+			}
 			if i > zero {
 				w.WriteByte(',')
 			}
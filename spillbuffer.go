@@ -0,0 +1,75 @@
+package jingo
+
+// spillbuffer.go manages spilling Buffers. These are streaming buffers bound to a temporary file
+// which is only created once the content outgrows the in-memory limit. WriteTo replays the file
+// followed by whatever is still held in memory, so documents larger than RAM can be produced by
+// batch jobs without any change to how they're written out.
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// NewSpillBuffer returns a Buffer from the pool which holds up to around `memLimit` bytes in
+// memory before spilling its content to a temporary file created in dir (or the default
+// directory for temporary files if dir is empty). WriteTo writes the whole document, spilled
+// or not. The file is removed by Reset and 'ReturnToPool', so make sure to call one of them.
+func NewSpillBuffer(memLimit int, dir string) *Buffer {
+	b := NewBufferFromPoolWithCap(memLimit)
+	b.spill = &spillFile{dir: dir}
+	b.dst = b.spill
+	b.flushAt = memLimit
+	b.mark = 0
+	return b
+}
+
+// spillFile is an io.Writer which creates its temporary file on first write
+type spillFile struct {
+	dir string
+	f   *os.File
+}
+
+func (s *spillFile) Write(p []byte) (int, error) {
+	if s.f == nil {
+		f, err := ioutil.TempFile(s.dir, "jingo-*.json")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+	}
+	return s.f.Write(p)
+}
+
+// writeTo replays the spilled content to w, leaving the file positioned for further writes
+func (s *spillFile) writeTo(w io.Writer) (int64, error) {
+	if s.f == nil {
+		return 0, nil
+	}
+
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.f)
+}
+
+// remove closes and deletes the temporary file, if there is one
+func (s *spillFile) remove() {
+	if s.f == nil {
+		return
+	}
+	s.f.Close()
+	os.Remove(s.f.Name())
+	s.f = nil
+}
+
+// writeSpillTo writes the spilled content followed by Bytes to w
+func (b *Buffer) writeSpillTo(w io.Writer) (int64, error) {
+	n, err := b.spill.writeTo(w)
+	if err != nil {
+		return n, err
+	}
+
+	m, err := w.Write(b.Bytes)
+	return n + int64(m), err
+}
@@ -0,0 +1,69 @@
+package jingo
+
+// sse.go writes Server-Sent Events frames (https://html.spec.whatwg.org/multipage/server-sent-events.html)
+// for push services, encoding each frame straight into a pooled buffer.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidEventField is returned by WriteEvent for an event or id containing a line break, which
+// would end the field early and let the rest be read as fields of its own.
+var ErrInvalidEventField = errors.New("jingo: event field contains a line break")
+
+var sseData = []byte("data: ")
+
+// WriteEvent encodes v with enc as the data of a Server-Sent Events frame, and writes the frame to
+// w with a single call to its Write. The event and id fields are written before the data when they
+// aren't empty, and should either contain a carriage return or line feed ErrInvalidEventField is
+// returned and nothing is written. Should w implement http.Flusher, as a
+// http.ResponseWriter generally does, it's flushed so the frame reaches the client straight away.
+// Any error encoding or writing the frame is returned.
+func WriteEvent(w io.Writer, event, id string, enc Encoder, v interface{}) error {
+	if strings.ContainsAny(event, "\r\n") || strings.ContainsAny(id, "\r\n") {
+		return ErrInvalidEventField
+	}
+
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	if event != "" {
+		b.WriteString("event: ")
+		b.WriteString(event)
+		b.WriteByte('\n')
+	}
+	if id != "" {
+		b.WriteString("id: ")
+		b.WriteString(id)
+		b.WriteByte('\n')
+	}
+
+	b.Write(sseData)
+	start := len(b.Bytes)
+	enc.Marshal(v, b)
+	if err := b.Err(); err != nil {
+		return err
+	}
+
+	// documents are a single line unless the encoder has a Config adding newlines, in which case
+	// each line needs its own data field
+	if doc := bytes.TrimSuffix(b.Bytes[start:], []byte{'\n'}); bytes.IndexByte(doc, '\n') >= 0 {
+		lines := bytes.ReplaceAll(doc, []byte{'\n'}, []byte("\ndata: "))
+		b.Bytes = append(b.Bytes[:start], lines...)
+	} else {
+		b.Bytes = b.Bytes[:start+len(doc)]
+	}
+	b.WriteString("\n\n")
+
+	if _, err := w.Write(b.Bytes); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package jingo
+
+// streamingbuffer.go manages streaming Buffers. A streaming buffer is bound to an io.Writer and
+// flushes its content to it as the encoders work through a document, so a document of any size
+// can be encoded within a bounded amount of memory. MarshalChunks hands each flush to a callback
+// rather than a writer, and MarshalReader to a pipe.
+
+import (
+	"io"
+)
+
+// NewStreamingBuffer returns a Buffer from the pool which flushes its content to w each time it
+// grows beyond `threshold` bytes while being written to by the encoders. Call Flush once you're
+// done writing to make sure the remainder reaches w, then 'ReturnToPool'. Write errors from w
+// abandon the document and are reported by Flush and Err.
+func NewStreamingBuffer(w io.Writer, threshold int) *Buffer {
+	b := NewBufferFromPoolWithCap(threshold)
+	b.dst = w
+	b.flushAt = threshold
+	b.mark = 0
+	return b
+}
+
+// Flush writes any content held in Bytes to the writer a streaming buffer is bound to. It's a
+// no-op for any other buffer.
+func (b *Buffer) Flush() error {
+	if b.dst == nil || b.err != nil {
+		return b.err
+	}
+
+	b.flush()
+	return b.err
+}
+
+// flush writes Bytes to dst and empties it
+func (b *Buffer) flush() {
+	if len(b.Bytes) == 0 {
+		return
+	}
+
+	if b.hash != nil {
+		b.hashPending()
+	}
+
+	n, err := b.dst.Write(b.Bytes)
+	b.off += n
+	b.Bytes = b.Bytes[:0]
+	b.hashed = 0
+
+	if err != nil {
+		b.err = err
+		b.mark = 0
+		return
+	}
+
+	if b.lender != nil {
+		b.borrow()
+	}
+}
+
+// chunkFunc adapts a chunk callback to the io.Writer a streaming buffer flushes to
+type chunkFunc func(chunk []byte) error
+
+func (f chunkFunc) Write(p []byte) (int, error) {
+	if err := f(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// MarshalChunks encodes v using enc, calling fn with the content each time at least n bytes of it
+// have built up, and once more with the remainder, e.g to send a large document as a series of
+// WebSocket frames without holding all of it. Chunks are cut between values so may run past n by
+// one value. A chunk is only valid for the duration of the call, fn must copy it to keep it.
+// Encoding stops at the first error fn returns, which is returned along with any encoding error.
+func MarshalChunks(enc Encoder, v interface{}, n int, fn func(chunk []byte) error) error {
+	b := NewStreamingBuffer(chunkFunc(fn), n)
+	enc.Marshal(v, b)
+	err := b.Flush()
+	b.ReturnToPool()
+	return err
+}
+
+// MarshalReader returns a reader of the encoding of v by enc, e.g to hand a document to an API
+// which uploads from an io.Reader without holding all of it. The document is encoded by a goroutine
+// into a pipe, in chunks, as the reader is read, so v mustn't be modified until the reader reaches
+// EOF or is closed. Encoding errors are returned by Read. Closing the reader early stops the
+// encoding, and the reader must be read to the end or closed for the goroutine to finish.
+func MarshalReader(enc Encoder, v interface{}) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(marshalStream(pw, enc, v))
+	}()
+	return pr
+}
@@ -0,0 +1,349 @@
+package jingo
+
+// structdecoder.go manages StructDecoder, the decoding counterpart to StructEncoder. It follows the
+// same principle of compiling a set of instructions up-front, one per field, which write directly
+// to the field's offset in the destination struct when a document is decoded. Fields are included
+// using the same json tag conventions as the encoders, and keys are matched exactly.
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+// StructDecoder stores a set of instructions for decoding a JSON document into a struct.
+type StructDecoder struct {
+	t      interface{}
+	ptrTyp unsafe.Pointer // type pointer of *t, which Unmarshal checks its destination against
+	fields []fieldDecoder
+	intern bool // whether strings of the field being compiled are interned, see intern.go
+}
+
+// fieldDecoder is the instruction for a single field
+type fieldDecoder struct {
+	key    string
+	offset uintptr
+	decode func(s *scanner, p unsafe.Pointer) error
+}
+
+// NewStructDecoder compiles a set of instructions for decoding JSON documents into the struct t.
+func NewStructDecoder(t interface{}) *StructDecoder {
+	tt := reflect.TypeOf(t)
+	d := &StructDecoder{t: t, ptrTyp: typeOf(reflect.New(tt).Interface())}
+
+	for i := 0; i < tt.NumField(); i++ {
+		f := tt.Field(i)
+
+		tag, opts := parseTag(f.Tag.Get("json"))
+		if tag == "" {
+			continue
+		}
+
+		d.intern = opts.Contains("intern")
+		d.fields = append(d.fields, fieldDecoder{key: tag, offset: f.Offset, decode: d.decoderFor(f.Type)})
+		d.intern = false
+	}
+
+	return d
+}
+
+// Unmarshal decodes the JSON document in data into s, a pointer to the struct the decoder was
+// compiled for. Fields without a key in the document are left as they are, and keys without a
+// field are ignored. A *DecodeError is returned should the document be invalid, and an
+// *InvalidUnmarshalError should s be anything other than a non-nil pointer to the struct.
+func (d *StructDecoder) Unmarshal(data []byte, s interface{}) error {
+	p, err := target(s, d.ptrTyp, reflect.PtrTo(reflect.TypeOf(d.t)))
+	if err != nil {
+		return err
+	}
+
+	sc := getScanner(data)
+	defer putScanner(sc)
+
+	if err := d.decode(sc, p); err != nil {
+		return err
+	}
+	return sc.end()
+}
+
+// decode reads an object into the struct p points to
+func (d *StructDecoder) decode(s *scanner, p unsafe.Pointer) error {
+	if err := s.consume('{'); err != nil {
+		return err
+	}
+	if s.next() == '}' {
+		s.pos++
+		return nil
+	}
+
+	next := 0 // keys tend to arrive in the order the fields are declared, so look there first
+	for {
+		k, err := s.string()
+		if err != nil {
+			return err
+		}
+		if err := s.consume(':'); err != nil {
+			return err
+		}
+
+		if i := d.field(k, next); i >= 0 {
+			if err := d.fields[i].decode(s, unsafe.Pointer(uintptr(p)+d.fields[i].offset)); err != nil {
+				return err
+			}
+			next = i + 1
+		} else if err := s.skip(); err != nil {
+			return err
+		}
+
+		if done, err := s.more('}'); done || err != nil {
+			return err
+		}
+	}
+}
+
+// field returns the index of the field for key k, or -1 if there isn't one
+func (d *StructDecoder) field(k []byte, next int) int {
+	if next < len(d.fields) && d.fields[next].key == string(k) {
+		return next
+	}
+	for i := range d.fields {
+		if d.fields[i].key == string(k) {
+			return i
+		}
+	}
+	return -1
+}
+
+// decoderFor returns the instruction which decodes a value of type t
+func (d *StructDecoder) decoderFor(t reflect.Type) func(*scanner, unsafe.Pointer) error {
+	if t == timeType {
+		return decodeTime
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if d.intern {
+			return decodeInternedString
+		}
+		return decodeString
+	case reflect.Bool:
+		return decodeBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return intDecoder(t.Kind())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uintDecoder(t.Kind())
+	case reflect.Float32, reflect.Float64:
+		return floatDecoder(t.Kind())
+
+	case reflect.Struct:
+		if t == reflect.TypeOf(d.t) {
+			// handle recursive structs by re-using the current decoder
+			return d.decode
+		}
+		return NewStructDecoder(reflect.New(t).Elem().Interface()).decode
+
+	case reflect.Slice:
+		return newSliceDecoder(t, d).decode
+
+	case reflect.Array:
+		return arrayDecoder(t.Len(), t.Elem().Size(), d.decoderFor(t.Elem()))
+
+	case reflect.Ptr:
+		return ptrDecoder(t.Elem(), d.decoderFor(t.Elem()))
+	}
+
+	panic(compileError(fmt.Sprint("unsupported type ", t.Kind())))
+}
+
+// ptrDecoder wraps dec to decode into the value a pointer of type *t points to, allocating it if
+// needed. null sets the pointer to nil.
+func ptrDecoder(t reflect.Type, dec func(*scanner, unsafe.Pointer) error) func(*scanner, unsafe.Pointer) error {
+	return func(s *scanner, p unsafe.Pointer) error {
+		if s.null() {
+			*(*unsafe.Pointer)(p) = nil
+			return nil
+		}
+
+		v := *(*unsafe.Pointer)(p)
+		if v == nil {
+			v = unsafe.Pointer(reflect.New(t).Pointer())
+			*(*unsafe.Pointer)(p) = v
+		}
+		return dec(s, v)
+	}
+}
+
+// arrayDecoder decodes an array of n elements of the given size with dec. Surplus elements in the
+// document are ignored.
+func arrayDecoder(n int, size uintptr, dec func(*scanner, unsafe.Pointer) error) func(*scanner, unsafe.Pointer) error {
+	return func(s *scanner, p unsafe.Pointer) error {
+		if s.null() {
+			return nil
+		}
+		if err := s.consume('['); err != nil {
+			return err
+		}
+		if s.next() == ']' {
+			s.pos++
+			return nil
+		}
+
+		for i := 0; ; i++ {
+			var err error
+			if i < n {
+				err = dec(s, unsafe.Pointer(uintptr(p)+uintptr(i)*size))
+			} else {
+				err = s.skip()
+			}
+			if err != nil {
+				return err
+			}
+
+			if done, err := s.more(']'); done || err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func decodeString(s *scanner, p unsafe.Pointer) error {
+	if s.null() {
+		return nil
+	}
+	b, err := s.string()
+	if err != nil {
+		return err
+	}
+	*(*string)(p) = string(b)
+	return nil
+}
+
+func decodeBool(s *scanner, p unsafe.Pointer) error {
+	if s.null() {
+		return nil
+	}
+	v, err := s.bool()
+	if err != nil {
+		return err
+	}
+	*(*bool)(p) = v
+	return nil
+}
+
+func decodeTime(s *scanner, p unsafe.Pointer) error {
+	if s.null() {
+		return nil
+	}
+	start := s.pos
+	b, err := s.string()
+	if err != nil {
+		return err
+	}
+	v, err := time.Parse(time.RFC3339Nano, string(b))
+	if err != nil {
+		return &DecodeError{Offset: start, Msg: err.Error()}
+	}
+	*(*time.Time)(p) = v
+	return nil
+}
+
+func intDecoder(k reflect.Kind) func(*scanner, unsafe.Pointer) error {
+	bits := bitSize[k]
+	return func(s *scanner, p unsafe.Pointer) error {
+		if s.null() {
+			return nil
+		}
+		start := s.pos
+		b, err := s.number()
+		if err != nil {
+			return err
+		}
+
+		v, err := strconv.ParseInt(string(b), 10, bits)
+		if err != nil {
+			return &DecodeError{Offset: start, Msg: err.Error()}
+		}
+
+		switch k {
+		case reflect.Int:
+			*(*int)(p) = int(v)
+		case reflect.Int8:
+			*(*int8)(p) = int8(v)
+		case reflect.Int16:
+			*(*int16)(p) = int16(v)
+		case reflect.Int32:
+			*(*int32)(p) = int32(v)
+		default:
+			*(*int64)(p) = v
+		}
+		return nil
+	}
+}
+
+func uintDecoder(k reflect.Kind) func(*scanner, unsafe.Pointer) error {
+	bits := bitSize[k]
+	return func(s *scanner, p unsafe.Pointer) error {
+		if s.null() {
+			return nil
+		}
+		start := s.pos
+		b, err := s.number()
+		if err != nil {
+			return err
+		}
+
+		v, err := strconv.ParseUint(string(b), 10, bits)
+		if err != nil {
+			return &DecodeError{Offset: start, Msg: err.Error()}
+		}
+
+		switch k {
+		case reflect.Uint:
+			*(*uint)(p) = uint(v)
+		case reflect.Uint8:
+			*(*uint8)(p) = uint8(v)
+		case reflect.Uint16:
+			*(*uint16)(p) = uint16(v)
+		case reflect.Uint32:
+			*(*uint32)(p) = uint32(v)
+		default:
+			*(*uint64)(p) = v
+		}
+		return nil
+	}
+}
+
+func floatDecoder(k reflect.Kind) func(*scanner, unsafe.Pointer) error {
+	bits := bitSize[k]
+	return func(s *scanner, p unsafe.Pointer) error {
+		if s.null() {
+			return nil
+		}
+		start := s.pos
+		b, err := s.number()
+		if err != nil {
+			return err
+		}
+
+		v, err := strconv.ParseFloat(string(b), bits)
+		if err != nil {
+			return &DecodeError{Offset: start, Msg: err.Error()}
+		}
+
+		if k == reflect.Float32 {
+			*(*float32)(p) = float32(v)
+		} else {
+			*(*float64)(p) = v
+		}
+		return nil
+	}
+}
+
+// bitSize holds the size of each numeric kind, as strconv expects
+var bitSize = map[reflect.Kind]int{
+	reflect.Int: strconv.IntSize, reflect.Int8: 8, reflect.Int16: 16, reflect.Int32: 32, reflect.Int64: 64,
+	reflect.Uint: strconv.IntSize, reflect.Uint8: 8, reflect.Uint16: 16, reflect.Uint32: 32, reflect.Uint64: 64,
+	reflect.Float32: 32, reflect.Float64: 64,
+}
@@ -8,6 +8,7 @@ package jingo
 // `.String()` stringer functionality which is somewhat out of our control.
 
 import (
+	"encoding"
 	"fmt"
 	"io"
 	"reflect"
@@ -17,9 +18,10 @@ import (
 )
 
 // instruction describes the different ways we can execute a single instruction at runtime.
-// static, leapFun/offset, fun are mutually exclusive. we've used a concrete type for speed.
+// leapFun/offset, fun are mutually exclusive. we've used a concrete type for speed. static is
+// either the whole instruction, for kindStatic, or written after the value, see fuse.
 type instruction struct {
-	static  []byte                        // provides a fast path for writing static chunks without needing an instruction function
+	static  []byte                        // static chunk, on its own or following the value
 	kind    int                           // used to switch special paths in Marshal, like string fast path
 	offset  uintptr                       // used in conjunction with leapFun
 	leapFun func(unsafe.Pointer, *Buffer) // provides a fast path for simple write & avoids wrapping function to capture offset
@@ -38,197 +40,546 @@ type iface struct {
 	Type, Data unsafe.Pointer
 }
 
+// Encoder is implemented by each of the compiled encoders, allowing them to be held side by side.
+// The value passed to Marshal must be a pointer to the type the encoder was compiled for.
+type Encoder interface {
+	Marshal(interface{}, *Buffer)
+}
+
+var (
+	_ Encoder = &StructEncoder{}
+	_ Encoder = &SliceEncoder{}
+)
+
 // StructEncoder stores a set of instructions for converting a struct to a json document. It's
-// useless to create an instance of this outside of `NewStructEncoder`.
+// useless to create an instance of this outside of `NewStructEncoder`. Once compiled an encoder is
+// only ever read, so Marshal and its variants may be called on one instance from any number of
+// goroutines at once.
 type StructEncoder struct {
-	instructions []instruction       // the instructionset to be executed during Marshal
-	f            reflect.StructField // current field
-	t            interface{}         // type
-	i            int                 // iter
-	cb           Buffer              // side buffer for static data
-	cpos         int                 // side buffer position
+	instructions []instruction   // the instructionset to be executed during Marshal
+	t            interface{}     // type
+	size         int             // estimated length of a document, see estimate.go
+	base         *StructEncoder  // the encoder without any Config applied, if this has one
+	plan         []fieldPlan     // description of how each field is encoded, see Explain
+	hooks        *hooks          // callbacks run around Marshal, see SetHooks
+	metrics      Metrics         // observes each document, see SetMetrics
+	tracer       Tracer          // traces each document, see SetTracer
+	typ, ptrTyp  unsafe.Pointer  // type pointers of the struct and a pointer to it, see MarshalChecked
+	version      int             // API version the encoder was compiled for, see MarshalVersion
+	esc          escapeMode      // how escaped strings are written, see Config.EscapeHTML
+	cfg          Config          // the Config applied, if base is set
+	mask         map[string]bool // keys of the fields to compile, if not all, see CompileMask
+}
+
+// structBuilder holds the state which is only needed while compiling the instructions into e. It's
+// kept apart from the encoder, with the compiling methods on it rather than the encoder, and dropped
+// when compile returns, so nothing a published encoder holds changes once it's in use.
+type structBuilder struct {
+	e      *StructEncoder      // encoder being compiled
+	f      reflect.StructField // current field
+	i      int                 // iter
+	cb     Buffer              // side buffer for static data
+	cpos   int                 // side buffer position
+	how    string              // description of the current field
+	nested explainer           // encoder the current field is delegated to
 }
 
 // Marshal executes the instructions for a given type and writes the resulting
 // json document to the io.Writer provided
 func (e *StructEncoder) Marshal(s interface{}, w *Buffer) {
+	if e.metrics != nil || e.tracer != nil || observing() {
+		observe(e.metrics, e.tracer, reflect.TypeOf(e.t), (*(*iface)(unsafe.Pointer(&s))).Data, w, e.marshalPtr)
+		return
+	}
+	e.marshalPtr((*(*iface)(unsafe.Pointer(&s))).Data, w)
+}
 
+// marshalPtr is Marshal for the struct p points to, see nestedEncoder
+func (e *StructEncoder) marshalPtr(p unsafe.Pointer, w *Buffer) {
+	if e.hooks != nil {
+		e.hooks.run(p, w, e.marshal)
+		return
+	}
+	e.marshal(p, w)
+}
+
+// run writes s using marshal in place of the encoder's instructions, i.e those of a variant of it,
+// applying the encoder's hooks and observing the document as Marshal does
+func (e *StructEncoder) run(s interface{}, w *Buffer, marshal func(unsafe.Pointer, *Buffer)) {
 	p := (*(*iface)(unsafe.Pointer(&s))).Data
+	if e.metrics != nil || e.tracer != nil || observing() {
+		observe(e.metrics, e.tracer, reflect.TypeOf(e.t), p, w, func(p unsafe.Pointer, w *Buffer) {
+			e.hooked(p, w, marshal)
+		})
+		return
+	}
+	e.hooked(p, w, marshal)
+}
 
+// hooked calls marshal within the encoder's hooks, if it has any
+func (e *StructEncoder) hooked(p unsafe.Pointer, w *Buffer, marshal func(unsafe.Pointer, *Buffer)) {
+	if e.hooks != nil {
+		e.hooks.run(p, w, marshal)
+		return
+	}
+	marshal(p, w)
+}
+
+// marshal executes the instructions against the struct p points to
+func (e *StructEncoder) marshal(p unsafe.Pointer, w *Buffer) {
+	var at int
+	e.marshalAt(p, w, &at)
+}
+
+// marshalAt is marshal, storing the index of each instruction to at before it's executed so that
+// MarshalSafe can tell which field panicked. at is left at -1 outside of the loop.
+func (e *StructEncoder) marshalAt(p unsafe.Pointer, w *Buffer, at *int) {
+	*at = -1
+
+	if !w.ok() { // the buffer has been abandoned, see Buffer.SetLimit
+		return
+	}
+
+	if p == nil { // a nil pointer at the top level, as for nested ones
+		w.Write(null)
+		return
+	}
+
+	w.Grow(e.size)
+
+	// structs of only strings and numbers were tried with a loop of their own which skipped the
+	// checks they never need, but branch prediction already makes those checks close to free and
+	// it measured no faster. Go can't generate a closure per shape, so this loop is as flat as it gets.
 	for i := 0; i < len(e.instructions); i++ {
+		*at = i
 
 		if e.instructions[i].kind == kindStatic { // static data fast path
 			w.Write(e.instructions[i].static)
 			continue
-		} else if e.instructions[i].kind == kindStringField { // string fields fast path, allows inlining of whole write
-			ptrStringToBuf(unsafe.Pointer(uintptr(p)+e.instructions[i].offset), w)
+		} else if e.instructions[i].kind == kindStringField { // string fields fast path, writes the value and static data together
+			writeFused(w, *(*string)(unsafe.Pointer(uintptr(p) + e.instructions[i].offset)), e.instructions[i].static)
 			continue
 		} else if e.instructions[i].kind == kindInt { // int fields fast path, allows inlining of whole write
 			ptrIntToBuf(unsafe.Pointer(uintptr(p)+e.instructions[i].offset), w)
-			continue
 		} else if e.instructions[i].leapFun != nil { // simple 'conv' function fast path
 			e.instructions[i].leapFun(unsafe.Pointer(uintptr(p)+e.instructions[i].offset), w)
-			continue
+		} else {
+			e.instructions[i].fun(p, w) // all other instruction types
 		}
 
-		e.instructions[i].fun(p, w) // all other instruction types
+		w.Write(e.instructions[i].static) // static data following the value, see fuse
 	}
+	*at = -1
 }
 
 // NewStructEncoder compiles a set of instructions for marhsaling a struct shape to a JSON document.
 func NewStructEncoder(t interface{}) *StructEncoder {
-	e := &StructEncoder{}
-	e.t = t
+	precompile(reflect.TypeOf(t), allVersions, 0)
+	return newStructEncoder(t, allVersions, 0)
+}
+
+// newStructEncoder compiles a StructEncoder including only the fields of the given API version, see
+// MarshalVersion, which writes escaped strings as esc selects
+func newStructEncoder(t interface{}, version int, esc escapeMode) *StructEncoder {
+	e := &StructEncoder{version: version, esc: esc}
+	e.compile(t)
+	return e
+}
+
+// compile builds the instructions for t
+func (e *StructEncoder) compile(t interface{}) {
+	(&structBuilder{e: e}).compile(t)
+}
+
+// compile builds the instructions for t into the encoder being compiled
+func (b *structBuilder) compile(t interface{}) {
+	b.e.t = t
 	tt := reflect.TypeOf(t)
+	b.e.typ, b.e.ptrTyp = typeOf(t), typeOf(reflect.New(tt).Interface())
 
-	e.chunk("{")
+	b.chunk("{")
 
 	emit := 0 // track number of fields we emit
 	// pass over each field in the struct to build up our instruction set for each
-	for e.i = 0; e.i < tt.NumField(); e.i++ {
-		e.f = tt.Field(e.i)
+	for b.i = 0; b.i < tt.NumField(); b.i++ {
+		b.f = tt.Field(b.i)
 
-		tag, opts := parseTag(e.f.Tag.Get("json")) // we're using tags to nominate inclusion
+		tag, opts := parseTag(b.f.Tag.Get("json")) // we're using tags to nominate inclusion
 		if tag == "" {
+			b.e.plan = append(b.e.plan, fieldPlan{name: b.f.Name, how: "skipped, no json tag"})
+			continue
+		}
+		if !opts.inVersion(b.e.version) {
+			b.e.plan = append(b.e.plan, fieldPlan{name: b.f.Name, how: fmt.Sprintf("skipped, not in version %d", b.e.version)})
+			continue
+		}
+		if b.e.mask != nil && !b.e.mask[tag] {
+			b.e.plan = append(b.e.plan, fieldPlan{name: b.f.Name, how: "skipped, not in mask"})
 			continue
 		}
 		emit++
 
 		// write the key
 		if emit > 1 {
-			e.chunk(",")
+			b.chunk(",")
 		}
-		e.chunk(`"` + tag + `":`)
+		b.chunk(`"` + tag + `":`)
 
 		switch {
 		/// support calling .String() when the 'stringer' option is passed
-		case opts.Contains("stringer") && reflect.ValueOf(e.t).Field(e.i).MethodByName("String").Kind() != reflect.Invalid:
-			e.optInstrStringer()
+		case opts.Contains("stringer") && reflect.ValueOf(b.e.t).Field(b.i).MethodByName("String").Kind() != reflect.Invalid:
+			b.optInstrStringer()
+			b.how = "quoted String() via fmt.Stringer"
+
+		/// support calling .AppendText([]byte) or .MarshalText() when the 'text' option is passed
+		case opts.Contains("text") && isText(b.f.Type):
+			b.optInstrText()
 
 		/// support calling .JSONEncode(*Buffer) when the 'encoder' option is passed
 		case opts.Contains("encoder"):
 
 			// requrie explicit opt-in for JSONMarshaler implementation
-			t := reflect.ValueOf(e.t).Field(e.i).Type()
+			t := reflect.ValueOf(b.e.t).Field(b.i).Type()
 			if t.Kind() != reflect.Ptr {
 				t = reflect.PtrTo(t)
 			}
 
 			if _, ok := t.MethodByName("EncodeJSON"); ok {
-				e.optInstrEncoderWriter()
+				b.optInstrEncoderWriter()
+				b.how = "EncodeJSON(io.Writer) via JSONMarshaler"
 				break
 			}
 
 			// default to JSONEncoder implementation for any other encoder fields
-			e.optInstrEncoder()
+			b.optInstrEncoder()
+			b.how = "JSONEncode(*Buffer) via JSONEncoder"
 
 		/// support writing byteslice-like items using 'raw' option.
 		case opts.Contains("raw"):
-			e.optInstrRaw()
+			b.optInstrRaw()
+			b.how = "raw bytes"
 
 		/// suport escaping reserved json characters from byteslice-like items and slices
 		case opts.Contains("escape"):
-			e.optInstrEscape()
+			b.optInstrEscape()
+
+		/// support writing bools and numbers as strings when the 'string' option is passed
+		case opts.Contains("string") && quotable(b.f.Type):
+			b.optInstrString()
+
+		/// types with an encoder registered via RegisterTypeEncoder
+		case typeEncoderFor(b.f.Type) != nil:
+			b.val(escaping(b.e.esc, typeEncoderFor(b.f.Type)))
+			b.how = "registered type encoder"
+		case b.f.Type.Kind() == reflect.Ptr && typeEncoderFor(b.f.Type.Elem()) != nil:
+			b.ptrval(escaping(b.e.esc, typeEncoderFor(b.f.Type.Elem())))
+			b.how = "registered type encoder"
 
 		/// time is a type of struct, not a kind, so somewhat of a special case here.
-		case e.f.Type == timeType:
-			e.chunk(`"`)
-			e.val(ptrTimeToBuf)
-			e.chunk(`"`)
-		case e.f.Type.Kind() == reflect.Ptr && timeType == reflect.TypeOf(e.t).Field(e.i).Type.Elem():
-			e.ptrstringval(ptrTimeToBuf)
+		case b.f.Type == timeType:
+			b.chunk(`"`)
+			b.val(ptrTimeToBuf)
+			b.chunk(`"`)
+			b.how = "time"
+		case b.f.Type.Kind() == reflect.Ptr && timeType == reflect.TypeOf(b.e.t).Field(b.i).Type.Elem():
+			b.ptrstringval(ptrTimeToBuf)
+			b.how = "time"
 
 		// write the value instruction depending on type
-		case e.f.Type.Kind() == reflect.Ptr:
+		case b.f.Type.Kind() == reflect.Ptr:
 			// create an instruction which can read from a pointer field
-			e.valueInst(e.f.Type.Elem().Kind(), e.ptrval)
+			b.valueInst(b.f.Type.Elem().Kind(), b.ptrval)
 
 		default:
 			// create an instruction which reads from a standard field
-			e.valueInst(e.f.Type.Kind(), e.val)
+			b.valueInst(b.f.Type.Kind(), b.val)
+		}
+
+		b.e.size += typicalWidth(b.f.Type)
+
+		if b.f.Type.Kind() == reflect.Ptr {
+			b.how = "nullable " + b.how
 		}
+		b.e.plan = append(b.e.plan, fieldPlan{name: b.f.Name, key: tag, how: b.how, nested: b.nested, end: len(b.e.instructions),
+			offset: b.f.Offset, size: b.f.Type.Size(), inline: b.f.Type.Kind() == reflect.Struct, value: &fieldValue{e: b.e, key: tag}})
+		b.how, b.nested = "", nil
 	}
 
-	e.chunk("}")
-	e.flunk()
+	b.chunk("}")
+	b.flunk()
+	b.e.fuse()
+}
 
-	return e
+// fuse folds each static instruction into the value instruction before it, which writes the static
+// data after its value. Documents alternate between the two, so this roughly halves the number of
+// instructions Marshal has to step through.
+func (e *StructEncoder) fuse() {
+	moved := make([]int, len(e.instructions)) // new index of each instruction
+	n := 0
+	for i, in := range e.instructions {
+		if in.kind == kindStatic && n > 0 && e.instructions[n-1].kind != kindStatic && e.instructions[n-1].static == nil {
+			e.instructions[n-1].static = in.static
+			moved[i] = n - 1
+			continue
+		}
+		e.instructions[n] = in
+		moved[i] = n
+		n++
+	}
+	e.instructions = e.instructions[:n]
+
+	for i := range e.plan {
+		if e.plan[i].end > 0 {
+			e.plan[i].end = moved[e.plan[i].end-1] + 1
+		}
+	}
+}
+
+// writeFused writes s followed by the static data fused after it, with a single capacity check
+// rather than one for each
+func writeFused(w *Buffer, s string, static []byte) {
+	l, n := len(w.Bytes), len(s)+len(static)
+	if cap(w.Bytes)-l < n {
+		w.WriteString(s)
+		w.Write(static)
+		return
+	}
+
+	b := w.Bytes[:l+n]
+	copy(b[l+copy(b[l:], s):], static)
+	w.Bytes = b
 }
 
 func (e *StructEncoder) appendInstructionFun(fun func(unsafe.Pointer, *Buffer)) {
 	e.instructions = append(e.instructions, instruction{fun: fun})
 }
 
-func (e *StructEncoder) optInstrStringer() {
-	e.chunk(`"`)
+func (b *structBuilder) optInstrStringer() {
+	b.chunk(`"`)
 
-	t := reflect.ValueOf(e.t).Field(e.i).Type()
-	if e.f.Type.Kind() == reflect.Ptr {
+	t := reflect.ValueOf(b.e.t).Field(b.i).Type()
+	if b.f.Type.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
 
+	// bind the method once here rather than going through reflect on each call, see bind
+	proto, ok := reflect.New(t).Interface().(fmt.Stringer)
 	conv := func(v unsafe.Pointer, w *Buffer) {
-		e, ok := reflect.NewAt(t, v).Interface().(fmt.Stringer)
 		if !ok {
 			return
 		}
-		w.WriteString(e.String())
+		s := proto
+		bind(unsafe.Pointer(&s), v)
+		w.WriteString(s.String()) // appended as a string, so there's no []byte conversion to allocate
+	}
+	if b.e.esc&escapeAll != 0 {
+		esc := escapers[b.e.esc]
+		conv = func(v unsafe.Pointer, w *Buffer) {
+			if !ok {
+				return
+			}
+			s := proto
+			bind(unsafe.Pointer(&s), v)
+			esc.escape(s.String(), w)
+		}
 	}
 
-	if e.f.Type.Kind() == reflect.Ptr {
-		e.ptrval(conv)
+	if b.f.Type.Kind() == reflect.Ptr {
+		b.ptrval(conv)
 	} else {
-		e.val(conv)
+		b.val(conv)
 	}
 
-	e.chunk(`"`)
+	b.chunk(`"`)
 }
 
-func (e *StructEncoder) optInstrEncoder() {
-	t := reflect.ValueOf(e.t).Field(e.i).Type()
-	if e.f.Type.Kind() == reflect.Ptr {
+func (b *structBuilder) optInstrEncoder() {
+	t := reflect.ValueOf(b.e.t).Field(b.i).Type()
+	if b.f.Type.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
 
+	proto, ok := reflect.New(t).Interface().(JSONEncoder)
 	conv := func(v unsafe.Pointer, w *Buffer) {
-		e, ok := reflect.NewAt(t, v).Interface().(JSONEncoder)
 		if !ok {
 			w.Write(null)
 			return
 		}
-		e.JSONEncode(w)
+		enc := proto
+		bind(unsafe.Pointer(&enc), v)
+		enc.JSONEncode(w)
 	}
+	conv = escaping(b.e.esc, conv)
 
-	if e.f.Type.Kind() == reflect.Ptr {
-		e.ptrval(conv)
+	if b.f.Type.Kind() == reflect.Ptr {
+		b.ptrval(conv)
 	} else {
-		e.val(conv)
+		b.val(conv)
 	}
 }
 
-func (e *StructEncoder) optInstrEncoderWriter() {
-	t := reflect.ValueOf(e.t).Field(e.i).Type()
-	if e.f.Type.Kind() == reflect.Ptr {
+func (b *structBuilder) optInstrEncoderWriter() {
+	t := reflect.ValueOf(b.e.t).Field(b.i).Type()
+	if b.f.Type.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
 
+	proto, ok := reflect.New(t).Interface().(JSONMarshaler)
 	conv := func(v unsafe.Pointer, w *Buffer) {
-		e, ok := reflect.NewAt(t, v).Interface().(JSONMarshaler)
 		if !ok {
 			w.Write(null)
 			return
 		}
-		e.EncodeJSON(w)
+		enc := proto
+		bind(unsafe.Pointer(&enc), v)
+		enc.EncodeJSON(w)
+	}
+	conv = escaping(b.e.esc, conv)
+
+	if b.f.Type.Kind() == reflect.Ptr {
+		b.ptrval(conv)
+	} else {
+		b.val(conv)
+	}
+}
+
+// escaping wraps fn, a custom encoder, so that strings it writes with WriteQuotedString are escaped
+// as esc selects, as those of the encoder it's part of are
+func escaping(esc escapeMode, fn func(unsafe.Pointer, *Buffer)) func(unsafe.Pointer, *Buffer) {
+	if esc == 0 {
+		return fn
+	}
+	return func(v unsafe.Pointer, w *Buffer) {
+		prev := w.esc
+		w.esc = esc
+		fn(v, w)
+		w.esc = prev
+	}
+}
+
+// quotable reports whether fields of type t, or the type t points to, are written as strings by the
+// `,string` option. As with encoding/json that's bools and numbers, strings aren't quoted twice.
+func quotable(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Bool {
+		return true
+	}
+	_, ok := bitSize[t.Kind()]
+	return ok
+}
+
+func (b *structBuilder) optInstrString() {
+	k := b.f.Type.Kind()
+	if k == reflect.Ptr {
+		k = b.f.Type.Elem().Kind()
+	}
+	b.how = "quoted " + k.String()
+
+	if k == reflect.Bool {
+		if b.f.Type.Kind() == reflect.Ptr {
+			b.ptrval(ptrQuotedBoolToBuf)
+		} else {
+			b.val(ptrQuotedBoolToBuf)
+		}
+		return
+	}
+
+	if b.f.Type.Kind() == reflect.Ptr {
+		b.ptrstringval(typeconv[k])
+		return
+	}
+	b.chunk(`"`)
+	b.val(typeconv[k])
+	b.chunk(`"`)
+}
+
+// textAppender is encoding.TextAppender, which is preferred over encoding.TextMarshaler as the text
+// is appended straight to the buffer rather than returned in a new slice
+type textAppender interface {
+	AppendText(b []byte) ([]byte, error)
+}
+
+// isText reports whether fields of type t, or the type t points to, can be written as text
+func isText(t reflect.Type) bool {
+	if t.Kind() != reflect.Ptr {
+		t = reflect.PtrTo(t)
+	}
+	return t.Implements(textAppenderType) || t.Implements(textMarshalerType)
+}
+
+var (
+	textAppenderType  = reflect.TypeOf((*textAppender)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (b *structBuilder) optInstrText() {
+	t := reflect.ValueOf(b.e.t).Field(b.i).Type()
+	if b.f.Type.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	esc := escapers[b.e.esc]
+	var conv func(unsafe.Pointer, *Buffer)
+	if proto, ok := reflect.New(t).Interface().(textAppender); ok {
+		b.how = "quoted AppendText([]byte) via encoding.TextAppender"
+		conv = func(v unsafe.Pointer, w *Buffer) {
+			a := proto
+			bind(unsafe.Pointer(&a), v)
+
+			w.WriteByte('"')
+			start := len(w.Bytes)
+			b, err := a.AppendText(w.Bytes)
+			if err != nil {
+				w.Bytes = w.Bytes[:start-1]
+				w.fail(err)
+				return
+			}
+			w.Bytes = b
+			if !esc.plain(b[start:]) { // rare, so escape a copy rather than in place
+				s := getScratch()
+				s.Write(b[start:])
+				w.Bytes = w.Bytes[:start]
+				esc.escape(s.UnsafeString(), w)
+				putScratch(s)
+			}
+			w.WriteByte('"')
+		}
+	} else {
+		proto := reflect.New(t).Interface().(encoding.TextMarshaler)
+		b.how = "quoted MarshalText() via encoding.TextMarshaler"
+		conv = func(v unsafe.Pointer, w *Buffer) {
+			m := proto
+			bind(unsafe.Pointer(&m), v)
+
+			b, err := m.MarshalText()
+			if err != nil {
+				w.fail(err)
+				return
+			}
+			w.WriteByte('"')
+			esc.escape(*(*string)(unsafe.Pointer(&b)), w) // b is ours and only read
+			w.WriteByte('"')
+		}
 	}
 
-	if e.f.Type.Kind() == reflect.Ptr {
-		e.ptrval(conv)
+	if b.f.Type.Kind() == reflect.Ptr {
+		b.ptrval(conv)
 	} else {
-		e.val(conv)
+		b.val(conv)
 	}
 }
 
-func (e *StructEncoder) optInstrRaw() {
+// bind points the interface value at i, holding a pointer of the type the field's methods are
+// called through, at the field v instead. The interface's method table is left as it is, so a
+// prototype can be made once at compile time and bound to each value in turn without reflection or
+// allocation.
+func bind(i unsafe.Pointer, v unsafe.Pointer) {
+	(*iface)(i).Data = v
+}
+
+func (b *structBuilder) optInstrRaw() {
 	conv := func(v unsafe.Pointer, w *Buffer) {
 		s := *(*string)(v)
 		if len(s) == 0 {
@@ -238,71 +589,101 @@ func (e *StructEncoder) optInstrRaw() {
 		w.WriteString(s)
 	}
 
-	if e.f.Type.Kind() == reflect.Ptr {
-		e.ptrval(conv)
+	if b.f.Type.Kind() == reflect.Ptr {
+		b.ptrval(conv)
 	} else {
-		e.val(conv)
+		b.val(conv)
 	}
 }
 
-func (e *StructEncoder) optInstrEscape() {
-	if e.f.Type.Kind() == reflect.Slice {
-		e.flunk()
+func (b *structBuilder) optInstrEscape() {
+	if b.f.Type.Kind() == reflect.Slice {
+		b.flunk()
 
 		/// create an escape string encoder internally instead of mirroring the struct, so people only need to pass the ,escape opt instead
-		enc := NewSliceEncoder([]EscapeString{})
-		f := e.f
-		e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
-			var em interface{} = unsafe.Pointer(uintptr(v) + f.Offset)
-			enc.Marshal(em, w)
+		enc := sharedSlice([]EscapeString{}, allVersions, b.e.esc)
+		b.how, b.nested = "slice", enc
+		f := b.f
+		b.e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+			enc.marshalPtr(unsafe.Pointer(uintptr(v)+f.Offset), w)
 		})
 		return
 	}
 
-	if e.f.Type.Kind() == reflect.Ptr {
-		e.ptrstringval(ptrEscapeStringToBuf)
+	b.how = "escaped string"
+	if b.f.Type.Kind() == reflect.Ptr {
+		b.ptrstringval(escapers[b.e.esc].ptrEscape)
 	} else {
-		e.chunk(`"`)
-		e.val(ptrEscapeStringToBuf)
-		e.chunk(`"`)
+		b.chunk(`"`)
+		b.val(escapers[b.e.esc].ptrEscape)
+		b.chunk(`"`)
+	}
+}
+
+// inline splices the instructions of se, for a struct embedded at offset within ours, into our own.
+// Its static data is merged with the chunks either side and the offsets of its values are moved on,
+// so the nested document is written without the call into its Marshal.
+func (b *structBuilder) inline(se *StructEncoder, offset uintptr) {
+	for _, in := range se.instructions {
+		if in.kind == kindStatic {
+			b.cb.Write(in.static) // not chunk, as se's size is already accounted for
+			continue
+		}
+
+		b.flunk()
+		static := in.static
+		in.static = nil
+
+		if in.fun != nil {
+			fun := in.fun
+			in.fun = func(v unsafe.Pointer, w *Buffer) {
+				fun(unsafe.Pointer(uintptr(v)+offset), w)
+			}
+		} else {
+			in.offset += offset
+		}
+		b.e.instructions = append(b.e.instructions, in)
+		b.cb.Write(static)
 	}
 }
 
 // chunk writes a chunk of body data to the chunk buffer. only for writing static
 //
 //	structure and not dynamic values.
-func (e *StructEncoder) chunk(b string) {
-	e.cb.Write([]byte(b))
+func (b *structBuilder) chunk(s string) {
+	b.cb.Write([]byte(s))
+	b.e.size += len(s)
 }
 
 // flunk flushes whatever chunk data we've got buffered into a single instruction
-func (e *StructEncoder) flunk() {
+func (b *structBuilder) flunk() {
 
-	b := e.cb.Bytes
-	bs := b[e.cpos:]
-	e.cpos = len(b)
+	cb := b.cb.Bytes
+	bs := cb[b.cpos:]
+	b.cpos = len(cb)
 
 	if len(bs) == 0 {
 		return
 	}
 
-	e.instructions = append(e.instructions, instruction{static: bs, kind: kindStatic})
+	b.e.instructions = append(b.e.instructions, instruction{static: bs, kind: kindStatic})
 }
 
 // valueInst works out the conversion function we need for `k` and creates an instruction to write it to the buffer
-func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer, *Buffer))) {
+func (b *structBuilder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer, *Buffer))) {
 
 	switch k {
 
 	case reflect.Int:
 
 		/// fast path for int fields
-		if e.f.Type.Kind() == reflect.Ptr {
+		b.how = "int"
+		if b.f.Type.Kind() == reflect.Ptr {
 			instr(ptrIntToBuf)
 			return
 		}
-		e.flunk()
-		e.instructions = append(e.instructions, instruction{offset: e.f.Offset, kind: kindInt})
+		b.flunk()
+		b.e.instructions = append(b.e.instructions, instruction{offset: b.f.Offset, kind: kindInt})
 
 	case reflect.Bool,
 		reflect.Int8,
@@ -317,6 +698,7 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 		reflect.Float32,
 		reflect.Float64:
 		/// standard print
+		b.how = k.String()
 		conv, ok := typeconv[k]
 		if !ok {
 			return
@@ -325,93 +707,115 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 
 	case reflect.Array:
 		/// support for primitives in arrays (proabbly need arrayencoder.go here if we want to take this further)
-		e.chunk("[")
+		b.chunk("[")
+		b.how = fmt.Sprintf("array of %d %s", b.f.Type.Len(), b.f.Type.Elem().Kind())
 
-		conv, ok := typeconv[e.f.Type.Elem().Kind()]
+		conv, ok := typeconv[b.f.Type.Elem().Kind()]
 		if !ok {
 			return
 		}
 
-		offset := e.f.Type.Elem().Size()
-		for i := 0; i < e.f.Type.Len(); i++ {
+		offset := b.f.Type.Elem().Size()
+		for i := 0; i < b.f.Type.Len(); i++ {
 			if i > 0 {
-				e.chunk(", ")
+				b.chunk(", ")
 			}
 
-			e.flunk()
-			f := e.f
+			b.flunk()
+			f := b.f
 			i := i
-			e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+			b.e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
 				conv(unsafe.Pointer(uintptr(v)+f.Offset+(uintptr(i)*offset)), w)
 			})
 		}
 
-		e.chunk("]")
+		b.chunk("]")
 
 	case reflect.Slice:
 
-		e.flunk()
+		b.flunk()
 
-		enc := NewSliceEncoder(reflect.ValueOf(e.t).Field(e.i).Interface())
-		f := e.f
-		e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
-			var em interface{} = unsafe.Pointer(uintptr(v) + f.Offset)
-			enc.Marshal(em, w)
+		enc := compileSlice(reflect.ValueOf(b.e.t).Field(b.i).Interface(), b.e.version, b.e.esc)
+		b.how, b.nested = "slice", enc
+		f := b.f
+		b.e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+			enc.marshalPtr(unsafe.Pointer(uintptr(v)+f.Offset), w)
 		})
 
 	case reflect.String:
 
+		/// strings in documents for scripts are escaped like any other
+		if b.e.esc&escapeAll != 0 {
+			b.optInstrEscape()
+			b.how = "string"
+			return
+		}
+
 		/// for strings to be nullable they need a special instruction to write quotes conditionally.
-		if e.f.Type.Kind() == reflect.Ptr {
-			e.ptrstringval(ptrStringToBuf)
+		b.how = "string"
+		if b.f.Type.Kind() == reflect.Ptr {
+			b.ptrstringval(ptrStringToBuf)
 			return
 		}
 
 		// otherwise a standard quoted print instruction
-		e.chunk(`"`)
+		b.chunk(`"`)
 
 		/// fast path for strings
-		e.flunk() // flush any chunk data we've buffered
-		e.instructions = append(e.instructions, instruction{offset: e.f.Offset, kind: kindStringField})
-		e.chunk(`"`)
+		b.flunk() // flush any chunk data we've buffered
+		b.e.instructions = append(b.e.instructions, instruction{offset: b.f.Offset, kind: kindStringField})
+		b.chunk(`"`)
 
 	case reflect.Struct:
-		// create an instruction for the field name (as per val)
-		e.flunk()
-
-		if e.f.Type.Kind() == reflect.Ptr {
+		if b.f.Type.Kind() == reflect.Ptr {
+			// create an instruction for the field name (as per val)
+			b.flunk()
 
 			/// now cater for it being a pointer to a struct
-			var inf = reflect.New(reflect.TypeOf(e.t).Field(e.i).Type.Elem()).Elem().Interface()
+			var inf = reflect.New(reflect.TypeOf(b.e.t).Field(b.i).Type.Elem()).Elem().Interface()
 
-			var enc *StructEncoder
-			if e.t == inf {
+			var enc nestedEncoder
+			if b.e.t == inf && b.e.mask == nil {
 				// handle recursive structs by re-using the current encoder
-				enc = e
+				enc = selfRef{b.e}
 			} else {
-				enc = NewStructEncoder(inf)
+				var size int
+				enc, size = compileStruct(inf, b.e.version, b.e.esc)
+				b.e.size += size
 			}
+			b.how, b.nested = "struct", enc
 
 			// now create an instruction to marshal the field
-			f := e.f
-			e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
-				var em interface{} = unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(v) + f.Offset)))
-				if em == unsafe.Pointer(nil) {
+			f := b.f
+			b.e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+				p := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(v) + f.Offset))
+				if p == nil {
 					w.Write(null)
 					return
 				}
-				enc.Marshal(em, w)
+				enc.marshalPtr(p, w)
 			})
 			return
 		}
 
 		// build a new StructEncoder for the type
-		enc := NewStructEncoder(reflect.ValueOf(e.t).Field(e.i).Interface())
-		// now create another instruction which calls marshal on the struct, passing our writer
-		f := e.f
-		e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
-			var em interface{} = unsafe.Pointer(uintptr(v) + f.Offset)
-			enc.Marshal(em, w)
+		enc, size := compileStruct(reflect.ValueOf(b.e.t).Field(b.i).Interface(), b.e.version, b.e.esc)
+		b.e.size += size
+		b.how, b.nested = "struct", enc
+
+		// the struct is part of ours, so its instructions can run in place of a nested Marshal
+		if se, ok := enc.(*StructEncoder); ok {
+			b.inline(se, b.f.Offset)
+			b.how = "inlined struct"
+			return
+		}
+
+		// otherwise it's compiled lazily, create another instruction which calls marshal on the
+		// struct, passing our writer
+		b.flunk()
+		f := b.f
+		b.e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+			enc.marshalPtr(unsafe.Pointer(uintptr(v)+f.Offset), w)
 		})
 		return
 
@@ -425,27 +829,28 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 		reflect.Uintptr,
 		reflect.UnsafePointer:
 		// no
-		panic(fmt.Sprint("unsupported type ", e.f.Type.Kind(), e.f.Name))
+		panic(compileError(fmt.Sprint("unsupported type ", b.f.Type.Kind(), b.f.Name)))
 	}
 }
 
+// compileError is the panic value of the compilers for types or tags they can't encode, which
+// sets them apart from failures of the compilers themselves
+type compileError string
+
 // val creates an instruction to read from a field we're marshaling
-func (e *StructEncoder) val(conv func(unsafe.Pointer, *Buffer)) {
+func (b *structBuilder) val(conv func(unsafe.Pointer, *Buffer)) {
 
-	e.flunk() // flush any chunk data we've buffered
-	e.instructions = append(e.instructions, instruction{leapFun: conv, offset: e.f.Offset})
+	b.flunk() // flush any chunk data we've buffered
+	b.e.instructions = append(b.e.instructions, instruction{leapFun: conv, offset: b.f.Offset})
 }
 
 // ptrval creates an instruction to read from a pointer field we're marshaling
-func (e *StructEncoder) ptrval(conv func(unsafe.Pointer, *Buffer)) {
+func (b *structBuilder) ptrval(conv func(unsafe.Pointer, *Buffer)) {
 
-	e.flunk() // flush any chunk data we've buffered
+	b.flunk() // flush any chunk data we've buffered
 
-	// avoids allocs at runtime
-	null := []byte("null")
-
-	f := e.f
-	e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+	f := b.f
+	b.e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
 
 		p := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(v) + f.Offset)))
 		if p == unsafe.Pointer(nil) {
@@ -457,14 +862,11 @@ func (e *StructEncoder) ptrval(conv func(unsafe.Pointer, *Buffer)) {
 }
 
 // ptrstringval is essentially the same as ptrval but quotes strings if not nil
-func (e *StructEncoder) ptrstringval(conv func(unsafe.Pointer, *Buffer)) {
-	e.flunk() // flush any chunk data we've buffered
-
-	// avoids allocs at runtime
-	null := []byte("null")
+func (b *structBuilder) ptrstringval(conv func(unsafe.Pointer, *Buffer)) {
+	b.flunk() // flush any chunk data we've buffered
 
-	f := e.f
-	e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
+	f := b.f
+	b.e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
 
 		p := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(v) + f.Offset)))
 		if p == unsafe.Pointer(nil) {
@@ -0,0 +1,62 @@
+package jingo
+
+// template.go provides a function for templates to embed documents with, i.e {{ tojson .Data }}
+// inside a script element of an html/template. The document is returned as template.JS, which
+// html/template trusts as it is within a script, so it's made safe there first: <, > and & are
+// replaced with their \u escapes so that no string can close the element or open a comment, as are
+// U+2028 and U+2029, as for JSONP. In valid JSON those characters only appear within strings, where
+// the escapes decode to the same text.
+//
+// That only holds for valid JSON though, and plain string fields are written as they are, so a
+// quote in one would end the string early and leave the rest as script. Struct and slice encoders
+// are compiled again with every string escaped, and whatever any encoder writes is checked with
+// Valid before it's returned, which catches the strings written by String methods, raw fields and
+// encoders of other kinds.
+
+import (
+	"errors"
+	"html/template"
+)
+
+// ErrInvalidDocument is returned by TemplateFunc and MarshalJSONP for an encoder which didn't write
+// valid JSON, which can't be embedded within a script safely.
+var ErrInvalidDocument = errors.New("jingo: encoder wrote invalid JSON")
+
+// TemplateFunc returns a function encoding its argument with enc for use in templates, registered
+// with e.g template.FuncMap{"tojson": jingo.TemplateFunc(enc)}. The result is safe to embed within
+// a script element, or a JavaScript event handler attribute, of an html/template. A *StructEncoder
+// or *SliceEncoder is compiled again for this with every string escaped, plain ones included.
+// Errors encoding the value are returned, as is ErrInvalidDocument should the result not be valid
+// JSON, either of which makes the template's Execute fail.
+func TemplateFunc(enc Encoder) func(v interface{}) (template.JS, error) {
+	enc = scriptEncoder(enc, escapeHTML)
+	return func(v interface{}) (template.JS, error) {
+		doc := getScratch()
+		defer putScratch(doc)
+
+		enc.Marshal(v, doc)
+		if err := doc.Err(); err != nil {
+			return "", err
+		}
+		if !Valid(doc.Bytes) {
+			return "", ErrInvalidDocument
+		}
+
+		b := NewBufferFromPool()
+		defer b.ReturnToPool()
+		writeScript(b, doc.Bytes, true)
+		return template.JS(b.String()), nil
+	}
+}
+
+// scriptEncoder returns enc compiled to escape every string it writes, as esc selects, for struct
+// and slice encoders, which keep their Config and observers. Others are returned as they are.
+func scriptEncoder(enc Encoder, esc escapeMode) Encoder {
+	switch e := enc.(type) {
+	case *StructEncoder:
+		return e.withConfig(e.cfg, e.esc|esc|escapeAll)
+	case *SliceEncoder:
+		return e.withConfig(e.cfg, e.esc|esc|escapeAll)
+	}
+	return enc
+}
@@ -0,0 +1,226 @@
+package jingo
+
+// tokenreader.go provides a pull based tokenizer, the reading counterpart to the token writer. It
+// walks a document a token at a time without building anything from it, which suits picking a few
+// values out of very large documents. Input can be a byte slice or an io.Reader, in which case it's
+// read through a window so the whole document never needs to be held in memory.
+
+import (
+	"fmt"
+	"io"
+)
+
+// TokenKind identifies the type of a Token
+type TokenKind uint8
+
+// The kinds of token returned by TokenReader.Next
+const (
+	TokenBeginObject TokenKind = iota + 1
+	TokenEndObject
+	TokenBeginArray
+	TokenEndArray
+	TokenKey
+	TokenString
+	TokenNumber
+	TokenTrue
+	TokenFalse
+	TokenNull
+)
+
+var tokenNames = [...]string{"", "{", "}", "[", "]", "key", "string", "number", "true", "false", "null"}
+
+func (k TokenKind) String() string {
+	if int(k) < len(tokenNames) {
+		return tokenNames[k]
+	}
+	return "invalid"
+}
+
+// Token is a single token of a document. Value holds the unescaped content of keys and strings,
+// and the text of numbers. It refers to the reader's internal storage so is only valid until the
+// next call to Next.
+type Token struct {
+	Kind  TokenKind
+	Value []byte
+}
+
+// lookahead is the most a token can need to read past the point the window is found wanting,
+// being the length of an escaped surrogate pair
+const lookahead = 12
+
+// TokenReader reads the tokens of a stream of JSON documents.
+type TokenReader struct {
+	s     scanner
+	r     io.Reader // source of further input, nil once exhausted
+	err   error     // error reading from r
+	stack []byte    // the objects and arrays we're inside of
+	open  bool      // the innermost object or array has just opened
+	after bool      // a value has just been read
+	colon bool      // a key has just been read
+}
+
+// NewTokenReader returns a TokenReader over the documents in b.
+func NewTokenReader(b []byte) *TokenReader {
+	return &TokenReader{s: scanner{data: b}}
+}
+
+// NewTokenReaderFrom returns a TokenReader over the documents read from r.
+func NewTokenReaderFrom(r io.Reader) *TokenReader {
+	return &TokenReader{s: scanner{data: make([]byte, 0, 4096)}, r: r}
+}
+
+// Next returns the next token, or io.EOF once the input is exhausted between documents.
+func (r *TokenReader) Next() (Token, error) {
+	for {
+		start, state := r.s.pos, *r
+		tok, err := r.next()
+
+		// a token cut off by the end of the window may be whole once more has been read
+		cut := err != nil && r.s.pos >= len(r.s.data)-lookahead || tok.Kind == TokenNumber && r.s.pos == len(r.s.data)
+		if r.r == nil || !cut {
+			return tok, err
+		}
+
+		*r = state
+		r.s.pos = start
+		r.fill()
+	}
+}
+
+// Skip reads past the next value, including everything within it if it's an object or array.
+func (r *TokenReader) Skip() error {
+	depth := 0
+	for {
+		tok, err := r.Next()
+		if err != nil {
+			return err
+		}
+
+		switch tok.Kind {
+		case TokenBeginObject, TokenBeginArray:
+			depth++
+		case TokenEndObject, TokenEndArray:
+			depth--
+		case TokenKey:
+			continue
+		}
+
+		if depth <= 0 {
+			return nil
+		}
+	}
+}
+
+// fill reads more input into the window, dropping what's already been read
+func (r *TokenReader) fill() {
+	s := &r.s
+	n := copy(s.data, s.data[s.pos:])
+	s.data, s.pos = s.data[:n], 0
+
+	if cap(s.data)-n < minRead {
+		b := make([]byte, n, 2*cap(s.data)+minRead)
+		copy(b, s.data)
+		s.data = b
+	}
+
+	m, err := r.r.Read(s.data[n:cap(s.data)])
+	s.data = s.data[:n+m]
+	if err != nil {
+		if err != io.EOF {
+			r.err = err
+		}
+		r.r = nil
+	}
+}
+
+// next reads the next token from the window
+func (r *TokenReader) next() (Token, error) {
+	s := &r.s
+	c := s.next()
+
+	if c == 0 {
+		if r.err != nil {
+			return Token{}, r.err
+		}
+		if len(r.stack) > 0 || r.colon {
+			return Token{}, s.unexpected("a value")
+		}
+		return Token{}, io.EOF
+	}
+
+	if len(r.stack) == 0 {
+		return r.value(c)
+	}
+	top := r.stack[len(r.stack)-1]
+
+	switch {
+	case r.colon:
+		if err := s.consume(':'); err != nil {
+			return Token{}, err
+		}
+		r.colon = false
+		return r.value(s.next())
+
+	case (r.open || r.after) && c == top+2: // '[' + 2 == ']', '{' + 2 == '}'
+		s.pos++
+		r.stack, r.open, r.after = r.stack[:len(r.stack)-1], false, true
+		if top == '{' {
+			return Token{Kind: TokenEndObject}, nil
+		}
+		return Token{Kind: TokenEndArray}, nil
+
+	case r.after:
+		if c != ',' {
+			return Token{}, s.unexpected(fmt.Sprintf("',' or %q", top+2))
+		}
+		s.pos++
+		c = s.next()
+	}
+
+	r.open = false
+	if top == '{' {
+		k, err := s.string()
+		if err != nil {
+			return Token{}, err
+		}
+		r.colon, r.after = true, false
+		return Token{Kind: TokenKey, Value: k}, nil
+	}
+	return r.value(c)
+}
+
+// value reads a value starting with c
+func (r *TokenReader) value(c byte) (Token, error) {
+	s := &r.s
+	r.after = true
+
+	switch c {
+	case '{', '[':
+		s.pos++
+		r.stack, r.open, r.after = append(r.stack, c), true, false
+		if c == '{' {
+			return Token{Kind: TokenBeginObject}, nil
+		}
+		return Token{Kind: TokenBeginArray}, nil
+
+	case '"':
+		v, err := s.string()
+		return Token{Kind: TokenString, Value: v}, err
+
+	case 't', 'f':
+		v, err := s.bool()
+		if v {
+			return Token{Kind: TokenTrue}, err
+		}
+		return Token{Kind: TokenFalse}, err
+
+	case 'n':
+		if s.null() {
+			return Token{Kind: TokenNull}, nil
+		}
+		return Token{}, s.unexpected("a value")
+	}
+
+	v, err := s.number()
+	return Token{Kind: TokenNumber, Value: v}, err
+}
@@ -0,0 +1,125 @@
+package jingo
+
+// tokenwriter.go provides a low level token writer API on Buffer. It's intended for hand-written
+// encoders of dynamic shapes that can't be described by a struct, where keeping track of commas
+// by hand is error prone. The compiled encoders don't use any of this themselves, but they can be
+// composed with it safely via WriteValue.
+
+import (
+	"strconv"
+)
+
+// BeginObject writes the opening brace of an object
+func (b *Buffer) BeginObject() {
+	b.value()
+	b.Bytes = append(b.Bytes, '{')
+	b.nest = append(b.nest, false)
+}
+
+// EndObject writes the closing brace of the object opened with BeginObject
+func (b *Buffer) EndObject() {
+	b.end()
+	b.Bytes = append(b.Bytes, '}')
+}
+
+// BeginArray writes the opening bracket of an array
+func (b *Buffer) BeginArray() {
+	b.value()
+	b.Bytes = append(b.Bytes, '[')
+	b.nest = append(b.nest, false)
+}
+
+// EndArray writes the closing bracket of the array opened with BeginArray
+func (b *Buffer) EndArray() {
+	b.end()
+	b.Bytes = append(b.Bytes, ']')
+}
+
+// WriteKey writes an escaped object key. The next value written becomes its value.
+func (b *Buffer) WriteKey(k string) {
+	b.value()
+	b.WriteQuotedString(k)
+	b.Bytes = append(b.Bytes, ':')
+	b.key = true
+}
+
+// WriteInt writes an integer value
+func (b *Buffer) WriteInt(v int64) {
+	b.value()
+	b.Bytes = appendInt64(b.Bytes, v)
+}
+
+// WriteUint writes an unsigned integer value
+func (b *Buffer) WriteUint(v uint64) {
+	b.value()
+	b.Bytes = appendUint64(b.Bytes, v)
+}
+
+// WriteFloat writes a floating point value, formatted in the same way as float64 fields
+func (b *Buffer) WriteFloat(v float64) {
+	b.value()
+	b.Bytes = strconv.AppendFloat(b.Bytes, v, 'f', -1, 64)
+}
+
+// WriteBool writes a boolean value
+func (b *Buffer) WriteBool(v bool) {
+	b.value()
+	i := 0
+	if v {
+		i = 1
+	}
+	b.Bytes = append(b.Bytes, bools[i]...)
+}
+
+// WriteNull writes a null value
+func (b *Buffer) WriteNull() {
+	b.value()
+	b.Bytes = append(b.Bytes, null...)
+}
+
+// WriteStringValue writes an escaped, quoted string value
+func (b *Buffer) WriteStringValue(v string) {
+	b.value()
+	b.WriteQuotedString(v)
+}
+
+// WriteRawValue writes a pre-encoded JSON value as-is
+func (b *Buffer) WriteRawValue(v []byte) {
+	b.value()
+	b.Bytes = append(b.Bytes, v...)
+}
+
+// WriteValue writes a value using a compiled encoder, e.g a StructEncoder or SliceEncoder. The
+// encoder starts from a fresh level, so any use of the token writer within it, i.e by a field's
+// own encoder, doesn't see the commas and keys of the document around it.
+func (b *Buffer) WriteValue(enc Encoder, v interface{}) {
+	b.value()
+
+	nest, key := b.nest, b.key
+	b.nest, b.key = nest[len(nest):], false // shares the stack's memory, as it's only added to
+	enc.Marshal(v, b)
+	b.nest, b.key = nest, key
+}
+
+// value is called ahead of writing any value, and writes the separating comma if it needs one
+func (b *Buffer) value() {
+	if b.key {
+		b.key = false
+		return
+	}
+
+	if n := len(b.nest); n > 0 {
+		if b.nest[n-1] {
+			b.Bytes = append(b.Bytes, ',')
+		}
+		b.nest[n-1] = true
+	}
+}
+
+// end pops the current object or array off the nesting stack
+func (b *Buffer) end() {
+	b.key = false
+	if n := len(b.nest); n > 0 {
+		b.nest = b.nest[:n-1]
+	}
+}
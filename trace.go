@@ -0,0 +1,61 @@
+package jingo
+
+// trace.go lets marshalling be bridged to tracing spans, e.g OpenTelemetry's, so that slow
+// documents of particular types show up in traces without touching the call sites. The Tracer is
+// called around each top level document along with the Metrics, see metrics.go.
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Tracer is told as each document an encoder marshals starts and finishes. StartMarshal is called
+// with the name of the type encoded and the context passed to MarshalContext, or
+// context.Background() for Marshal, and returns the function to call once the document has been
+// written with its size and the buffer's Err. With OpenTelemetry, StartMarshal would start a span
+// and the function end it. It's called on the marshalling goroutine so must be safe for concurrent
+// use.
+type Tracer interface {
+	StartMarshal(ctx context.Context, typ string) (finish func(bytes int, err error))
+}
+
+var tracer atomic.Value // tracerBox
+
+// tracerBox holds the global Tracer, as atomic.Value needs the same concrete type each time
+type tracerBox struct {
+	tr Tracer
+}
+
+// SetTracer nominates tr to trace the documents marshalled by every encoder which hasn't had a
+// Tracer of its own set. nil switches global tracing off.
+func SetTracer(tr Tracer) {
+	tracer.Store(tracerBox{tr})
+	setObserving(observeTracer, tr != nil)
+}
+
+// globalTracer returns the Tracer set with SetTracer, if any
+func globalTracer() Tracer {
+	b, _ := tracer.Load().(tracerBox)
+	return b.tr
+}
+
+// tracing reports whether there's a global Tracer
+func tracing() bool {
+	return atomic.LoadUint32(&observeOn)&observeTracer != 0
+}
+
+// SetTracer returns a copy of the encoder whose documents are traced by tr in place of any Tracer
+// set with SetTracer. The encoder itself is left as it is.
+func (e *StructEncoder) SetTracer(tr Tracer) *StructEncoder {
+	v := *e
+	v.tracer = tr
+	return &v
+}
+
+// SetTracer returns a copy of the encoder whose documents are traced by tr in place of any Tracer
+// set with SetTracer. The encoder itself is left as it is.
+func (e *SliceEncoder) SetTracer(tr Tracer) *SliceEncoder {
+	v := *e
+	v.tracer = tr
+	return &v
+}
@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package jingo
+
+// typedencoder.go manages TypedStructEncoder, a generic wrapper around StructEncoder. Binding the
+// type at compile time means values are handed to Marshal as a *T rather than interface{}, which
+// avoids boxing them and gives compile time type safety at the call site.
+
+import (
+	"unsafe"
+)
+
+// TypedStructEncoder is a StructEncoder bound to the struct type T.
+type TypedStructEncoder[T any] struct {
+	enc *StructEncoder
+}
+
+// NewTypedStructEncoder compiles a set of instructions for marshaling the struct type T to a JSON document.
+func NewTypedStructEncoder[T any]() *TypedStructEncoder[T] {
+	var t T
+	return &TypedStructEncoder[T]{enc: NewStructEncoder(t)}
+}
+
+// Marshal executes the instructions for T against v and writes the resulting json document to w
+func (e *TypedStructEncoder[T]) Marshal(v *T, w *Buffer) {
+	e.enc.marshal(unsafe.Pointer(v), w)
+}
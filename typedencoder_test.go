@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package jingo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_TypedStructEncoder(t *testing.T) {
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	NewStructEncoder(SmallPayload{}).Marshal(smallPayload, want)
+
+	enc := NewTypedStructEncoder[SmallPayload]()
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(smallPayload, buf)
+
+	if !bytes.Equal(want.Bytes, buf.Bytes) {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, buf.Bytes)
+	}
+}
+
+func BenchmarkTypedSmallPayload(b *testing.B) {
+
+	e := NewTypedStructEncoder[SmallPayload]()
+	buf := NewBufferFromPool()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Marshal(smallPayload, buf)
+		buf.Reset()
+	}
+}
@@ -0,0 +1,30 @@
+package jingo
+
+// typeencoders.go lets callers take over the encoding of a type wherever it appears, which suits
+// third party types such as decimals or UUIDs which can't carry an 'encoder' option on every field
+// that uses them.
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// typeEncoders holds the functions registered with RegisterTypeEncoder, keyed by reflect.Type
+var typeEncoders sync.Map
+
+// RegisterTypeEncoder nominates fn to encode every value of type t, in place of the encoding jingo
+// would otherwise choose. fn is handed a pointer to the value and must write the complete JSON
+// value, quotes included. It's consulted as encoders are compiled, so should be called before any
+// encoder using t is created, typically from an init func. Tag options on a field take precedence.
+func RegisterTypeEncoder(t reflect.Type, fn func(unsafe.Pointer, *Buffer)) {
+	typeEncoders.Store(t, fn)
+}
+
+// typeEncoderFor returns the function registered for t, if any
+func typeEncoderFor(t reflect.Type) func(unsafe.Pointer, *Buffer) {
+	if fn, ok := typeEncoders.Load(t); ok {
+		return fn.(func(unsafe.Pointer, *Buffer))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package jingo
+
+// versions.go lets one struct serve several versions of an API. Fields can be tagged with the
+// version they were introduced in, `json:"name,since=3"`, and the last version they appear in,
+// `json:"name,until=2"`. MarshalVersion then writes only the fields of the version asked for, using
+// an encoder compiled for that version on first use, so there's no cost per field at runtime.
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// allVersions compiles every field regardless of its since and until options, as Marshal writes
+const allVersions = -1
+
+// inVersion reports whether a field with these options is part of the given API version
+func (o tagOptions) inVersion(version int) bool {
+	if version == allVersions {
+		return true
+	}
+	if n, ok := o.intValue("since"); ok && version < n {
+		return false
+	}
+	if n, ok := o.intValue("until"); ok && version > n {
+		return false
+	}
+	return true
+}
+
+// intValue returns the value of a name=N option, if there is one
+func (o tagOptions) intValue(name string) (int, bool) {
+	for _, opt := range strings.Split(string(o), ",") {
+		if !strings.HasPrefix(opt, name+"=") {
+			continue
+		}
+
+		n, err := strconv.Atoi(opt[len(name)+1:])
+		if err != nil {
+			panic(compileError(fmt.Sprint("invalid ", name, " option ", opt)))
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// MarshalVersion is Marshal, but writes only the fields belonging to the given API version, as set
+// by their since and until tag options. Versions are counted from zero.
+func (e *StructEncoder) MarshalVersion(s interface{}, w *Buffer, version int) {
+	base := e
+	if base.base != nil {
+		base = base.base
+	}
+
+	e.marshalVariant(s, w, sharedStruct(base.t, version, base.esc))
+}
+
+// marshalVariant writes s using v, a variant of the encoder compiled with a subset of its fields,
+// applying the encoder's own Config, hooks, Metrics and Tracer
+func (e *StructEncoder) marshalVariant(s interface{}, w *Buffer, v *StructEncoder) {
+	if e.base != nil {
+		e.run(s, w, func(p unsafe.Pointer, w *Buffer) { marshalConfig(p, w, &e.cfg, v.marshal) })
+		return
+	}
+	e.run(s, w, v.marshal)
+}
+
+// MarshalVersion is Marshal, but the elements include only the fields belonging to the given API
+// version, as set by their since and until tag options. Versions are counted from zero.
+func (e *SliceEncoder) MarshalVersion(s interface{}, w *Buffer, version int) {
+	base := e
+	if base.base != nil {
+		base = base.base
+	}
+
+	v := sharedSlice(reflect.Zero(base.tt).Interface(), version, base.esc)
+	if e.base != nil {
+		e.run(s, w, func(p unsafe.Pointer, w *Buffer) { marshalConfig(p, w, &e.cfg, v.marshal) })
+		return
+	}
+	e.run(s, w, v.marshal)
+}
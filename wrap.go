@@ -0,0 +1,37 @@
+package jingo
+
+// wrap.go adapts the encoders to encoding/json, so values encoded by jingo can be embedded in
+// documents and code paths which still go through the stdlib.
+
+import (
+	"encoding/json"
+)
+
+// wrapped is the json.Marshaler returned by Wrap
+type wrapped struct {
+	enc Encoder
+	v   interface{}
+}
+
+// Wrap returns a json.Marshaler which encodes v with enc. As with Marshal, v must be a pointer to
+// the type the encoder was compiled for.
+func Wrap(enc Encoder, v interface{}) json.Marshaler {
+	return wrapped{enc: enc, v: v}
+}
+
+// MarshalJSON encodes the value into a pooled buffer, returning a copy of the result.
+func (m wrapped) MarshalJSON() ([]byte, error) {
+	b := NewBufferFromPool()
+	m.enc.Marshal(m.v, b)
+
+	if err := b.Err(); err != nil {
+		b.ReturnToPool()
+		return nil, err
+	}
+
+	out := make([]byte, len(b.Bytes))
+	copy(out, b.Bytes)
+	b.ReturnToPool()
+
+	return out, nil
+}
@@ -0,0 +1,27 @@
+//go:build goexperiment.jsonv2
+// +build goexperiment.jsonv2
+
+package jingo
+
+// wrap_jsonv2.go extends Wrap to encoding/json/v2, which is built only with GOEXPERIMENT=jsonv2
+// while it's experimental. json/v2 prefers MarshalJSONTo over MarshalJSON, so values wrapped by
+// Wrap are written straight into the caller's jsontext.Encoder rather than copied out first.
+
+import (
+	"encoding/json/jsontext"
+	jsonv2 "encoding/json/v2"
+)
+
+var _ jsonv2.MarshalerTo = wrapped{} // commit to compatibility with json/v2
+
+// MarshalJSONTo encodes the value into a pooled buffer and writes it to e as a single value.
+func (m wrapped) MarshalJSONTo(e *jsontext.Encoder) error {
+	b := NewBufferFromPool()
+	defer b.ReturnToPool()
+
+	m.enc.Marshal(m.v, b)
+	if err := b.Err(); err != nil {
+		return err
+	}
+	return e.WriteValue(jsontext.Value(b.Bytes))
+}
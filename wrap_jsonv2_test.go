@@ -0,0 +1,30 @@
+//go:build goexperiment.jsonv2
+// +build goexperiment.jsonv2
+
+package jingo
+
+import (
+	jsonv2 "encoding/json/v2"
+	"testing"
+)
+
+func Test_WrapJSONv2(t *testing.T) {
+
+	enc := NewStructEncoder(LargePayload{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(largePayload, want)
+
+	got, err := jsonv2.Marshal(map[string]any{"payload": Wrap(enc, largePayload)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := `{"payload":` + want.String() + `}`; string(got) != w {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", w, got)
+	}
+
+	if _, err := jsonv2.Marshal(Wrap(failingEncoder{}, largePayload)); err == nil {
+		t.Error("expected the encoder's error")
+	}
+}